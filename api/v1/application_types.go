@@ -20,16 +20,194 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	// DefaultSyncPeriodMinutes is the sync period used if .spec.syncPeriod is not set
+	DefaultSyncPeriodMinutes int32 = 3
+
+	// DefaultTargetRevision is the revision synced if .spec.source.targetRevision is not set
+	DefaultTargetRevision string = "HEAD"
+
+	// DefaultDestinationNamespace is the namespace of resources without a namespace if .spec.destination.namespace is not set
+	DefaultDestinationNamespace string = "default"
+
+	// RepoSecretAPITokenKey is the key of the github API token in the secret referenced by .spec.source.repoSecret
+	RepoSecretAPITokenKey string = "apiToken"
+
+	// RepoSecretUsernameKey is the key of the registry username in the secret of an OCI source
+	RepoSecretUsernameKey string = "username"
+
+	// RepoSecretPasswordKey is the key of the registry password in the secret of an OCI source
+	RepoSecretPasswordKey string = "password"
+
+	// OCISourcePrefix marks sources that are OCI artifacts, e.g. oci://registry.example.com/manifests/app:v1
+	OCISourcePrefix string = "oci://"
+
+	// S3SourcePrefix marks sources that are bundles in an S3-compatible bucket, e.g. s3://bucket/manifests/app.tar.gz
+	S3SourcePrefix string = "s3://"
+
+	// RepoSecretAccessKeyIDKey is the key of the access key ID in the secret of an S3 source
+	RepoSecretAccessKeyIDKey string = "accessKeyID"
+
+	// RepoSecretSecretAccessKeyKey is the key of the secret access key in the secret of an S3 source
+	RepoSecretSecretAccessKeyKey string = "secretAccessKey"
+
+	// RepoSecretRegionKey is the key of the bucket region in the secret of an S3 source. Defaults to us-east-1
+	RepoSecretRegionKey string = "region"
+
+	// RepoSecretEndpointKey is the key of the endpoint of an S3-compatible service in the secret of an S3 source,
+	// e.g. https://minio.example.com. Defaults to the AWS endpoint of the region
+	RepoSecretEndpointKey string = "endpoint"
+)
+
 // ApplicationSpec defines the desired state of Application
 type ApplicationSpec struct {
-	// Reference to the location of the applications manifests
-	Source ApplicationSource `json:"source"`
+	// Reference to the location of the applications manifests. Either source or sources must be set
+	// +optional
+	Source ApplicationSource `json:"source,omitempty"`
+
+	// Locations of the application's manifests if they are spread over several repositories or paths.
+	// The objects of all sources are merged, setting a field of the same object to different values in
+	// two sources is a conflict that fails the sync
+	// +optional
+	Sources []ApplicationSource `json:"sources,omitempty"`
+
+	// Name of the Project that limits what the application may deploy. Projects are read from the namespace
+	// of the application, or from the project namespace of the controller if it has one. The application is
+	// not restricted if empty, unless the controller has a project namespace, then the default project applies
+	// +optional
+	Project string `json:"project,omitempty"`
+
+	// Where the application is deployed to
+	// +optional
+	Destination ApplicationDestination `json:"destination,omitempty"`
 
 	//+kubebuilder:validation:Minimum=1
 
 	// Time in between sync attempts in minutes. Defaults to 3.
 	// +optional
 	SyncPeriodMinutes *int32 `json:"syncPeriod,omitempty"`
+
+	// Controls how the application is synced
+	// +optional
+	SyncPolicy *SyncPolicy `json:"syncPolicy,omitempty"`
+
+	// Service account in the namespace of the application that is impersonated to apply, prune and read
+	// the application's resources. If not set, the controller's default service account for applications
+	// is impersonated if configured, otherwise the controller's own service account is used
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Fields that are ignored when comparing live resources with git and that are not
+	// overwritten on sync, e.g. replicas managed by a HorizontalPodAutoscaler
+	// +optional
+	IgnoreDifferences []ResourceIgnoreDifferences `json:"ignoreDifferences,omitempty"`
+
+	// Variables substituted in the manifests before they are applied
+	// +optional
+	PostBuild *PostBuild `json:"postBuild,omitempty"`
+}
+
+// PostBuild replaces references to variables, e.g. ${CLUSTER_NAME} or ${REPLICAS:=2}, in the manifests
+// with their values, so the same manifests can be deployed with different values
+type PostBuild struct {
+	// Variables and their values. Take precedence over the variables of substituteFrom
+	// +optional
+	Substitute map[string]string `json:"substitute,omitempty"`
+
+	// ConfigMaps and Secrets in the namespace of the application whose entries are variables.
+	// Later references take precedence over earlier ones
+	// +optional
+	SubstituteFrom []SubstituteReference `json:"substituteFrom,omitempty"`
+
+	// Fails the sync if a manifest references a variable that is not set and has no default.
+	// Otherwise such references are replaced with an empty string
+	// +optional
+	Strict bool `json:"strict,omitempty"`
+}
+
+// SubstituteReference references a ConfigMap or Secret holding variables
+type SubstituteReference struct {
+	// Kind of the object holding the variables
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	Kind string `json:"kind"`
+
+	// Name of the ConfigMap or Secret in the namespace of the application
+	Name string `json:"name"`
+
+	// Skips the reference if the ConfigMap or Secret does not exist instead of failing the sync
+	// +optional
+	Optional bool `json:"optional,omitempty"`
+}
+
+// ResourceIgnoreDifferences selects fields of matching resources whose differences are ignored
+type ResourceIgnoreDifferences struct {
+	// +optional
+	Group string `json:"group,omitempty"`
+
+	Kind string `json:"kind"`
+
+	// Matches resources of any name if empty
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Matches resources in any namespace if empty
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// JSON pointers (RFC 6901) to the ignored fields, e.g. /spec/replicas
+	// +optional
+	JSONPointers []string `json:"jsonPointers,omitempty"`
+
+	// JQ-like path expressions to the ignored fields, e.g. .webhooks[].clientConfig.caBundle or
+	// .spec.template.spec.containers[] | select(.name == "app").image
+	// +optional
+	JQPathExpressions []string `json:"jqPathExpressions,omitempty"`
+}
+
+// SyncPolicy controls how an application is synced
+type SyncPolicy struct {
+	// Suspends automated syncs. Only sync operations requested with .operation are run
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Runs every sync with server-side dry-run. Nothing in the cluster is changed,
+	// the outcome is recorded in .status.dryRun
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Controls how failed syncs are retried.
+	// If not set failed syncs are retried 5 times with a backoff starting at 5s
+	// +optional
+	Retry *RetryStrategy `json:"retry,omitempty"`
+}
+
+// RetryStrategy controls how failed syncs are retried
+type RetryStrategy struct {
+	// Maximum number of attempts before the application is marked as stalled.
+	// A negative value retries forever. Defaults to 5
+	// +optional
+	Limit *int32 `json:"limit,omitempty"`
+
+	// Backoff between attempts
+	// +optional
+	Backoff *Backoff `json:"backoff,omitempty"`
+}
+
+// Backoff is an exponential backoff between sync attempts
+type Backoff struct {
+	// Backoff after the first failed attempt. Defaults to 5s
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	//+kubebuilder:validation:Minimum=1
+
+	// Factor the backoff is multiplied by after every failed attempt. Defaults to 2
+	// +optional
+	Factor *int32 `json:"factor,omitempty"`
+
+	// Maximum backoff between attempts. Defaults to 3m
+	// +optional
+	MaxDuration *metav1.Duration `json:"maxDuration,omitempty"`
 }
 
 // ApplicationStatus defines the observed state of Application
@@ -43,20 +221,128 @@ type ApplicationStatus struct {
 	// Time indicating lst time application was synced
 	SyncedAt *metav1.Time `json:"syncedAt,omitempty"`
 
+	// The generation of the application spec that was last synced
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Hash of the application spec that was last synced. Clearing a completed operation bumps the
+	// generation without changing the spec, which must not require another sync
+	// +optional
+	ObservedSpecHash string `json:"observedSpecHash,omitempty"`
+
 	// Information about sync
 	Sync SyncStatus `json:"sync"`
+
+	// Number of consecutive failed sync attempts. Reset after a successful sync
+	// +optional
+	FailedSyncAttempts int32 `json:"failedSyncAttempts,omitempty"`
+
+	// Error of the last failed sync attempt
+	// +optional
+	LastSyncError string `json:"lastSyncError,omitempty"`
+
+	// Revision the sources resolved to in the last sync attempt. A stalled application is retried once
+	// its sources resolve to another revision
+	// +optional
+	LastAttemptedRevision string `json:"lastAttemptedRevision,omitempty"`
+
+	// Most recent syncs, newest first
+	// +optional
+	History []SyncHistoryEntry `json:"history,omitempty"`
+
+	// Outcome of the last dry-run sync
+	// +optional
+	DryRun *DryRunStatus `json:"dryRun,omitempty"`
+
+	// Sync status and health of the applications among the resources of this application
+	// +optional
+	Children *ChildrenStatus `json:"children,omitempty"`
+
+	// Latest observations of the application's state
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// HealthStatusCode is the health of an application managed by another application
+type HealthStatusCode string
+
+const (
+	// The latest spec was synced without errors
+	HealthStatusHealthy HealthStatusCode = "Healthy"
+
+	// The latest spec was not synced yet
+	HealthStatusProgressing HealthStatusCode = "Progressing"
+
+	// The application does not exist (yet)
+	HealthStatusMissing HealthStatusCode = "Missing"
+
+	// The last sync failed
+	HealthStatusDegraded HealthStatusCode = "Degraded"
+)
+
+// ChildrenStatus aggregates the status of the applications managed by an application
+type ChildrenStatus struct {
+	// OutOfSync if any child is out of sync, Unknown if the sync status of any child is not known yet
+	SyncStatus SyncStatusCode `json:"syncStatus"`
+
+	// The worst health of any child
+	Health HealthStatusCode `json:"health"`
+
+	// +optional
+	Applications []ChildApplicationStatus `json:"applications,omitempty"`
+}
+
+// ChildApplicationStatus is the status of an application managed by another application
+type ChildApplicationStatus struct {
+	Name string `json:"name"`
+
+	Namespace string `json:"namespace"`
+
+	SyncStatus SyncStatusCode `json:"syncStatus"`
+
+	Health HealthStatusCode `json:"health"`
+
+	// Why the application is not healthy
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
+const (
+	// ConditionTypeStalled is true when a sync kept failing and retries have been exhausted.
+	// The application is retried after its spec changes or its sources move to a new revision,
+	// which is checked every sync period
+	ConditionTypeStalled string = "Stalled"
+
+	// ConditionTypeDryRunSucceeded is true when all resources passed the last dry-run sync
+	ConditionTypeDryRunSucceeded string = "DryRunSucceeded"
+
+	// ConditionTypeSharedResource is true when the application targets resources that are managed by
+	// another application. It is set on both applications
+	ConditionTypeSharedResource string = "SharedResource"
+
+	// ConditionTypeCommitVerified is true when the commits of all sources with verifyCommit are signed by a
+	// trusted key. The application is not synced while it is false
+	ConditionTypeCommitVerified string = "CommitVerified"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:JSONPath=.status.sync.syncStatus,name=status,type=string
+//+kubebuilder:printcolumn:JSONPath=.status.children.health,name=children,type=string,priority=1
 
 // Application is the Schema for the applications API
 type Application struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   ApplicationSpec   `json:"spec,omitempty"`
+	Spec ApplicationSpec `json:"spec,omitempty"`
+
+	// Operation requested on the application. Removed by the controller once the operation completed
+	// +optional
+	Operation *Operation `json:"operation,omitempty"`
+
 	Status ApplicationStatus `json:"status,omitempty"`
 }
 
@@ -71,7 +357,10 @@ type ApplicationList struct {
 
 // ApplicationSource contains all required information about the (git) source of the application
 type ApplicationSource struct {
-	// URL to the git repository that contains the application manifests
+	// URL to the git repository that contains the application manifests, or the reference of an OCI
+	// artifact containing them, e.g. oci://registry.example.com/manifests/app:v1 or oci://registry.example.com/manifests/app@sha256:...
+	// Bundles of manifests are fetched from http(s) URLs ending in .tar.gz, .tgz or .tar, or from
+	// S3-compatible buckets, e.g. s3://bucket/manifests/app.tar.gz
 	RepoURL string `json:"repoURL"`
 
 	// Path is the directory within the Git repository where your manifest(s) live(s)
@@ -80,16 +369,158 @@ type ApplicationSource struct {
 	// Defines the revision of the source to the sync the application to.
 	// This can be a git commit, tag or branch.
 	// If empty will default to HEAD
+	// For OCI sources whose reference has no tag or digest, this is the tag. Defaults to latest
+	// For bundles this is the expected sha256:<checksum> of the bundle. If empty the bundle is synced
+	// whenever its ETag changes
+	// A semver constraint like ~1.4, ^2, 1.x or ">=2.0.0 <3" is resolved to the latest matching tag
+	// of the git repository or OCI repository on every sync
 	// +optional
 	TargetRevision string `json:"targetRevision,omitempty"`
 
+	// Whether pre-release tags like v1.5.0-rc.1 are considered when targetRevision is a semver constraint.
+	// Without it, pre-releases only match comparators with a pre-release of the same version, e.g. >=1.5.0-rc.0
+	// +optional
+	IncludePrerelease bool `json:"includePrerelease,omitempty"`
+
+	// Only sync commits with a valid GPG or SSH signature of a trusted key. Only supported for git repositories
+	// +optional
+	VerifyCommit *CommitVerification `json:"verifyCommit,omitempty"`
+
 	// Name of secret that contains Github API token
 	// This secret should have stringData with apiToken field
 	// If using a public repository this is not needed
+	// For OCI sources and http(s) bundles the secret contains username and password, or an apiToken sent as bearer token
+	// For S3 sources the secret contains accessKeyID and secretAccessKey, and optionally region and endpoint
 	// +optional
 	RepoSecret string `json:"repoSecret,omitempty"`
 }
 
+// CommitVerification references the keys that are trusted to sign commits
+type CommitVerification struct {
+	// Kind of the object holding the trusted keys
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	// +kubebuilder:default=ConfigMap
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Name of the ConfigMap or Secret in the namespace of the application. Every entry holds an armored
+	// GPG public key or SSH public keys in authorized_keys format
+	Name string `json:"name"`
+}
+
+// ApplicationDestination contains information about where the application is deployed to
+type ApplicationDestination struct {
+	// Namespace of resources that do not set a namespace in their manifests. Defaults to "default"
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Operation is an operation requested on an application
+type Operation struct {
+	// Sync the application right away, even if automated syncs are suspended
+	// +optional
+	Sync *SyncOperation `json:"sync,omitempty"`
+}
+
+// SyncOperation requests a sync of the application
+type SyncOperation struct {
+	// Restricts the sync to the resources matching any of these selectors.
+	// Only matching resources are applied and pruned. All resources are synced if empty
+	// +optional
+	Resources []ResourceSelector `json:"resources,omitempty"`
+
+	// Runs the sync with server-side dry-run, see .spec.syncPolicy.dryRun
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// ResourceSelector selects resources of an application. Unset fields match any resource
+type ResourceSelector struct {
+	// +optional
+	Group string `json:"group,omitempty"`
+
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// +optional
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+}
+
+// SyncHistoryEntry records a completed sync
+type SyncHistoryEntry struct {
+	// Commit SHA that was synced
+	Revision string `json:"revision"`
+
+	// Time the sync completed
+	SyncedAt metav1.Time `json:"syncedAt"`
+
+	// True if only a subset of the resources was synced
+	// +optional
+	Partial bool `json:"partial,omitempty"`
+
+	// Selectors a partial sync was restricted to
+	// +optional
+	Resources []ResourceSelector `json:"resources,omitempty"`
+}
+
+// DryRunStatus is the outcome of a dry-run sync
+type DryRunStatus struct {
+	// Commit SHA that was dry-run
+	Revision string `json:"revision"`
+
+	// The generation of the application spec that was dry-run
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Time the dry-run completed
+	RanAt metav1.Time `json:"ranAt"`
+
+	// Resources that would have been changed by the sync
+	// +optional
+	Resources []DryRunResult `json:"resources,omitempty"`
+}
+
+// DryRunAction is the change a sync would make to a resource
+// +kubebuilder:validation:Enum=Create;Update;Delete
+type DryRunAction string
+
+const (
+	DryRunActionCreate DryRunAction = "Create"
+	DryRunActionUpdate DryRunAction = "Update"
+	DryRunActionDelete DryRunAction = "Delete"
+)
+
+// DryRunResult is the dry-run outcome for a single resource
+type DryRunResult struct {
+	// +optional
+	Group string `json:"group,omitempty"`
+
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	Action DryRunAction `json:"action"`
+
+	// Error returned by the API server, e.g. a validation error or an admission webhook rejection.
+	// Empty if the change would have been accepted
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
 // SyncStatusCode is a type representing possible comparison/sync states
 type SyncStatusCode string
 
@@ -128,11 +559,61 @@ type Resource struct {
 	// - "OutOfSync"
 	// +optional
 	Status SyncStatusCode `json:"status,omitempty"`
+
+	// Set if the resource could not be synced
+	// +optional
+	Warning *ResourceWarning `json:"warning,omitempty"`
 }
 
+// ResourceWarning explains why a resource could not be synced
+type ResourceWarning struct {
+	// Type of the warning, e.g. SharedResource
+	Type string `json:"type"`
+
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// The <namespace>/<name> of the application managing a shared resource
+	// +optional
+	ManagedBy string `json:"managedBy,omitempty"`
+}
+
+const (
+	// ResourceWarningSharedResource is set on resources that are managed by another application.
+	// They are not applied until the other application stops managing them
+	ResourceWarningSharedResource string = "SharedResource"
+
+	// ResourceWarningProjectViolation is set on resources that are not permitted by the application's project.
+	// They are neither applied nor pruned
+	ResourceWarningProjectViolation string = "ProjectViolation"
+)
+
 type SyncStatus struct {
 	SyncStatus SyncStatusCode    `json:"syncStatus"`
 	Source     ApplicationSource `json:"source"`
+
+	// Sources of an application with multiple sources when it was last synced
+	// +optional
+	Sources []ApplicationSource `json:"sources,omitempty"`
+
+	// Commit SHA the target revision resolved to when the application was last synced. For applications
+	// with multiple sources, the commit SHAs of the sources in order, separated by commas
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
+	// Tag the semver constraint in the target revision resolved to when the application was last synced.
+	// For applications with multiple sources, the tags of the sources in order, separated by commas.
+	// Empty if no target revision is a semver constraint
+	// +optional
+	Tag string `json:"tag,omitempty"`
+}
+
+// GetSources returns the sources of an application: spec.sources if set, spec.source otherwise
+func (s *ApplicationSpec) GetSources() []ApplicationSource {
+	if len(s.Sources) > 0 {
+		return s.Sources
+	}
+	return []ApplicationSource{s.Source}
 }
 
 func init() {
@@ -0,0 +1,341 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var (
+	sha256DigestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	// names of variables substituted by postBuild
+	variableNamePattern = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*$`)
+)
+
+// log is for logging in this package.
+var applicationlog = logf.Log.WithName("application-resource")
+
+// SetupWebhookWithManager registers the defaulting and validating webhooks for Applications with the manager
+func (r *Application) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&applicationDefaulter{}).
+		// secrets are read directly from the API server so the manager does not have to cache all secrets
+		WithValidator(&applicationValidator{client: mgr.GetAPIReader()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-gitops-jellis18-gitopscontroller-io-v1-application,mutating=true,failurePolicy=fail,sideEffects=None,groups=gitops.jellis18.gitopscontroller.io,resources=applications,verbs=create;update,versions=v1,name=mapplication.kb.io,admissionReviewVersions=v1
+
+type applicationDefaulter struct{}
+
+// Default fills in the defaults of unset optional fields
+func (d *applicationDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	app, ok := obj.(*Application)
+	if !ok {
+		return fmt.Errorf("expected an Application but got a %T", obj)
+	}
+	applicationlog.Info("default", "name", app.Name)
+
+	app.SetDefaults()
+	return nil
+}
+
+// SetDefaults fills in the defaults of unset optional fields. Controllers creating Applications use it
+// to compare their spec with the defaulted spec stored in the cluster
+func (r *Application) SetDefaults() {
+	if r.Spec.SyncPeriodMinutes == nil {
+		syncPeriod := DefaultSyncPeriodMinutes
+		r.Spec.SyncPeriodMinutes = &syncPeriod
+	}
+	if len(r.Spec.Sources) == 0 && r.Spec.Source.TargetRevision == "" {
+		r.Spec.Source.TargetRevision = DefaultTargetRevision
+	}
+	for i := range r.Spec.Sources {
+		if r.Spec.Sources[i].TargetRevision == "" {
+			r.Spec.Sources[i].TargetRevision = DefaultTargetRevision
+		}
+		r.Spec.Sources[i].VerifyCommit.setDefaults()
+	}
+	r.Spec.Source.VerifyCommit.setDefaults()
+	if r.Spec.Destination.Namespace == "" {
+		r.Spec.Destination.Namespace = DefaultDestinationNamespace
+	}
+}
+
+func (v *CommitVerification) setDefaults() {
+	if v != nil && v.Kind == "" {
+		v.Kind = "ConfigMap"
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-gitops-jellis18-gitopscontroller-io-v1-application,mutating=false,failurePolicy=fail,sideEffects=None,groups=gitops.jellis18.gitopscontroller.io,resources=applications,verbs=create;update,versions=v1,name=vapplication.kb.io,admissionReviewVersions=v1
+
+type applicationValidator struct {
+	client client.Reader
+}
+
+// ValidateCreate validates a new Application
+func (v *applicationValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	app, ok := obj.(*Application)
+	if !ok {
+		return fmt.Errorf("expected an Application but got a %T", obj)
+	}
+	applicationlog.Info("validate create", "name", app.Name)
+
+	return v.validate(ctx, app, true)
+}
+
+// ValidateUpdate validates an updated Application. Updates that don't change the spec, like the ones of the
+// controller adding or removing its finalizer or clearing an operation, and updates of Applications being
+// deleted are always allowed, so that an invalid Application can still be deleted
+func (v *applicationValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	app, ok := newObj.(*Application)
+	if !ok {
+		return fmt.Errorf("expected an Application but got a %T", newObj)
+	}
+	oldApp, ok := oldObj.(*Application)
+	if !ok {
+		return fmt.Errorf("expected an Application but got a %T", oldObj)
+	}
+	if app.DeletionTimestamp != nil || equality.Semantic.DeepEqual(oldApp.Spec, app.Spec) {
+		return nil
+	}
+	applicationlog.Info("validate update", "name", app.Name)
+
+	// repo secrets may be deleted before the Applications using them, e.g. when a namespace is deleted
+	return v.validate(ctx, app, false)
+}
+
+// ValidateDelete allows all Applications to be deleted
+func (v *applicationValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+// Validates the spec of an Application. Missing repo secrets are only rejected if requireSecrets is set
+func (v *applicationValidator) validate(ctx context.Context, app *Application, requireSecrets bool) error {
+	var allErrs field.ErrorList
+
+	if len(app.Spec.Sources) == 0 {
+		allErrs = append(allErrs, v.validateSource(ctx, field.NewPath("spec", "source"), app.Namespace, app.Spec.Source, requireSecrets)...)
+	} else {
+		if app.Spec.Source.RepoURL != "" || app.Spec.Source.Path != "" {
+			allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "source"), "must not be set together with spec.sources"))
+		}
+		sourcesPath := field.NewPath("spec", "sources")
+		seen := make(map[[3]string]bool)
+		for i, source := range app.Spec.Sources {
+			allErrs = append(allErrs, v.validateSource(ctx, sourcesPath.Index(i), app.Namespace, source, requireSecrets)...)
+			key := [3]string{source.RepoURL, source.Path, source.TargetRevision}
+			if seen[key] {
+				allErrs = append(allErrs, field.Duplicate(sourcesPath.Index(i), source))
+			}
+			seen[key] = true
+		}
+	}
+
+	if namespace := app.Spec.Destination.Namespace; namespace != "" {
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "destination", "namespace"), namespace, msg))
+		}
+	}
+
+	if serviceAccount := app.Spec.ServiceAccountName; serviceAccount != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(serviceAccount) {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "serviceAccountName"), serviceAccount, msg))
+		}
+	}
+
+	if app.Spec.SyncPolicy != nil && app.Spec.SyncPolicy.Retry != nil && app.Spec.SyncPolicy.Retry.Backoff != nil {
+		backoff := app.Spec.SyncPolicy.Retry.Backoff
+		backoffPath := field.NewPath("spec", "syncPolicy", "retry", "backoff")
+		if backoff.Duration != nil && backoff.Duration.Duration < 0 {
+			allErrs = append(allErrs, field.Invalid(backoffPath.Child("duration"), backoff.Duration.String(), "must not be negative"))
+		}
+		if backoff.MaxDuration != nil && backoff.MaxDuration.Duration < 0 {
+			allErrs = append(allErrs, field.Invalid(backoffPath.Child("maxDuration"), backoff.MaxDuration.String(), "must not be negative"))
+		}
+	}
+
+	if postBuild := app.Spec.PostBuild; postBuild != nil {
+		postBuildPath := field.NewPath("spec", "postBuild")
+		for name := range postBuild.Substitute {
+			if !variableNamePattern.MatchString(name) {
+				allErrs = append(allErrs, field.Invalid(postBuildPath.Child("substitute").Key(name), name,
+					"must consist of letters, digits and underscores and must not start with a digit"))
+			}
+		}
+		for i, ref := range postBuild.SubstituteFrom {
+			for _, msg := range validation.IsDNS1123Subdomain(ref.Name) {
+				allErrs = append(allErrs, field.Invalid(postBuildPath.Child("substituteFrom").Index(i).Child("name"), ref.Name, msg))
+			}
+		}
+	}
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("Application").GroupKind(), app.Name, allErrs)
+}
+
+func (v *applicationValidator) validateSource(ctx context.Context, sourcePath *field.Path, namespace string, source ApplicationSource, requireSecrets bool) field.ErrorList {
+	var allErrs field.ErrorList
+	if err := validateRepoURL(source.RepoURL); err != nil {
+		allErrs = append(allErrs, field.Invalid(sourcePath.Child("repoURL"), source.RepoURL, err.Error()))
+	}
+	if err := validateSourcePath(source.Path); err != nil {
+		allErrs = append(allErrs, field.Invalid(sourcePath.Child("path"), source.Path, err.Error()))
+	}
+	if isBundleURL(source.RepoURL) && source.TargetRevision != "" && source.TargetRevision != DefaultTargetRevision &&
+		!sha256DigestPattern.MatchString(source.TargetRevision) {
+		allErrs = append(allErrs, field.Invalid(sourcePath.Child("targetRevision"), source.TargetRevision,
+			"must be the sha256:<checksum> of the bundle"))
+	}
+	if source.VerifyCommit != nil && (strings.HasPrefix(source.RepoURL, OCISourcePrefix) || isBundleURL(source.RepoURL)) {
+		allErrs = append(allErrs, field.Forbidden(sourcePath.Child("verifyCommit"), "only supported for git repositories"))
+	}
+	if secretName := source.RepoSecret; secretName != "" {
+		allErrs = append(allErrs, v.validateRepoSecret(ctx, sourcePath.Child("repoSecret"), namespace, secretName, source.RepoURL, requireSecrets)...)
+	}
+	return allErrs
+}
+
+// Only github repositories, OCI artifacts and bundles are supported, e.g. https://github.com/owner/repo.git
+func validateRepoURL(repoURL string) error {
+	if strings.HasPrefix(repoURL, OCISourcePrefix) {
+		return validateOCIReference(repoURL)
+	}
+	if strings.HasPrefix(repoURL, S3SourcePrefix) {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(repoURL, S3SourcePrefix), "/")
+		if bucket == "" || key == "" {
+			return fmt.Errorf("must point to an object in a bucket, e.g. s3://bucket/manifests/app.tar.gz")
+		}
+		return nil
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("must be an http(s) url")
+	}
+	if isBundleURL(repoURL) {
+		return nil
+	}
+	if u.Host != "github.com" {
+		return fmt.Errorf("only github.com repositories are supported")
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) != 2 || segments[0] == "" || strings.TrimSuffix(segments[1], ".git") == "" {
+		return fmt.Errorf("must point to a repository, e.g. https://github.com/owner/repo")
+	}
+	return nil
+}
+
+// The path must stay within the repository
+func validateSourcePath(sourcePath string) error {
+	if path.IsAbs(sourcePath) {
+		return fmt.Errorf("must be relative to the repository root")
+	}
+	for _, segment := range strings.Split(sourcePath, "/") {
+		if segment == ".." {
+			return fmt.Errorf("must not traverse outside of the repository")
+		}
+	}
+	return nil
+}
+
+// OCI references look like oci://registry.example.com/repository[:tag][@sha256:digest]
+func validateOCIReference(repoURL string) error {
+	registry, repository, ok := strings.Cut(strings.TrimPrefix(repoURL, OCISourcePrefix), "/")
+	if !ok || registry == "" || repository == "" {
+		return fmt.Errorf("must be an OCI reference, e.g. oci://registry.example.com/manifests/app:v1")
+	}
+	if _, digest, ok := strings.Cut(repository, "@"); ok && !sha256DigestPattern.MatchString(digest) {
+		return fmt.Errorf("only sha256 digests are supported")
+	}
+	return nil
+}
+
+// Bundles are tarballs in a bucket or served over http(s), e.g. https://example.com/manifests/app.tar.gz
+func isBundleURL(repoURL string) bool {
+	if strings.HasPrefix(repoURL, S3SourcePrefix) {
+		return true
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+	for _, suffix := range []string{".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(u.Path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *applicationValidator) validateRepoSecret(ctx context.Context, fldPath *field.Path, namespace, name, repoURL string, required bool) field.ErrorList {
+	var secret corev1.Secret
+	if err := v.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			if !required {
+				return nil
+			}
+			return field.ErrorList{field.NotFound(fldPath, name)}
+		}
+		return field.ErrorList{field.InternalError(fldPath, err)}
+	}
+	if strings.HasPrefix(repoURL, S3SourcePrefix) {
+		_, hasAccessKeyID := secret.Data[RepoSecretAccessKeyIDKey]
+		_, hasSecretAccessKey := secret.Data[RepoSecretSecretAccessKeyKey]
+		if !hasAccessKeyID || !hasSecretAccessKey {
+			return field.ErrorList{field.Invalid(fldPath, name, fmt.Sprintf("secret must contain %s and %s",
+				RepoSecretAccessKeyIDKey, RepoSecretSecretAccessKeyKey))}
+		}
+		return nil
+	}
+	if strings.HasPrefix(repoURL, OCISourcePrefix) || isBundleURL(repoURL) {
+		_, hasToken := secret.Data[RepoSecretAPITokenKey]
+		_, hasUsername := secret.Data[RepoSecretUsernameKey]
+		_, hasPassword := secret.Data[RepoSecretPasswordKey]
+		if !hasToken && !(hasUsername && hasPassword) {
+			return field.ErrorList{field.Invalid(fldPath, name, fmt.Sprintf("secret must contain %s and %s, or %s",
+				RepoSecretUsernameKey, RepoSecretPasswordKey, RepoSecretAPITokenKey))}
+		}
+		return nil
+	}
+	if _, ok := secret.Data[RepoSecretAPITokenKey]; !ok {
+		return field.ErrorList{field.Invalid(fldPath, name, fmt.Sprintf("secret must contain %s", RepoSecretAPITokenKey))}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var _ = Describe("Application webhooks", func() {
+	newApplication := func(name string) *Application {
+		return &Application{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: ApplicationSpec{
+				Source: ApplicationSource{RepoURL: "https://github.com/org/repo.git", Path: "manifests/app"},
+			},
+		}
+	}
+
+	It("defaults unset fields", func() {
+		app := newApplication("defaulted")
+		Expect(k8sClient.Create(ctx, app)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, ctx, app)
+
+		Expect(app.Spec.SyncPeriodMinutes).NotTo(BeNil())
+		Expect(*app.Spec.SyncPeriodMinutes).To(Equal(DefaultSyncPeriodMinutes))
+		Expect(app.Spec.Source.TargetRevision).To(Equal(DefaultTargetRevision))
+		Expect(app.Spec.Destination.Namespace).To(Equal(DefaultDestinationNamespace))
+	})
+
+	It("rejects invalid applications", func() {
+		app := newApplication("invalid")
+		app.Spec.Source.RepoURL = "https://gitlab.com/org/repo"
+		err := k8sClient.Create(ctx, app)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected an invalid error, got %v", err)
+
+		app = newApplication("missing-secret")
+		app.Spec.Source.RepoSecret = "missing"
+		err = k8sClient.Create(ctx, app)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected an invalid error, got %v", err)
+	})
+
+	It("rejects invalid spec updates", func() {
+		app := newApplication("updated")
+		Expect(k8sClient.Create(ctx, app)).To(Succeed())
+		DeferCleanup(k8sClient.Delete, ctx, app)
+
+		app.Spec.Source.Path = "../other-repo"
+		err := k8sClient.Update(ctx, app)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected an invalid error, got %v", err)
+	})
+
+	It("lets the finalizer be removed after the repo secret was deleted", func() {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "repo-secret", Namespace: "default"},
+			StringData: map[string]string{RepoSecretAPITokenKey: "token"},
+		}
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+		app := newApplication("finalized")
+		app.Finalizers = []string{"gitops.jellis18.gitopscontroller.io/finalizer"}
+		app.Spec.Source.RepoSecret = secret.Name
+		Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+		// e.g. the namespace is being deleted and the secret is gone first
+		Expect(k8sClient.Delete(ctx, secret)).To(Succeed())
+
+		// updates that don't change the spec, like the ones of the controller, are still allowed
+		app.Labels = map[string]string{"team": "web"}
+		Expect(k8sClient.Update(ctx, app)).To(Succeed())
+
+		Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(app), app)).To(Succeed())
+		Expect(app.DeletionTimestamp).NotTo(BeNil())
+
+		app.Finalizers = nil
+		Expect(k8sClient.Update(ctx, app)).To(Succeed())
+		err := k8sClient.Get(ctx, client.ObjectKeyFromObject(app), app)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue(), "expected the application to be deleted, got %v", err)
+	})
+})
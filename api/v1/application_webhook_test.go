@@ -0,0 +1,198 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestApplication() *Application {
+	return &Application{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+		Spec: ApplicationSpec{
+			Source: ApplicationSource{
+				RepoURL: "https://github.com/org/repo.git",
+				Path:    "manifests/app",
+			},
+		},
+	}
+}
+
+func TestApplicationDefault(t *testing.T) {
+	app := newTestApplication()
+	if err := (&applicationDefaulter{}).Default(context.Background(), app); err != nil {
+		t.Fatal(err)
+	}
+
+	if app.Spec.SyncPeriodMinutes == nil || *app.Spec.SyncPeriodMinutes != DefaultSyncPeriodMinutes {
+		t.Errorf("expected default sync period, got %v", app.Spec.SyncPeriodMinutes)
+	}
+	if app.Spec.Source.TargetRevision != DefaultTargetRevision {
+		t.Errorf("expected default target revision, got %s", app.Spec.Source.TargetRevision)
+	}
+	if app.Spec.Destination.Namespace != DefaultDestinationNamespace {
+		t.Errorf("expected default destination namespace, got %s", app.Spec.Destination.Namespace)
+	}
+}
+
+func TestApplicationValidate(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "repo-secret", Namespace: "apps"},
+		Data:       map[string][]byte{RepoSecretAPITokenKey: []byte("token")},
+	}
+	registrySecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry-secret", Namespace: "apps"},
+		Data:       map[string][]byte{RepoSecretUsernameKey: []byte("ci"), RepoSecretPasswordKey: []byte("password")},
+	}
+	usernameOnly := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "username-only", Namespace: "apps"},
+		Data:       map[string][]byte{RepoSecretUsernameKey: []byte("ci")},
+	}
+	validator := &applicationValidator{
+		client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(secret, registrySecret, usernameOnly).Build(),
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(app *Application)
+		wantErr bool
+	}{
+		{name: "valid", mutate: func(app *Application) {}},
+		{name: "valid with secret", mutate: func(app *Application) { app.Spec.Source.RepoSecret = "repo-secret" }},
+		{name: "not a github url", mutate: func(app *Application) { app.Spec.Source.RepoURL = "https://gitlab.com/org/repo" }, wantErr: true},
+		{name: "not a repository url", mutate: func(app *Application) { app.Spec.Source.RepoURL = "https://github.com/org" }, wantErr: true},
+		{name: "absolute path", mutate: func(app *Application) { app.Spec.Source.Path = "/manifests" }, wantErr: true},
+		{name: "traversing path", mutate: func(app *Application) { app.Spec.Source.Path = "manifests/../../etc" }, wantErr: true},
+		{name: "missing secret", mutate: func(app *Application) { app.Spec.Source.RepoSecret = "missing" }, wantErr: true},
+		{name: "invalid service account", mutate: func(app *Application) { app.Spec.ServiceAccountName = "Deployer" }, wantErr: true},
+		{name: "invalid namespace", mutate: func(app *Application) { app.Spec.Destination.Namespace = "Not_A_Namespace" }, wantErr: true},
+		{name: "oci artifact", mutate: func(app *Application) { app.Spec.Source.RepoURL = "oci://registry.example.com/manifests/app:v1" }},
+		{name: "oci artifact with credentials", mutate: func(app *Application) {
+			app.Spec.Source.RepoURL = "oci://registry.example.com/manifests/app:v1"
+			app.Spec.Source.RepoSecret = "registry-secret"
+		}},
+		{name: "oci artifact without repository", mutate: func(app *Application) { app.Spec.Source.RepoURL = "oci://registry.example.com" }, wantErr: true},
+		{name: "oci artifact with invalid digest", mutate: func(app *Application) { app.Spec.Source.RepoURL = "oci://registry.example.com/app@md5:abc" }, wantErr: true},
+		{name: "oci artifact with github secret", mutate: func(app *Application) {
+			app.Spec.Source.RepoURL = "oci://registry.example.com/manifests/app:v1"
+			app.Spec.Source.RepoSecret = "username-only"
+		}, wantErr: true},
+		{name: "http bundle", mutate: func(app *Application) { app.Spec.Source.RepoURL = "https://example.com/manifests/app.tar.gz" }},
+		{name: "http bundle with checksum", mutate: func(app *Application) {
+			app.Spec.Source.RepoURL = "https://example.com/manifests/app.tgz"
+			app.Spec.Source.TargetRevision = "sha256:" + strings.Repeat("a", 64)
+		}},
+		{name: "http bundle with branch", mutate: func(app *Application) {
+			app.Spec.Source.RepoURL = "https://example.com/manifests/app.tgz"
+			app.Spec.Source.TargetRevision = "main"
+		}, wantErr: true},
+		{name: "s3 bundle", mutate: func(app *Application) { app.Spec.Source.RepoURL = "s3://manifests/app.tar.gz" }},
+		{name: "s3 bundle without key", mutate: func(app *Application) { app.Spec.Source.RepoURL = "s3://manifests" }, wantErr: true},
+		{name: "s3 bundle with registry secret", mutate: func(app *Application) {
+			app.Spec.Source.RepoURL = "s3://manifests/app.tar.gz"
+			app.Spec.Source.RepoSecret = "registry-secret"
+		}, wantErr: true},
+		{name: "verified commits", mutate: func(app *Application) {
+			app.Spec.Source.VerifyCommit = &CommitVerification{Name: "trusted-keys"}
+		}},
+		{name: "verified oci artifact", mutate: func(app *Application) {
+			app.Spec.Source.RepoURL = "oci://registry.example.com/manifests/app:v1"
+			app.Spec.Source.VerifyCommit = &CommitVerification{Name: "trusted-keys"}
+		}, wantErr: true},
+		{name: "valid sources", mutate: func(app *Application) {
+			app.Spec.Sources = []ApplicationSource{app.Spec.Source, {RepoURL: "https://github.com/org/overlays", Path: "prod"}}
+			app.Spec.Source = ApplicationSource{}
+		}},
+		{name: "source and sources", mutate: func(app *Application) {
+			app.Spec.Sources = []ApplicationSource{{RepoURL: "https://github.com/org/overlays", Path: "prod"}}
+		}, wantErr: true},
+		{name: "invalid second source", mutate: func(app *Application) {
+			app.Spec.Sources = []ApplicationSource{app.Spec.Source, {RepoURL: "https://gitlab.com/org/overlays", Path: "prod"}}
+			app.Spec.Source = ApplicationSource{}
+		}, wantErr: true},
+		{name: "duplicate sources", mutate: func(app *Application) {
+			app.Spec.Sources = []ApplicationSource{app.Spec.Source, app.Spec.Source}
+			app.Spec.Source = ApplicationSource{}
+		}, wantErr: true},
+		{name: "post build variables", mutate: func(app *Application) {
+			app.Spec.PostBuild = &PostBuild{
+				Substitute:     map[string]string{"CLUSTER_NAME": "prod", "_REPLICAS2": "3"},
+				SubstituteFrom: []SubstituteReference{{Kind: "ConfigMap", Name: "cluster-vars"}},
+			}
+		}},
+		{name: "invalid variable name", mutate: func(app *Application) {
+			app.Spec.PostBuild = &PostBuild{Substitute: map[string]string{"cluster-name": "prod"}}
+		}, wantErr: true},
+		{name: "invalid substitute reference", mutate: func(app *Application) {
+			app.Spec.PostBuild = &PostBuild{SubstituteFrom: []SubstituteReference{{Kind: "Secret", Name: "Cluster Vars"}}}
+		}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		app := newTestApplication()
+		tt.mutate(app)
+		err := validator.ValidateCreate(context.Background(), app)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestApplicationValidateUpdate(t *testing.T) {
+	validator := &applicationValidator{client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()}
+	ctx := context.Background()
+
+	// the repo secret of the application was deleted, e.g. because its namespace is being deleted
+	oldApp := newTestApplication()
+	oldApp.Spec.Source.RepoSecret = "deleted-secret"
+	if err := validator.ValidateCreate(ctx, oldApp); err == nil {
+		t.Error("expected creating an application with a missing repo secret to be rejected")
+	}
+
+	// the controller removing its finalizer
+	app := oldApp.DeepCopy()
+	app.Finalizers = nil
+	if err := validator.ValidateUpdate(ctx, oldApp, app); err != nil {
+		t.Errorf("expected updates that don't change the spec to be allowed, got %v", err)
+	}
+
+	app = oldApp.DeepCopy()
+	now := metav1.Now()
+	app.DeletionTimestamp = &now
+	app.Spec.Source.RepoURL = "not a url"
+	if err := validator.ValidateUpdate(ctx, oldApp, app); err != nil {
+		t.Errorf("expected updates of deleted applications to be allowed, got %v", err)
+	}
+
+	app = oldApp.DeepCopy()
+	app.Spec.Source.Path = "manifests/other"
+	if err := validator.ValidateUpdate(ctx, oldApp, app); err != nil {
+		t.Errorf("expected spec updates not to fail on a missing repo secret, got %v", err)
+	}
+
+	app.Spec.Source.Path = "../other"
+	if err := validator.ValidateUpdate(ctx, oldApp, app); err == nil {
+		t.Error("expected invalid spec updates to be rejected")
+	}
+}
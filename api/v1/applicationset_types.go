@@ -0,0 +1,187 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ClusterSecretTypeLabel marks secrets that register a cluster for the cluster generator
+	ClusterSecretTypeLabel string = "gitops.jellis18.gitopscontroller.io/secret-type"
+
+	// ClusterSecretType is the value of the ClusterSecretTypeLabel of cluster secrets
+	ClusterSecretType string = "cluster"
+
+	// InClusterName is the name of the cluster the controller runs in
+	InClusterName string = "in-cluster"
+)
+
+// ApplicationSetSpec defines the Applications generated by an ApplicationSet
+type ApplicationSetSpec struct {
+	// Generators producing the parameters of the Applications. The template is rendered once for every
+	// set of parameters of every generator
+	Generators []ApplicationSetGenerator `json:"generators"`
+
+	// Template of the generated Applications. Parameters are referenced with {{name}}
+	Template ApplicationSetTemplate `json:"template"`
+}
+
+// ApplicationSetTemplate is the template of the generated Applications
+type ApplicationSetTemplate struct {
+	Metadata ApplicationSetTemplateMeta `json:"metadata"`
+
+	Spec ApplicationSpec `json:"spec"`
+}
+
+// ApplicationSetTemplateMeta is the metadata of the generated Applications
+type ApplicationSetTemplateMeta struct {
+	Name string `json:"name"`
+
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ApplicationSetGenerator produces parameters for the template. Exactly one generator should be set
+type ApplicationSetGenerator struct {
+	ApplicationSetBaseGenerator `json:",inline"`
+
+	// Combines the parameters of two generators
+	// +optional
+	Matrix *MatrixGenerator `json:"matrix,omitempty"`
+
+	// Merges the parameters of several generators
+	// +optional
+	Merge *MergeGenerator `json:"merge,omitempty"`
+}
+
+// ApplicationSetBaseGenerator are the generators that can be combined by the matrix and merge generators
+type ApplicationSetBaseGenerator struct {
+	// +optional
+	List *ListGenerator `json:"list,omitempty"`
+
+	// +optional
+	Git *GitGenerator `json:"git,omitempty"`
+
+	// +optional
+	Clusters *ClusterGenerator `json:"clusters,omitempty"`
+}
+
+// ListGenerator produces a static list of parameters
+type ListGenerator struct {
+	Elements []map[string]string `json:"elements"`
+}
+
+// GitGenerator produces a set of parameters for every matching directory of a git repository.
+// The parameters are path, path.basename and path.basenameNormalized
+type GitGenerator struct {
+	// URL to the git repository
+	RepoURL string `json:"repoURL"`
+
+	// Revision the directories are read at. Defaults to HEAD
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
+	// Name of secret in the namespace of the ApplicationSet containing the API token for the repository
+	// +optional
+	RepoSecret string `json:"repoSecret,omitempty"`
+
+	Directories []GitDirectoryGeneratorItem `json:"directories"`
+}
+
+// GitDirectoryGeneratorItem selects directories of a repository
+type GitDirectoryGeneratorItem struct {
+	// Path of the directories. The last path segment may be a glob, e.g. apps/*
+	Path string `json:"path"`
+
+	// Excludes the matching directories instead
+	// +optional
+	Exclude bool `json:"exclude,omitempty"`
+}
+
+// ClusterGenerator produces a set of parameters for every cluster registered with a secret labeled
+// gitops.jellis18.gitopscontroller.io/secret-type: cluster in the namespace of the ApplicationSet. The secret
+// keys name and server and the secret's labels (as metadata.labels.<key>) are the parameters. Applications
+// are always deployed to the cluster the controller runs in, so server must be https://kubernetes.default.svc
+type ClusterGenerator struct {
+	// Selects the cluster secrets. The cluster the controller runs in is included (as in-cluster) if not set
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// MatrixGenerator produces the combinations of the parameters of two generators
+type MatrixGenerator struct {
+	// +kubebuilder:validation:MinItems=2
+	// +kubebuilder:validation:MaxItems=2
+	Generators []ApplicationSetBaseGenerator `json:"generators"`
+}
+
+// MergeGenerator overrides the parameters of the first generator with the parameters of the following
+// generators that have the same values for all merge keys
+type MergeGenerator struct {
+	// +kubebuilder:validation:MinItems=1
+	MergeKeys []string `json:"mergeKeys"`
+
+	// +kubebuilder:validation:MinItems=2
+	Generators []ApplicationSetBaseGenerator `json:"generators"`
+}
+
+// ApplicationSetStatus defines the observed state of ApplicationSet
+type ApplicationSetStatus struct {
+	// Names of the generated Applications
+	// +optional
+	Applications []string `json:"applications,omitempty"`
+
+	// Latest observations of the ApplicationSet's state
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+const (
+	// ConditionTypeApplicationsGenerated is true when the Applications were generated from the latest parameters
+	ConditionTypeApplicationsGenerated string = "ApplicationsGenerated"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// ApplicationSet is the Schema for the applicationsets API
+type ApplicationSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ApplicationSetSpec   `json:"spec,omitempty"`
+	Status ApplicationSetStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ApplicationSetList contains a list of ApplicationSet
+type ApplicationSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ApplicationSet `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ApplicationSet{}, &ApplicationSetList{})
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// InClusterServer is the server of the cluster the controller runs in. Applications are always deployed to it
+const InClusterServer string = "https://kubernetes.default.svc"
+
+// ProjectSpec defines what the Applications of a project may deploy
+type ProjectSpec struct {
+	// Repositories Applications may be synced from. Supports globs, e.g. https://github.com/my-org/*
+	// +optional
+	SourceRepos []string `json:"sourceRepos,omitempty"`
+
+	// Where Applications may deploy resources to
+	// +optional
+	Destinations []ProjectDestination `json:"destinations,omitempty"`
+
+	// Cluster-scoped kinds Applications may deploy. No cluster-scoped resources may be deployed if empty
+	// +optional
+	ClusterResourceAllowList []metav1.GroupKind `json:"clusterResourceAllowList,omitempty"`
+
+	// Cluster-scoped kinds Applications may not deploy, even if they are in the allow list
+	// +optional
+	ClusterResourceDenyList []metav1.GroupKind `json:"clusterResourceDenyList,omitempty"`
+
+	// Namespaced kinds Applications may not deploy
+	// +optional
+	NamespaceResourceDenyList []metav1.GroupKind `json:"namespaceResourceDenyList,omitempty"`
+}
+
+// ProjectDestination is a cluster and namespace Applications may deploy to. Both support globs
+type ProjectDestination struct {
+	// Server of the cluster. Defaults to any cluster
+	// +optional
+	Server string `json:"server,omitempty"`
+
+	// Defaults to any namespace
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// Project is the Schema for the projects API. It limits the repositories, destinations and
+// kinds of resources of the Applications that reference it
+type Project struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ProjectSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ProjectList contains a list of Project
+type ProjectList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Project `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Project{}, &ProjectList{})
+}
@@ -19,38 +19,92 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
 )
 
 const (
 	finalizerName     string = "gitops.jellis18.gitopscontroller.io/finalizer"
-	apiTokenSecretKey string = "apiToken"
+	apiTokenSecretKey string = gitopsv1.RepoSecretAPITokenKey
 )
 
 // ApplicationReconciler reconciles a Application object
 type ApplicationReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// Cache of manifests fetched from git shared by all Applications. If nil, manifests are fetched on every sync
+	ManifestCache *ManifestCache
+
+	// How manifests are fetched from github. Defaults to FetchModeContents
+	FetchMode FetchMode
+
+	// Cache of github responses shared by all Applications using the same credential. If nil, responses are not cached
+	ResponseCache *GithubResponseCache
+
+	// Used to find objects tracked by an Application in all api groups. If nil, only the
+	// resources recorded in the Application status are managed
+	Discovery discovery.DiscoveryInterface
+
+	// Reads objects directly from the API server, so finding tracked objects does not start informers for all kinds.
+	// Applications impersonating a service account use the impersonating client instead
+	APIReader client.Reader
+
+	// Used to build clients impersonating the service accounts of Applications
+	Config *rest.Config
+
+	// Namespace Projects are read from, e.g. the controller's namespace, so tenants that can create Applications
+	// can't create or change the projects restricting them. If set, Applications without a project are restricted by
+	// the project named default. If empty, projects are read from the namespace of the Application and Applications
+	// without one are not restricted
+	ProjectNamespace string
+
+	// Service account impersonated for Applications that don't set one, e.g. a least-privilege account when
+	// Applications are managed by tenants. If empty, these Applications use the controller's own client
+	DefaultServiceAccountName string
+
+	// Client for requests to OCI registries and for bundles. Defaults to http.DefaultClient
+	HTTPClient *http.Client
+
+	// Secret with the age identities (*.agekey) and PGP private keys (*.asc) to decrypt SOPS-encrypted manifests
+	DecryptionSecret types.NamespacedName
+
+	// Applications sent to this channel (e.g. by the PushWebhookReceiver) are synced immediately
+	PushEvents <-chan event.GenericEvent
+
+	rateLimits           githubRateLimits
+	impersonatingClients impersonatingClients
+	openAPIDocuments     openAPIDocuments
 }
 
 //+kubebuilder:rbac:groups=gitops.jellis18.gitopscontroller.io,resources=applications,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=gitops.jellis18.gitopscontroller.io,resources=applications/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=gitops.jellis18.gitopscontroller.io,resources=applications/finalizers,verbs=update
+//+kubebuilder:rbac:groups=gitops.jellis18.gitopscontroller.io,resources=projects,verbs=get;list;watch
 //+kubebuilder:rbac:groups=*,resources=*,verbs=*
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=impersonate
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -86,10 +140,30 @@ func (r *ApplicationReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		if controllerutil.ContainsFinalizer(&app, finalizerName) {
 			// delete target managed resources
 			log.Info(fmt.Sprintf("Deleting managed resources for app %s", app.Name))
-			if err := r.deleteResources(ctx, app.Status.Resources); err != nil {
+			managed, err := r.managedResources(ctx, &app)
+			if err != nil {
+				log.Error(err, "could not find managed resources")
+				return ctrl.Result{}, err
+			}
+			resourceClient, err := r.resourceClient(&app)
+			if err != nil {
+				log.Error(err, "could not create client for managed resources")
+				return ctrl.Result{}, err
+			}
+			if err := r.deleteResources(ctx, resourceClient, &app, managed); err != nil {
 				log.Error(err, "could not delete managed resources")
 				return ctrl.Result{}, err
 			}
+			// child applications delete their own resources, so the deletion is only complete once they are gone
+			remaining, err := r.remainingChildren(ctx, managed)
+			if err != nil {
+				log.Error(err, "could not check child applications")
+				return ctrl.Result{}, err
+			}
+			if remaining > 0 {
+				log.Info(fmt.Sprintf("Waiting for %d child applications to be deleted", remaining))
+				return ctrl.Result{RequeueAfter: childDeletionRequeueInterval}, nil
+			}
 
 			controllerutil.RemoveFinalizer(&app, finalizerName)
 			app.Status.ReconciledAt = &metav1.Time{Time: time.Now()}
@@ -103,89 +177,377 @@ func (r *ApplicationReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, nil
 	}
 
-	// 1. Get target Objects from repo
-	stateManager, err := r.getAppStateManager(ctx, &app)
+	// a stalled application gets a fresh set of retries once its spec changes
+	if stalled := meta.FindStatusCondition(app.Status.Conditions, gitopsv1.ConditionTypeStalled); stalled != nil && stalled.ObservedGeneration != app.Generation {
+		resetRetries(&app)
+	}
+
+	project, err := r.getProject(ctx, &app)
 	if err != nil {
-		log.Error(err, "Error creating state manager")
-		return ctrl.Result{}, err
+		return r.handleSyncError(ctx, &app, err)
 	}
 
-	targetObjs, err := stateManager.getRepoObjs(ctx, &app)
+	// 1. Resolve target revision of every source
+	var sources []resolvedSource
+	for i, source := range app.Spec.GetSources() {
+		// no request is made to a source the project does not permit, so its credentials are never used for it
+		if project != nil && !sourcePermitted(project, source.RepoURL) {
+			return r.handleSyncError(ctx, &app, fmt.Errorf("repository %s is not permitted by project %s", source.RepoURL, project.Name))
+		}
+
+		resolved, err := r.getSourceClient(ctx, &app, source)
+		if err != nil {
+			return r.handleSyncError(ctx, &app, fmt.Errorf("could not create state manager: %w", err))
+		}
+
+		// don't make requests with a credential that is known to be rate limited
+		if until, paused := r.rateLimits.paused(resolved.credential); paused {
+			log.Info("Github rate limit exceeded, postponing sync", "credential", resolved.credential, "until", until)
+			return requeueAt(until), nil
+		}
+
+		// semver constraints are resolved to the latest matching tag on every sync
+		if isSemverConstraint(source.TargetRevision) {
+			resolved.tag, err = resolveSemverConstraint(ctx, resolved.client, source)
+			if err != nil {
+				if result, ok := r.rateLimits.handleError(ctx, resolved.credential, err); ok {
+					return result, nil
+				}
+				return r.handleSyncError(ctx, &app, fmt.Errorf("could not resolve target revision of %s: %w", source.RepoURL, err))
+			}
+			source.TargetRevision = resolved.tag
+		}
+
+		resolved.revision, err = resolved.client.resolveRevision(ctx, source, lastSyncedRevision(&app, i))
+		if err != nil {
+			if result, ok := r.rateLimits.handleError(ctx, resolved.credential, err); ok {
+				return result, nil
+			}
+			return r.handleSyncError(ctx, &app, fmt.Errorf("could not resolve target revision of %s: %w", source.RepoURL, err))
+		}
+
+		// commits that are not signed by a trusted key are never synced
+		if source.VerifyCommit != nil && !commitAlreadyVerified(&app, i, resolved.revision) {
+			if err := r.verifyCommit(ctx, &app, resolved); err != nil {
+				if result, ok := r.rateLimits.handleError(ctx, resolved.credential, err); ok {
+					return result, nil
+				}
+				return r.handleSyncError(ctx, &app, fmt.Errorf("could not verify commit %s of %s: %w", resolved.revision, source.RepoURL, err))
+			}
+		}
+		sources = append(sources, resolved)
+	}
+	revision := combinedRevision(sources)
+	setCommitVerified(&app, sources)
+
+	if skipStalledSync(&app, revision) {
+		log.Info("Application is stalled and its revision did not change, skipping sync", "revision", revision)
+		return r.skipSync(ctx, &app)
+	}
+	app.Status.LastAttemptedRevision = revision
+
+	rules, err := ignoreDifferencesRules(&app)
 	if err != nil {
-		log.Error(err, "could not fetch k8s resources from git repo")
-		// TODO: should retry with some limit but we will just return for now
-		return ctrl.Result{}, nil
+		return r.handleSyncError(ctx, &app, fmt.Errorf("invalid ignoreDifferences: %w", err))
+	}
+
+	// all requests on managed resources are made with this client
+	resourceClient, err := r.resourceClient(&app)
+	if err != nil {
+		return r.handleSyncError(ctx, &app, err)
+	}
+
+	// explicitly requested syncs are always run, automated syncs only if they are not suspended
+	if app.Operation == nil && app.Spec.SyncPolicy != nil && app.Spec.SyncPolicy.Suspend {
+		log.Info("Automated syncs are suspended, skipping sync")
+		return r.skipSync(ctx, &app)
+	}
+
+	// 2. Get target Objects from repo
+	var objsPerSource [][]*unstructured.Unstructured
+	// the file and line each object was read from
+	origins := make(map[*unstructured.Unstructured]string)
+	for _, source := range sources {
+		source := source
+		cacheKey := newManifestCacheKey(source.ApplicationSource, source.revision, r.FetchMode)
+		objs, err := r.ManifestCache.GetOrFetch(ctx, cacheKey, func() ([]*unstructured.Unstructured, error) {
+			return source.client.getRepoObjs(ctx, source.ApplicationSource, source.revision)
+		})
+		if err != nil {
+			if result, ok := r.rateLimits.handleError(ctx, source.credential, err); ok {
+				return result, nil
+			}
+			return r.handleSyncError(ctx, &app, fmt.Errorf("could not fetch k8s resources from git repo: %w", err))
+		}
+		for _, obj := range objs {
+			origins[obj] = popOrigin(obj)
+			if obj.GetNamespace() == "" {
+				obj.SetNamespace(destinationNamespace(&app))
+			}
+		}
+		// the manifest cache only holds the encrypted manifests, they are decrypted for this sync only. Objects
+		// are decrypted before they are merged, so their plaintext is merged with the objects of other sources
+		if err := r.decryptObjects(ctx, objs); err != nil {
+			return r.handleSyncError(ctx, &app, err)
+		}
+		// variables are substituted in the text of the documents, which doesn't include merged fields
+		if err := r.substituteVariables(ctx, &app, objs); err != nil {
+			return r.handleSyncError(ctx, &app, err)
+		}
+		objsPerSource = append(objsPerSource, objs)
+	}
+	targetObjs, err := mergeSourceObjects(objsPerSource)
+	if err != nil {
+		return r.handleSyncError(ctx, &app, err)
+	}
+	if err := checkSelfReference(&app, targetObjs); err != nil {
+		return r.handleSyncError(ctx, &app, err)
+	}
+	inheritChildRestrictions(&app, targetObjs)
+
+	// skip automated syncs if nothing changed since the last one
+	if app.Operation == nil {
+		syncRequired, err := r.isSyncRequired(ctx, resourceClient, &app, revision, targetObjs, rules)
+		if err != nil {
+			return r.handleSyncError(ctx, &app, fmt.Errorf("could not check managed resources for drift: %w", err))
+		}
+		if !syncRequired {
+			log.Info("Target revision unchanged and no drift detected, skipping sync", "revision", revision)
+			return r.skipSync(ctx, &app)
+		}
+	}
+
+	// a partial sync only applies and prunes the selected resources
+	selectors := syncSelectors(&app)
+	partial := len(selectors) > 0
+	if partial {
+		log.Info("Running partial sync", "selectors", selectors)
+		if targetObjs, err = selectTargets(targetObjs, selectors); err != nil {
+			return r.handleSyncError(ctx, &app, fmt.Errorf("invalid resource selector: %w", err))
+		}
+	}
+
+	// invalid manifests fail the whole sync before anything is applied or pruned
+	if err := r.validateObjects(ctx, targetObjs, origins); err != nil {
+		return r.handleSyncError(ctx, &app, err)
+	}
+
+	// resources the project does not permit are neither applied nor pruned
+	violations, err := r.projectViolations(project, targetObjs)
+	if err != nil {
+		return r.handleSyncError(ctx, &app, err)
+	}
+	if err := r.childViolations(&app, targetObjs, violations); err != nil {
+		return r.handleSyncError(ctx, &app, err)
+	}
+
+	if isDryRun(&app) {
+		return r.dryRunSync(ctx, resourceClient, &app, revision, targetObjs, selectors, rules, violations)
 	}
 
-	// 2. Create or update (for now don't worry about checking status)
+	// 3. Create or update (for now don't worry about checking status)
 	var resourceList []gitopsv1.Resource
 	for _, target := range targetObjs {
 		u := &unstructured.Unstructured{}
-		// TODO: this should be handled on the app spec
-		namespace := target.GetNamespace()
-		if namespace == "" {
-			target.SetNamespace("default")
-		}
 
 		gvk := target.GroupVersionKind()
-		resourceList = append(resourceList, gitopsv1.Resource{
-			Group:     gvk.Group,
-			Version:   gvk.Version,
-			Kind:      gvk.Kind,
-			Name:      target.GetName(),
-			Namespace: target.GetNamespace(),
-			Status:    gitopsv1.SyncStatusSynced,
-		})
+		resource := resourceFromObject(target)
+		resource.Status = gitopsv1.SyncStatusSynced
+		if violation, ok := violations[keyOfResource(resource)]; ok {
+			log.Info(fmt.Sprintf("Not applying %s: %s in namespace %s, %s", target.GetKind(), target.GetName(), target.GetNamespace(), violation))
+			resource.Status = gitopsv1.SyncStatusOutOfSync
+			resource.Warning = &gitopsv1.ResourceWarning{Type: gitopsv1.ResourceWarningProjectViolation, Message: violation}
+			resourceList = append(resourceList, resource)
+			continue
+		}
 		u.SetGroupVersionKind(gvk)
-		err := r.Get(ctx, client.ObjectKey{Namespace: target.GetNamespace(), Name: target.GetName()}, u)
+		err := resourceClient.Get(ctx, client.ObjectKey{Namespace: target.GetNamespace(), Name: target.GetName()}, u)
 		if err != nil && errors.IsNotFound(err) {
+			setTracking(target, &app)
 			log.Info(fmt.Sprintf("Creating %s: %s in namespace %s\n", target.GetKind(), target.GetName(), target.GetNamespace()))
-			if err := r.Create(ctx, target); err != nil {
-				log.Error(err, "could not create object", "target", target)
-				return ctrl.Result{}, err
+			if err := resourceClient.Create(ctx, target); err != nil {
+				return r.handleSyncError(ctx, &app, fmt.Errorf("could not create %s %s/%s: %w", target.GetKind(), target.GetNamespace(), target.GetName(), err))
 			}
 		} else if err != nil {
-			log.Error(err, "could not fetch target object", "target", target)
-			return ctrl.Result{}, err
+			return r.handleSyncError(ctx, &app, fmt.Errorf("could not fetch %s %s/%s: %w", target.GetKind(), target.GetNamespace(), target.GetName(), err))
 		} else {
+			// applications managing the same object would overwrite each other on every sync
+			owner, other, err := r.managedByOther(ctx, u, &app)
+			if err != nil {
+				return r.handleSyncError(ctx, &app, fmt.Errorf("could not check owner of %s %s/%s: %w", target.GetKind(), target.GetNamespace(), target.GetName(), err))
+			}
+			if other {
+				log.Info(fmt.Sprintf("Not updating %s: %s in namespace %s, it is managed by application %s", target.GetKind(), target.GetName(), target.GetNamespace(), owner))
+				markShared(&resource, owner)
+				resourceList = append(resourceList, resource)
+				continue
+			}
+			if owner != "" {
+				log.Info(fmt.Sprintf("Adopting orphaned %s: %s in namespace %s, its application %s no longer exists", target.GetKind(), target.GetName(), target.GetNamespace(), owner))
+			}
+			applyIgnoreDifferences(rules, target, u)
+			preserveChildState(target, u)
+			setTracking(target, &app)
 			log.Info(fmt.Sprintf("Updating %s: %s in namespace %s\n", target.GetKind(), target.GetName(), target.GetNamespace()))
-			if err := r.Update(ctx, target); err != nil {
-				log.Error(err, "could not update object", "target", target)
-				return ctrl.Result{}, err
+			if err := resourceClient.Update(ctx, target); err != nil {
+				return r.handleSyncError(ctx, &app, fmt.Errorf("could not update %s %s/%s: %w", target.GetKind(), target.GetNamespace(), target.GetName(), err))
 			}
 		}
+		resourceList = append(resourceList, resource)
 	}
 
 	// 4. Remove orphans
-	orphans := r.findOrphans(&app, resourceList)
-	if err := r.deleteResources(ctx, orphans); err != nil {
-		log.Error(err, "could not delete orphans")
+	managed, err := r.managedResources(ctx, &app)
+	if err != nil {
+		return r.handleSyncError(ctx, &app, fmt.Errorf("could not find managed resources: %w", err))
+	}
+	orphans := r.findOrphans(managed, resourceList)
+	if partial {
+		if orphans, err = r.selectOrphans(ctx, resourceClient, orphans, selectors); err != nil {
+			return r.handleSyncError(ctx, &app, fmt.Errorf("could not select orphans: %w", err))
+		}
+	}
+	if orphans, err = r.permittedResources(project, orphans); err != nil {
+		return r.handleSyncError(ctx, &app, err)
+	}
+	if err := r.deleteResources(ctx, resourceClient, &app, orphans); err != nil {
+		return r.handleSyncError(ctx, &app, fmt.Errorf("could not delete orphans: %w", err))
+	}
+
+	if err := r.completeOperation(ctx, &app); err != nil {
 		return ctrl.Result{}, err
 	}
 
 	// should really wait for these to be synced but for now just add to the resource list
 	app.Status.SyncedAt = &metav1.Time{Time: time.Now()}
 	app.Status.ReconciledAt = &metav1.Time{Time: time.Now()}
-	app.Status.Resources = resourceList
-	app.Status.Sync = gitopsv1.SyncStatus{SyncStatus: gitopsv1.SyncStatusSynced, Source: app.Spec.Source}
+	previouslyShared := sharedResources(app.Status.Resources)
+	if partial {
+		// the rest of the application was not synced, so it is not known to be in sync with the revision
+		app.Status.Resources = mergeResources(app.Status.Resources, resourceList, orphans)
+		app.Status.Sync.SyncStatus = gitopsv1.SyncStatusOutOfSync
+	} else {
+		app.Status.ObservedGeneration = app.Generation
+		if app.Status.ObservedSpecHash, err = specHash(&app); err != nil {
+			return r.handleSyncError(ctx, &app, err)
+		}
+		app.Status.Resources = resourceList
+		app.Status.Sync = gitopsv1.SyncStatus{SyncStatus: gitopsv1.SyncStatusSynced, Source: app.Spec.Source, Sources: app.Spec.Sources, Revision: revision, Tag: combinedTag(sources)}
+	}
+	for _, resource := range app.Status.Resources {
+		// resources with warnings were not applied
+		if resource.Warning != nil {
+			app.Status.Sync.SyncStatus = gitopsv1.SyncStatusOutOfSync
+		}
+	}
+	if app.Status.Children, err = r.childrenStatus(ctx, app.Status.Resources); err != nil {
+		log.Error(err, "could not get status of child applications")
+	}
+	shared := sharedResources(app.Status.Resources)
+	setSharedResourceCondition(&app, shared)
+	addSyncHistory(&app, revision, selectors)
+	resetRetries(&app)
 	log.Info("Updating Application status")
 	if err := r.Status().Update(ctx, &app); err != nil {
 		log.Error(err, fmt.Sprintf("could not update application %s", app.Name))
 		return ctrl.Result{}, err
 	}
+	syncTotal.WithLabelValues(app.Namespace, app.Name).Inc()
+	r.updateSharedResourceOwners(ctx, &app, previouslyShared, shared)
+	r.updateParent(ctx, &app)
 
-	// determine time for next sync and requeue with delay
-	if app.Spec.SyncPeriodMinutes == nil {
-		log.Error(errors.NewBadRequest(".spec.syncPeriod must be set"), "No sync period found")
-		return ctrl.Result{}, nil
+	return r.requeueAfterSyncPeriod(&app), nil
+}
+
+// determine time for next sync and requeue with delay
+func (r *ApplicationReconciler) requeueAfterSyncPeriod(app *gitopsv1.Application) ctrl.Result {
+	// normally set by the defaulting webhook, but webhooks may be disabled
+	syncPeriod := gitopsv1.DefaultSyncPeriodMinutes
+	if app.Spec.SyncPeriodMinutes != nil {
+		syncPeriod = *app.Spec.SyncPeriodMinutes
 	}
 
-	nextRun := time.Minute * time.Duration(*app.Spec.SyncPeriodMinutes)
+	nextRun := time.Minute * time.Duration(syncPeriod)
+
+	return ctrl.Result{RequeueAfter: nextRun}
+}
+
+// Namespace for resources that do not set one in their manifests
+func destinationNamespace(app *gitopsv1.Application) string {
+	if app.Spec.Destination.Namespace == "" {
+		return gitopsv1.DefaultDestinationNamespace
+	}
+	return app.Spec.Destination.Namespace
+}
 
-	return ctrl.Result{RequeueAfter: nextRun}, nil
+// A sync is required if the spec changed since the last sync, the last sync did not succeed,
+// the target revision resolves to a new commit or any of the managed resources have drifted.
+// Dry-runs don't change the cluster, so they are only repeated for new commits or spec changes
+func (r *ApplicationReconciler) isSyncRequired(ctx context.Context, resourceClient client.Client, app *gitopsv1.Application, revision string, targetObjs []*unstructured.Unstructured, rules []ignoreDifferencesRule) (bool, error) {
+	if isDryRun(app) {
+		return isDryRunRequired(app, revision), nil
+	}
+	if app.Status.ObservedGeneration != app.Generation ||
+		app.Status.Sync.SyncStatus != gitopsv1.SyncStatusSynced ||
+		app.Status.Sync.Revision != revision {
+		return true, nil
+	}
+	return r.detectDrift(ctx, resourceClient, app, targetObjs, rules)
 }
 
-func (r *ApplicationReconciler) deleteResources(ctx context.Context, resources []gitopsv1.Resource) error {
+// Compares the live resources with their target state in git. A resource has drifted if it was removed
+// from the cluster, its kind is no longer served, e.g. because its CRD was removed, or any of the fields set
+// in git were changed, except for ignored differences
+func (r *ApplicationReconciler) detectDrift(ctx context.Context, resourceClient client.Client, app *gitopsv1.Application, targetObjs []*unstructured.Unstructured, rules []ignoreDifferencesRule) (bool, error) {
+	log := log.FromContext(ctx)
+
+	var resourceList []gitopsv1.Resource
+	for _, target := range targetObjs {
+		resourceList = append(resourceList, resourceFromObject(target))
+
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(target.GroupVersionKind())
+		if err := resourceClient.Get(ctx, client.ObjectKey{Namespace: target.GetNamespace(), Name: target.GetName()}, live); err != nil {
+			if errors.IsNotFound(err) {
+				log.Info(fmt.Sprintf("%s %s in namespace %s was removed from the cluster", target.GetKind(), target.GetName(), target.GetNamespace()))
+				return true, nil
+			}
+			if meta.IsNoMatchError(err) {
+				log.Info(fmt.Sprintf("%s %s in namespace %s has a kind the cluster doesn't serve", target.GetKind(), target.GetName(), target.GetNamespace()))
+				return true, nil
+			}
+			return false, err
+		}
+		if isOutOfSync(rules, target, live) {
+			log.Info(fmt.Sprintf("%s %s in namespace %s differs from git", target.GetKind(), target.GetName(), target.GetNamespace()))
+			return true, nil
+		}
+	}
+
+	// resources removed from git have not been pruned yet
+	return len(r.findOrphans(app.Status.Resources, resourceList)) > 0, nil
+}
+
+// Records that the application was reconciled without syncing it
+func (r *ApplicationReconciler) skipSync(ctx context.Context, app *gitopsv1.Application) (ctrl.Result, error) {
+	syncSkippedTotal.WithLabelValues(app.Namespace, app.Name).Inc()
+	app.Status.ReconciledAt = &metav1.Time{Time: time.Now()}
+	children, err := r.childrenStatus(ctx, app.Status.Resources)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "could not get status of child applications")
+	} else {
+		app.Status.Children = children
+	}
+	if err := r.Status().Update(ctx, app); err != nil {
+		log.FromContext(ctx).Error(err, fmt.Sprintf("could not update application %s", app.Name))
+		return ctrl.Result{}, err
+	}
+	r.updateParent(ctx, app)
+	return r.requeueAfterSyncPeriod(app), nil
+}
+
+// Deletes the resources from the cluster. Resources that were taken over by another application are left alone
+func (r *ApplicationReconciler) deleteResources(ctx context.Context, resourceClient client.Client, app *gitopsv1.Application, resources []gitopsv1.Resource) error {
 	log := log.FromContext(ctx)
 
 	for _, resource := range resources {
@@ -197,43 +559,38 @@ func (r *ApplicationReconciler) deleteResources(ctx context.Context, resources [
 
 		u := &unstructured.Unstructured{}
 		u.SetGroupVersionKind(gvk)
-		if err := r.Get(ctx, client.ObjectKey{Namespace: resource.Namespace, Name: resource.Name}, u); client.IgnoreNotFound(err) != nil {
+		if err := resourceClient.Get(ctx, client.ObjectKey{Namespace: resource.Namespace, Name: resource.Name}, u); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
 			return err
 		}
+		if owner, other := trackedByOther(u, app); other {
+			log.Info(fmt.Sprintf("not deleting %s: %s in namespace %s, it is managed by application %s", resource.Kind, resource.Name, resource.Namespace, owner))
+			continue
+		}
 		log.Info(fmt.Sprintf("deleting %s: %s in namespace %s", resource.Kind, resource.Name, resource.Namespace))
-		if err := r.Delete(ctx, u); err != nil {
+		if err := resourceClient.Delete(ctx, u); client.IgnoreNotFound(err) != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (r *ApplicationReconciler) findOrphans(app *gitopsv1.Application, targetResourceList []gitopsv1.Resource) []gitopsv1.Resource {
+func (r *ApplicationReconciler) findOrphans(managedResources []gitopsv1.Resource, targetResourceList []gitopsv1.Resource) []gitopsv1.Resource {
 
 	resources := []gitopsv1.Resource{}
 
-	// get mapping for target resources
-	type key struct{ name, namespace, group, version, kind string }
-	targetResourceMapping := make(map[key]gitopsv1.Resource)
+	// get mapping for target resources. The api version is not part of the key, so a resource
+	// whose apiVersion changed in git is not pruned right after it was updated
+	targetResourceMapping := make(map[resourceKey]gitopsv1.Resource)
 	for _, resource := range targetResourceList {
-		targetResourceMapping[key{
-			name:      resource.Name,
-			namespace: resource.Namespace,
-			group:     resource.Group,
-			version:   resource.Version,
-			kind:      resource.Kind,
-		}] = resource
+		targetResourceMapping[keyOfResource(resource)] = resource
 	}
 
 	// remove orphans by looping over current managed resources and finding those that are not in the target resources
-	for _, managedResource := range app.Status.Resources {
-		_, ok := targetResourceMapping[key{
-			name:      managedResource.Name,
-			namespace: managedResource.Namespace,
-			group:     managedResource.Group,
-			version:   managedResource.Version,
-			kind:      managedResource.Kind,
-		}]
+	for _, managedResource := range managedResources {
+		_, ok := targetResourceMapping[keyOfResource(managedResource)]
 		// if this resource is not in the target list, it is an orphan, delete it
 		if !ok {
 			resources = append(resources, managedResource)
@@ -242,29 +599,84 @@ func (r *ApplicationReconciler) findOrphans(app *gitopsv1.Application, targetRes
 	return resources
 }
 
-// Find secret, get api token and initialize state manager
-func (r *ApplicationReconciler) getAppStateManager(ctx context.Context, app *gitopsv1.Application) (*AppStateManager, error) {
-	secretName := app.Spec.Source.RepoSecret
-	var stateManager *AppStateManager
-	if secretName != "" {
-		var repoSecret corev1.Secret
-		if err := r.Get(ctx, types.NamespacedName{Name: secretName, Namespace: app.Namespace}, &repoSecret); err != nil {
-			return nil, fmt.Errorf("could not find secret %s", secretName)
+// Find secret, get credentials and initialize the client for the kind of source
+func (r *ApplicationReconciler) getSourceClient(ctx context.Context, app *gitopsv1.Application, source gitopsv1.ApplicationSource) (resolvedSource, error) {
+	if isOCISource(source.RepoURL) || isBundleSource(source.RepoURL) {
+		repoSecret, err := getRepoSecret(ctx, r.Client, app.Namespace, source.RepoSecret)
+		if err != nil {
+			return resolvedSource{}, err
 		}
-		apiTokenBytes, ok := repoSecret.Data[apiTokenSecretKey]
-		if !ok {
-			return nil, fmt.Errorf("could not access secret data; %s from secret %s", apiTokenSecretKey, repoSecret.Name)
+		if isOCISource(source.RepoURL) {
+			return resolvedSource{ApplicationSource: source, client: newOCIClient(repoSecret, r.HTTPClient)}, nil
 		}
-		stateManager = NewAppStateManager(string(apiTokenBytes))
-	} else {
-		stateManager = NewAppStateManager("")
+		return resolvedSource{ApplicationSource: source, client: newBundleClient(repoSecret, r.HTTPClient)}, nil
 	}
-	return stateManager, nil
+
+	apiToken, err := getRepoAPIToken(ctx, r.Client, app.Namespace, source.RepoSecret)
+	if err != nil {
+		return resolvedSource{}, err
+	}
+	stateManager := NewAppStateManager(apiToken, r.FetchMode, r.ResponseCache)
+	return resolvedSource{ApplicationSource: source, client: stateManager, credential: stateManager.credential}, nil
+}
+
+// Returns a repository secret, or nil if no secret is given
+func getRepoSecret(ctx context.Context, c client.Reader, namespace, secretName string) (*corev1.Secret, error) {
+	if secretName == "" {
+		return nil, nil
+	}
+	var repoSecret corev1.Secret
+	if err := c.Get(ctx, types.NamespacedName{Name: secretName, Namespace: namespace}, &repoSecret); err != nil {
+		return nil, fmt.Errorf("could not find secret %s", secretName)
+	}
+	return &repoSecret, nil
+}
+
+// Returns the api token of a repository secret, or an empty token if no secret is given
+func getRepoAPIToken(ctx context.Context, c client.Reader, namespace, secretName string) (string, error) {
+	repoSecret, err := getRepoSecret(ctx, c, namespace, secretName)
+	if err != nil || repoSecret == nil {
+		return "", err
+	}
+	apiTokenBytes, ok := repoSecret.Data[apiTokenSecretKey]
+	if !ok {
+		return "", fmt.Errorf("could not access secret data; %s from secret %s", apiTokenSecretKey, repoSecret.Name)
+	}
+	return string(apiTokenBytes), nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ApplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&gitopsv1.Application{}).
-		Complete(r)
+	// index applications by repo so push webhooks can find the applications to sync
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &gitopsv1.Application{}, repoURLIndexKey, func(obj client.Object) []string {
+		app := obj.(*gitopsv1.Application)
+		var repoURLs []string
+		for _, source := range app.Spec.GetSources() {
+			repoURLs = append(repoURLs, normalizeRepoURL(source.RepoURL))
+		}
+		return repoURLs
+	}); err != nil {
+		return err
+	}
+
+	// index applications by project so they are synced when their project changes
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &gitopsv1.Application{}, projectIndexKey, func(obj client.Object) []string {
+		name := r.projectName(obj.(*gitopsv1.Application))
+		if name == "" {
+			return nil
+		}
+		return []string{name}
+	}); err != nil {
+		return err
+	}
+
+	// status updates do not bump the generation, so this keeps the controller from
+	// re-triggering itself every time it records the result of a sync
+	bldr := ctrl.NewControllerManagedBy(mgr).
+		For(&gitopsv1.Application{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &gitopsv1.Project{}}, handler.EnqueueRequestsFromMapFunc(r.applicationsForProject))
+	if r.PushEvents != nil {
+		bldr = bldr.Watches(&source.Channel{Source: r.PushEvents}, &handler.EnqueueRequestForObject{})
+	}
+	return bldr.Complete(r)
 }
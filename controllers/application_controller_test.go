@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+// A client whose reads fail, e.g. because the kind isn't served or the controller may not read it
+type getErrorClient struct {
+	client.Client
+	err error
+}
+
+func (c getErrorClient) Get(context.Context, client.ObjectKey, client.Object, ...client.GetOption) error {
+	return c.err
+}
+
+func TestDetectDriftOfUnreadableResources(t *testing.T) {
+	r := &ApplicationReconciler{}
+	app := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	targets := []*unstructured.Unstructured{newObject("example.com/v1", "Widget", "default", "widget")}
+	base := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+
+	// the CRD of the resource was removed, so syncing recreates it
+	noMatch := &meta.NoKindMatchError{GroupKind: schema.GroupKind{Group: "example.com", Kind: "Widget"}, SearchedVersions: []string{"v1"}}
+	drift, err := r.detectDrift(context.Background(), getErrorClient{base, noMatch}, app, targets, nil)
+	if err != nil || !drift {
+		t.Errorf("expected a kind that isn't served to be drift, got %v, %v", drift, err)
+	}
+
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Group: "example.com", Resource: "widgets"}, "widget", nil)
+	if _, err := r.detectDrift(context.Background(), getErrorClient{base, forbidden}, app, targets, nil); !apierrors.IsForbidden(err) {
+		t.Errorf("expected other errors to be returned, got %v", err)
+	}
+}
+
+func TestIsSyncRequired(t *testing.T) {
+	target := newDeployment(2, "app:1")
+	synced := func() *gitopsv1.Application {
+		app := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Generation: 2}}
+		app.Status.ObservedGeneration = 2
+		app.Status.Sync = gitopsv1.SyncStatus{SyncStatus: gitopsv1.SyncStatusSynced, Revision: "abc123"}
+		app.Status.Resources = []gitopsv1.Resource{resourceFromObject(target)}
+		return app
+	}
+
+	for _, tc := range []struct {
+		name     string
+		mutate   func(app *gitopsv1.Application)
+		live     *unstructured.Unstructured
+		revision string
+		want     bool
+	}{
+		{name: "nothing changed", live: newDeployment(2, "app:1"), want: false},
+		{name: "fields not set in git changed", live: withLabels(newDeployment(2, "app:1"), map[string]string{"team": "web"}), want: false},
+		{name: "generation changed", mutate: func(app *gitopsv1.Application) { app.Generation = 3 }, live: newDeployment(2, "app:1"), want: true},
+		{name: "not synced", mutate: func(app *gitopsv1.Application) { app.Status.Sync.SyncStatus = gitopsv1.SyncStatusOutOfSync }, live: newDeployment(2, "app:1"), want: true},
+		{name: "revision changed", live: newDeployment(2, "app:1"), revision: "def456", want: true},
+		{name: "live object changed", live: newDeployment(3, "app:1"), want: true},
+		{name: "live object removed", want: true},
+		{name: "orphan present", mutate: func(app *gitopsv1.Application) {
+			app.Status.Resources = append(app.Status.Resources, gitopsv1.Resource{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "removed-from-git"})
+		}, live: newDeployment(2, "app:1"), want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := synced()
+			if tc.mutate != nil {
+				tc.mutate(app)
+			}
+			revision := tc.revision
+			if revision == "" {
+				revision = "abc123"
+			}
+			builder := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme)
+			if tc.live != nil {
+				builder = builder.WithObjects(tc.live)
+			}
+			r := &ApplicationReconciler{}
+			got, err := r.isSyncRequired(context.Background(), builder.Build(), app, revision, []*unstructured.Unstructured{target}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("expected sync required to be %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func withLabels(obj *unstructured.Unstructured, labels map[string]string) *unstructured.Unstructured {
+	obj.SetLabels(labels)
+	return obj
+}
+
+func TestSkipSyncCountsSkippedSyncs(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+
+	app := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "skipped", Namespace: "default"}}
+	r := &ApplicationReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(app).Build(), Scheme: scheme}
+	skipped := syncSkippedTotal.WithLabelValues(app.Namespace, app.Name)
+	before := testutil.ToFloat64(skipped)
+	if _, err := r.skipSync(context.Background(), app); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(skipped) - before; got != 1 {
+		t.Errorf("expected the skipped sync to be counted once, got %v", got)
+	}
+	if app.Status.ReconciledAt == nil {
+		t.Error("expected the reconciliation time to be recorded")
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	// reasons of the ApplicationsGenerated condition
+	reasonApplicationsGenerated = "Generated"
+	reasonGenerationFailed      = "GenerationFailed"
+)
+
+// ApplicationSetReconciler reconciles a ApplicationSet object
+type ApplicationSetReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Cache of github responses used by the git generator. Optional
+	ResponseCache *GithubResponseCache
+}
+
+//+kubebuilder:rbac:groups=gitops.jellis18.gitopscontroller.io,resources=applicationsets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=gitops.jellis18.gitopscontroller.io,resources=applicationsets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=gitops.jellis18.gitopscontroller.io,resources=applicationsets/finalizers,verbs=update
+//+kubebuilder:rbac:groups=gitops.jellis18.gitopscontroller.io,resources=applications,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+//
+// It renders the template of the ApplicationSet for every set of parameters of its generators, creates or
+// updates the resulting Applications and deletes the Applications it generated before that are no longer generated.
+// Generated Applications are owned by the ApplicationSet, so they are garbage collected along with it
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.13.0/pkg/reconcile
+func (r *ApplicationSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var appSet gitopsv1.ApplicationSet
+	if err := r.Get(ctx, req.NamespacedName, &appSet); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !appSet.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// 1. render the applications from the parameters of the generators
+	apps, err := r.generateApplications(ctx, &appSet)
+	if err != nil {
+		return r.handleGenerationError(ctx, &appSet, err)
+	}
+
+	// 2. create or update the generated applications
+	generated := make(map[string]bool)
+	for _, app := range apps {
+		if err := r.applyApplication(ctx, &appSet, app); err != nil {
+			return r.handleGenerationError(ctx, &appSet, err)
+		}
+		generated[app.Name] = true
+	}
+
+	// 3. delete the applications that are no longer generated
+	var appList gitopsv1.ApplicationList
+	if err := r.List(ctx, &appList, client.InNamespace(appSet.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+	for i := range appList.Items {
+		app := &appList.Items[i]
+		if generated[app.Name] || !metav1.IsControlledBy(app, &appSet) {
+			continue
+		}
+		log.Info(fmt.Sprintf("Deleting application %s that is no longer generated", app.Name))
+		if err := r.Delete(ctx, app); client.IgnoreNotFound(err) != nil {
+			log.Error(err, fmt.Sprintf("could not delete application %s", app.Name))
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 4. update status
+	names := make([]string, 0, len(generated))
+	for name := range generated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	appSet.Status.Applications = names
+	meta.SetStatusCondition(&appSet.Status.Conditions, metav1.Condition{
+		Type:               gitopsv1.ConditionTypeApplicationsGenerated,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: appSet.Generation,
+		Reason:             reasonApplicationsGenerated,
+		Message:            fmt.Sprintf("generated %d applications", len(names)),
+	})
+	if err := r.Status().Update(ctx, &appSet); err != nil {
+		log.Error(err, fmt.Sprintf("could not update applicationset %s", appSet.Name))
+		return ctrl.Result{}, err
+	}
+
+	// directories and cluster secrets are not watched, so generate again periodically
+	return ctrl.Result{RequeueAfter: time.Duration(gitopsv1.DefaultSyncPeriodMinutes) * time.Minute}, nil
+}
+
+// Renders the applications of an ApplicationSet. Two sets of parameters rendering the same name are an error
+func (r *ApplicationSetReconciler) generateApplications(ctx context.Context, appSet *gitopsv1.ApplicationSet) ([]*gitopsv1.Application, error) {
+	allParams, err := r.generateParams(ctx, appSet)
+	if err != nil {
+		return nil, err
+	}
+
+	var apps []*gitopsv1.Application
+	names := make(map[string]bool)
+	for _, params := range allParams {
+		app, err := renderApplication(appSet, params)
+		if err != nil {
+			return nil, err
+		}
+		if names[app.Name] {
+			return nil, fmt.Errorf("more than one set of parameters generates application %s", app.Name)
+		}
+		names[app.Name] = true
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+// Creates a generated application or updates it if it differs from the live one. Applications that exist
+// but were not generated by the ApplicationSet are left alone
+func (r *ApplicationSetReconciler) applyApplication(ctx context.Context, appSet *gitopsv1.ApplicationSet, app *gitopsv1.Application) error {
+	// the webhook defaults the stored application, so compare with the defaulted spec
+	app.SetDefaults()
+
+	var live gitopsv1.Application
+	if err := r.Get(ctx, client.ObjectKeyFromObject(app), &live); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		if err := controllerutil.SetControllerReference(appSet, app, r.Scheme); err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info(fmt.Sprintf("Creating application %s", app.Name))
+		return r.Create(ctx, app)
+	}
+
+	if !metav1.IsControlledBy(&live, appSet) {
+		return fmt.Errorf("application %s already exists and is not managed by applicationset %s", app.Name, appSet.Name)
+	}
+
+	updated := live.DeepCopy()
+	updated.Spec = app.Spec
+	for key, value := range app.Labels {
+		if updated.Labels == nil {
+			updated.Labels = map[string]string{}
+		}
+		updated.Labels[key] = value
+	}
+	for key, value := range app.Annotations {
+		if updated.Annotations == nil {
+			updated.Annotations = map[string]string{}
+		}
+		updated.Annotations[key] = value
+	}
+	if equality.Semantic.DeepEqual(&live, updated) {
+		return nil
+	}
+	log.FromContext(ctx).Info(fmt.Sprintf("Updating application %s", app.Name))
+	return r.Update(ctx, updated)
+}
+
+func (r *ApplicationSetReconciler) handleGenerationError(ctx context.Context, appSet *gitopsv1.ApplicationSet, err error) (ctrl.Result, error) {
+	log.FromContext(ctx).Error(err, fmt.Sprintf("could not generate applications of applicationset %s", appSet.Name))
+	meta.SetStatusCondition(&appSet.Status.Conditions, metav1.Condition{
+		Type:               gitopsv1.ConditionTypeApplicationsGenerated,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: appSet.Generation,
+		Reason:             reasonGenerationFailed,
+		Message:            err.Error(),
+	})
+	if statusErr := r.Status().Update(ctx, appSet); statusErr != nil {
+		return ctrl.Result{}, statusErr
+	}
+	return ctrl.Result{}, err
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ApplicationSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// generated applications are watched so changes made to them by hand are reverted
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&gitopsv1.ApplicationSet{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Owns(&gitopsv1.Application{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
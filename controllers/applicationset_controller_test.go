@@ -0,0 +1,118 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestReconcileApplicationSet(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+
+	appSet := &gitopsv1.ApplicationSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "apps", Namespace: "gitops", UID: "appset-uid"},
+		Spec: gitopsv1.ApplicationSetSpec{
+			Generators: []gitopsv1.ApplicationSetGenerator{{ApplicationSetBaseGenerator: gitopsv1.ApplicationSetBaseGenerator{
+				List: &gitopsv1.ListGenerator{Elements: []map[string]string{{"name": "api"}, {"name": "web"}}},
+			}}},
+			Template: gitopsv1.ApplicationSetTemplate{
+				Metadata: gitopsv1.ApplicationSetTemplateMeta{Name: "{{name}}"},
+				Spec: gitopsv1.ApplicationSpec{Source: gitopsv1.ApplicationSource{
+					RepoURL: "https://github.com/org/repo",
+					Path:    "apps/{{name}}",
+				}},
+			},
+		},
+	}
+	stale := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "stale", Namespace: "gitops"}}
+	unmanaged := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "unmanaged", Namespace: "gitops"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(appSet, unmanaged).Build()
+	r := &ApplicationSetReconciler{Client: c, Scheme: scheme}
+	ctx := context.Background()
+
+	if err := controllerutil.SetControllerReference(appSet, stale, scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(appSet)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var api gitopsv1.Application
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "gitops", Name: "api"}, &api); err != nil {
+		t.Fatal(err)
+	}
+	if api.Spec.Source.Path != "apps/api" || !metav1.IsControlledBy(&api, appSet) {
+		t.Errorf("unexpected generated application %+v", api)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(stale), &gitopsv1.Application{}); err == nil {
+		t.Error("expected the application that is no longer generated to be deleted")
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(unmanaged), &gitopsv1.Application{}); err != nil {
+		t.Errorf("expected the application not generated by the set to be kept: %v", err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(appSet), appSet); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"api", "web"}; !reflect.DeepEqual(appSet.Status.Applications, want) {
+		t.Errorf("expected status applications %v, got %v", want, appSet.Status.Applications)
+	}
+
+	// changes made by hand are reverted
+	api.Spec.Source.Path = "elsewhere"
+	if err := c.Update(ctx, &api); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(appSet)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(&api), &api); err != nil {
+		t.Fatal(err)
+	}
+	if api.Spec.Source.Path != "apps/api" {
+		t.Errorf("expected the generated spec to be restored, got %s", api.Spec.Source.Path)
+	}
+
+	// an application that is not owned by the set is never taken over
+	if err := c.Get(ctx, client.ObjectKeyFromObject(appSet), appSet); err != nil {
+		t.Fatal(err)
+	}
+	appSet.Spec.Generators[0].List.Elements = append(appSet.Spec.Generators[0].List.Elements, map[string]string{"name": "unmanaged"})
+	if err := c.Update(ctx, appSet); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(appSet)}); err == nil {
+		t.Error("expected an error for an existing application that is not owned by the set")
+	}
+}
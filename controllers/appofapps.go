@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	// how often a parent that is being deleted checks whether its children are gone
+	childDeletionRequeueInterval = 5 * time.Second
+	// limits how far up a change of a child's status is propagated, in case applications manage each other
+	maxParentDepth = 10
+)
+
+// Order of the health codes from best to worst
+var healthSeverity = map[gitopsv1.HealthStatusCode]int{
+	gitopsv1.HealthStatusHealthy:     0,
+	gitopsv1.HealthStatusProgressing: 1,
+	gitopsv1.HealthStatusMissing:     2,
+	gitopsv1.HealthStatusDegraded:    3,
+}
+
+func isApplicationKind(gvk schema.GroupVersionKind) bool {
+	return gvk.Group == gitopsv1.GroupVersion.Group && gvk.Kind == "Application"
+}
+
+// Returns an error if an application is among its own targets
+func checkSelfReference(app *gitopsv1.Application, targetObjs []*unstructured.Unstructured) error {
+	for _, target := range targetObjs {
+		if isApplicationKind(target.GroupVersionKind()) && target.GetName() == app.Name && target.GetNamespace() == app.Namespace {
+			return fmt.Errorf("application %s cannot manage itself", trackingID(app))
+		}
+	}
+	return nil
+}
+
+// Children that don't set a project or service account inherit those of their parent, see childViolations
+func inheritChildRestrictions(app *gitopsv1.Application, targetObjs []*unstructured.Unstructured) {
+	for _, target := range targetObjs {
+		if !isApplicationKind(target.GroupVersionKind()) {
+			continue
+		}
+		if project, _, _ := unstructured.NestedString(target.Object, "spec", "project"); project == "" && app.Spec.Project != "" {
+			_ = unstructured.SetNestedField(target.Object, app.Spec.Project, "spec", "project")
+		}
+		if serviceAccount, _, _ := unstructured.NestedString(target.Object, "spec", "serviceAccountName"); serviceAccount == "" && app.Spec.ServiceAccountName != "" {
+			_ = unstructured.SetNestedField(target.Object, app.Spec.ServiceAccountName, "spec", "serviceAccountName")
+		}
+	}
+}
+
+// Children are restricted like their parent: they must be in the parent's project and impersonate its service
+// account, otherwise an application could lift its own restrictions by deploying another one. Adds the reasons
+// children are rejected for to the violations
+func (r *ApplicationReconciler) childViolations(app *gitopsv1.Application, targetObjs []*unstructured.Unstructured, violations map[resourceKey]string) error {
+	project, serviceAccount := r.projectName(app), r.serviceAccountName(app)
+	for _, target := range targetObjs {
+		key := keyOfResource(resourceFromObject(target))
+		if _, ok := violations[key]; ok || !isApplicationKind(target.GroupVersionKind()) {
+			continue
+		}
+		var child gitopsv1.Application
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(target.Object, &child); err != nil {
+			return fmt.Errorf("invalid child application %s/%s: %w", target.GetNamespace(), target.GetName(), err)
+		}
+		switch {
+		case project != "" && r.projectName(&child) != project:
+			violations[key] = fmt.Sprintf("child application must be in project %s of its parent", project)
+		case project != "" && r.projectNamespace(&child) != r.projectNamespace(app):
+			// projects are read from the namespace of the application, so this would be a different project
+			violations[key] = fmt.Sprintf("child application must be in namespace %s of its parent to be restricted by project %s", app.Namespace, project)
+		case serviceAccount != "" && r.serviceAccountName(&child) != serviceAccount:
+			violations[key] = fmt.Sprintf("child application must impersonate service account %s of its parent", serviceAccount)
+		}
+	}
+	return nil
+}
+
+// Keeps the state of a child application that is not defined in git when the parent updates it: the finalizer
+// that deletes the child's resources and a requested operation. Custom resources can't be updated without
+// a resource version
+func preserveChildState(target, live *unstructured.Unstructured) {
+	if !isApplicationKind(target.GroupVersionKind()) {
+		return
+	}
+	target.SetResourceVersion(live.GetResourceVersion())
+	target.SetFinalizers(live.GetFinalizers())
+	if _, ok := target.Object["operation"]; !ok {
+		if operation, ok := live.Object["operation"]; ok {
+			target.Object["operation"] = operation
+		}
+	}
+}
+
+// Returns the status of a child application as shown on its parent
+func childApplicationStatus(child *gitopsv1.Application) gitopsv1.ChildApplicationStatus {
+	status := gitopsv1.ChildApplicationStatus{
+		Name:       child.Name,
+		Namespace:  child.Namespace,
+		SyncStatus: child.Status.Sync.SyncStatus,
+		Health:     gitopsv1.HealthStatusHealthy,
+	}
+	if status.SyncStatus == "" {
+		status.SyncStatus = gitopsv1.SyncStatusUnknown
+	}
+
+	switch {
+	case meta.IsStatusConditionTrue(child.Status.Conditions, gitopsv1.ConditionTypeStalled) || child.Status.LastSyncError != "":
+		status.Health = gitopsv1.HealthStatusDegraded
+		status.Message = child.Status.LastSyncError
+	case child.Status.ObservedGeneration != child.Generation || child.Status.SyncedAt == nil:
+		status.Health = gitopsv1.HealthStatusProgressing
+		status.Message = "waiting for the latest spec to be synced"
+	case child.Status.Children != nil && child.Status.Children.Health != gitopsv1.HealthStatusHealthy:
+		// grandchildren are reflected on their grandparent
+		status.Health = child.Status.Children.Health
+		status.Message = fmt.Sprintf("child applications are %s", child.Status.Children.Health)
+	}
+	return status
+}
+
+// Aggregates the status of child applications. Returns nil if there are none
+func aggregateChildren(children []gitopsv1.ChildApplicationStatus) *gitopsv1.ChildrenStatus {
+	if len(children) == 0 {
+		return nil
+	}
+	aggregated := &gitopsv1.ChildrenStatus{
+		SyncStatus:   gitopsv1.SyncStatusSynced,
+		Health:       gitopsv1.HealthStatusHealthy,
+		Applications: children,
+	}
+	for _, child := range children {
+		switch {
+		case child.SyncStatus == gitopsv1.SyncStatusOutOfSync:
+			aggregated.SyncStatus = gitopsv1.SyncStatusOutOfSync
+		case child.SyncStatus != gitopsv1.SyncStatusSynced && aggregated.SyncStatus == gitopsv1.SyncStatusSynced:
+			aggregated.SyncStatus = gitopsv1.SyncStatusUnknown
+		}
+		if healthSeverity[child.Health] > healthSeverity[aggregated.Health] {
+			aggregated.Health = child.Health
+		}
+	}
+	return aggregated
+}
+
+// Collects the status of the applications among the resources of an application
+func (r *ApplicationReconciler) childrenStatus(ctx context.Context, resources []gitopsv1.Resource) (*gitopsv1.ChildrenStatus, error) {
+	var children []gitopsv1.ChildApplicationStatus
+	for _, resource := range resources {
+		if !isApplicationKind(schema.GroupVersionKind{Group: resource.Group, Version: resource.Version, Kind: resource.Kind}) {
+			continue
+		}
+		var child gitopsv1.Application
+		if err := r.Get(ctx, types.NamespacedName{Namespace: resource.Namespace, Name: resource.Name}, &child); err != nil {
+			if !errors.IsNotFound(err) {
+				return nil, err
+			}
+			children = append(children, gitopsv1.ChildApplicationStatus{
+				Name:       resource.Name,
+				Namespace:  resource.Namespace,
+				SyncStatus: gitopsv1.SyncStatusOutOfSync,
+				Health:     gitopsv1.HealthStatusMissing,
+			})
+			continue
+		}
+		children = append(children, childApplicationStatus(&child))
+	}
+	return aggregateChildren(children), nil
+}
+
+// Returns the number of child applications among the resources that still exist
+func (r *ApplicationReconciler) remainingChildren(ctx context.Context, resources []gitopsv1.Resource) (int, error) {
+	remaining := 0
+	for _, resource := range resources {
+		if !isApplicationKind(schema.GroupVersionKind{Group: resource.Group, Version: resource.Version, Kind: resource.Kind}) {
+			continue
+		}
+		err := r.Get(ctx, types.NamespacedName{Namespace: resource.Namespace, Name: resource.Name}, &gitopsv1.Application{})
+		if err == nil {
+			remaining++
+		} else if !errors.IsNotFound(err) {
+			return 0, err
+		}
+	}
+	return remaining, nil
+}
+
+// Updates the entry of an application in the children status of the application managing it, so the parent
+// reflects the child without syncing again. Failures are only logged, the parent catches up on its next sync
+func (r *ApplicationReconciler) updateParent(ctx context.Context, child *gitopsv1.Application) {
+	for depth := 0; child != nil && depth < maxParentDepth; depth++ {
+		parent, err := r.patchParentStatus(ctx, child)
+		if err != nil {
+			log.FromContext(ctx).Error(err, fmt.Sprintf("could not update parent of application %s", trackingID(child)))
+			return
+		}
+		child = parent
+	}
+}
+
+// Returns the parent if its status changed, so the change can be propagated further up
+func (r *ApplicationReconciler) patchParentStatus(ctx context.Context, child *gitopsv1.Application) (*gitopsv1.Application, error) {
+	key, ok := parseTrackingID(child.Annotations[trackingAnnotation])
+	if !ok {
+		return nil, nil
+	}
+
+	var parent gitopsv1.Application
+	changed := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		changed = false
+		if err := r.Get(ctx, key, &parent); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		// the parent adds new children on its next sync
+		if parent.Status.Children == nil {
+			return nil
+		}
+		children := append([]gitopsv1.ChildApplicationStatus{}, parent.Status.Children.Applications...)
+		found := false
+		for i := range children {
+			if children[i].Name == child.Name && children[i].Namespace == child.Namespace {
+				children[i] = childApplicationStatus(child)
+				found = true
+			}
+		}
+		aggregated := aggregateChildren(children)
+		if !found || equality.Semantic.DeepEqual(parent.Status.Children, aggregated) {
+			return nil
+		}
+
+		patch := client.MergeFromWithOptions(parent.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		parent.Status.Children = aggregated
+		changed = true
+		return r.Status().Patch(ctx, &parent, patch)
+	})
+	if err != nil || !changed {
+		return nil, err
+	}
+	return &parent, nil
+}
@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestChildApplicationStatus(t *testing.T) {
+	now := metav1.Now()
+	synced := gitopsv1.Application{
+		ObjectMeta: metav1.ObjectMeta{Name: "child", Namespace: "apps", Generation: 2},
+		Status: gitopsv1.ApplicationStatus{
+			ObservedGeneration: 2,
+			SyncedAt:           &now,
+			Sync:               gitopsv1.SyncStatus{SyncStatus: gitopsv1.SyncStatusSynced},
+		},
+	}
+
+	progressing := synced.DeepCopy()
+	progressing.Generation = 3
+
+	degraded := synced.DeepCopy()
+	degraded.Status.Sync.SyncStatus = gitopsv1.SyncStatusOutOfSync
+	degraded.Status.LastSyncError = "could not create ConfigMap"
+
+	grandchildMissing := synced.DeepCopy()
+	grandchildMissing.Status.Children = &gitopsv1.ChildrenStatus{SyncStatus: gitopsv1.SyncStatusOutOfSync, Health: gitopsv1.HealthStatusMissing}
+
+	for name, tc := range map[string]struct {
+		app        *gitopsv1.Application
+		syncStatus gitopsv1.SyncStatusCode
+		health     gitopsv1.HealthStatusCode
+	}{
+		"synced":             {&synced, gitopsv1.SyncStatusSynced, gitopsv1.HealthStatusHealthy},
+		"new spec":           {progressing, gitopsv1.SyncStatusSynced, gitopsv1.HealthStatusProgressing},
+		"failed sync":        {degraded, gitopsv1.SyncStatusOutOfSync, gitopsv1.HealthStatusDegraded},
+		"missing grandchild": {grandchildMissing, gitopsv1.SyncStatusSynced, gitopsv1.HealthStatusMissing},
+		"never synced":       {&gitopsv1.Application{}, gitopsv1.SyncStatusUnknown, gitopsv1.HealthStatusProgressing},
+	} {
+		status := childApplicationStatus(tc.app)
+		if status.SyncStatus != tc.syncStatus || status.Health != tc.health {
+			t.Errorf("%s: expected %s/%s, got %s/%s", name, tc.syncStatus, tc.health, status.SyncStatus, status.Health)
+		}
+	}
+}
+
+func TestAggregateChildren(t *testing.T) {
+	if aggregateChildren(nil) != nil {
+		t.Error("expected no children status without children")
+	}
+
+	aggregated := aggregateChildren([]gitopsv1.ChildApplicationStatus{
+		{Name: "a", SyncStatus: gitopsv1.SyncStatusSynced, Health: gitopsv1.HealthStatusHealthy},
+		{Name: "b", SyncStatus: gitopsv1.SyncStatusUnknown, Health: gitopsv1.HealthStatusProgressing},
+	})
+	if aggregated.SyncStatus != gitopsv1.SyncStatusUnknown || aggregated.Health != gitopsv1.HealthStatusProgressing {
+		t.Errorf("unexpected aggregate %s/%s", aggregated.SyncStatus, aggregated.Health)
+	}
+
+	aggregated = aggregateChildren([]gitopsv1.ChildApplicationStatus{
+		{Name: "a", SyncStatus: gitopsv1.SyncStatusOutOfSync, Health: gitopsv1.HealthStatusDegraded},
+		{Name: "b", SyncStatus: gitopsv1.SyncStatusUnknown, Health: gitopsv1.HealthStatusMissing},
+	})
+	if aggregated.SyncStatus != gitopsv1.SyncStatusOutOfSync || aggregated.Health != gitopsv1.HealthStatusDegraded {
+		t.Errorf("unexpected aggregate %s/%s", aggregated.SyncStatus, aggregated.Health)
+	}
+}
+
+func TestPreserveChildState(t *testing.T) {
+	live := newObject("gitops.jellis18.gitopscontroller.io/v1", "Application", "apps", "child")
+	live.SetResourceVersion("42")
+	live.SetFinalizers([]string{finalizerName})
+	live.Object["operation"] = map[string]interface{}{"sync": map[string]interface{}{}}
+
+	target := newObject("gitops.jellis18.gitopscontroller.io/v1", "Application", "apps", "child")
+	preserveChildState(target, live)
+	if target.GetResourceVersion() != "42" || len(target.GetFinalizers()) != 1 || target.Object["operation"] == nil {
+		t.Errorf("expected the state of the child to be preserved, got %v", target.Object)
+	}
+
+	configMap := newObject("v1", "ConfigMap", "apps", "config")
+	preserveChildState(configMap, live)
+	if configMap.GetResourceVersion() != "" {
+		t.Error("expected only applications to be changed")
+	}
+
+	parent := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "child", Namespace: "apps"}}
+	if err := checkSelfReference(parent, []*unstructured.Unstructured{target}); err == nil {
+		t.Error("expected an error for an application managing itself")
+	}
+}
+
+func TestUpdateParent(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+
+	root := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "root", Namespace: "apps"}}
+	parent := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "parent", Namespace: "apps"}}
+	setTracking(parent, root)
+	child := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "child", Namespace: "apps"}}
+	setTracking(child, parent)
+
+	now := metav1.Now()
+	parent.Status = gitopsv1.ApplicationStatus{
+		SyncedAt: &now,
+		Sync:     gitopsv1.SyncStatus{SyncStatus: gitopsv1.SyncStatusSynced},
+		Children: aggregateChildren([]gitopsv1.ChildApplicationStatus{
+			{Name: "child", Namespace: "apps", SyncStatus: gitopsv1.SyncStatusSynced, Health: gitopsv1.HealthStatusHealthy},
+		}),
+	}
+	root.Status.Children = aggregateChildren([]gitopsv1.ChildApplicationStatus{childApplicationStatus(parent)})
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(root, parent, child).Build()
+	r := &ApplicationReconciler{Client: c, Scheme: scheme}
+	ctx := context.Background()
+
+	// the child's sync fails
+	child.Status.Sync.SyncStatus = gitopsv1.SyncStatusOutOfSync
+	child.Status.LastSyncError = "could not fetch k8s resources from git repo"
+	r.updateParent(ctx, child)
+
+	if err := c.Get(ctx, client.ObjectKeyFromObject(parent), parent); err != nil {
+		t.Fatal(err)
+	}
+	if parent.Status.Children.Health != gitopsv1.HealthStatusDegraded || parent.Status.Children.SyncStatus != gitopsv1.SyncStatusOutOfSync {
+		t.Errorf("expected the parent to show the degraded child, got %+v", parent.Status.Children)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(root), root); err != nil {
+		t.Fatal(err)
+	}
+	if root.Status.Children.Health != gitopsv1.HealthStatusDegraded {
+		t.Errorf("expected the change to be propagated to the root, got %+v", root.Status.Children)
+	}
+
+	remaining, err := r.remainingChildren(ctx, []gitopsv1.Resource{
+		{Group: gitopsv1.GroupVersion.Group, Version: "v1", Kind: "Application", Namespace: "apps", Name: "child"},
+		{Group: gitopsv1.GroupVersion.Group, Version: "v1", Kind: "Application", Namespace: "apps", Name: "deleted"},
+		{Version: "v1", Kind: "ConfigMap", Namespace: "apps", Name: "child"},
+	})
+	if err != nil || remaining != 1 {
+		t.Errorf("expected 1 remaining child, got %d %v", remaining, err)
+	}
+}
+
+func TestChildViolations(t *testing.T) {
+	newChild := func(name, namespace, project, serviceAccount string) *unstructured.Unstructured {
+		child := newObject("gitops.jellis18.gitopscontroller.io/v1", "Application", namespace, name)
+		if project != "" {
+			_ = unstructured.SetNestedField(child.Object, project, "spec", "project")
+		}
+		if serviceAccount != "" {
+			_ = unstructured.SetNestedField(child.Object, serviceAccount, "spec", "serviceAccountName")
+		}
+		return child
+	}
+	parent := &gitopsv1.Application{
+		ObjectMeta: metav1.ObjectMeta{Name: "parent", Namespace: "team-a"},
+		Spec:       gitopsv1.ApplicationSpec{Project: "team-a", ServiceAccountName: "deployer"},
+	}
+	inherits := newChild("inherits", "team-a", "", "")
+	same := newChild("same", "team-a", "team-a", "deployer")
+	otherProject := newChild("other-project", "team-a", "admin", "")
+	otherServiceAccount := newChild("other-service-account", "team-a", "", "admin")
+	otherNamespace := newChild("other-namespace", "team-b", "", "")
+	targets := []*unstructured.Unstructured{inherits, same, otherProject, otherServiceAccount, otherNamespace, newObject("v1", "ConfigMap", "team-a", "config")}
+
+	r := &ApplicationReconciler{}
+	inheritChildRestrictions(parent, targets)
+	if project, _, _ := unstructured.NestedString(inherits.Object, "spec", "project"); project != "team-a" {
+		t.Errorf("expected the project of the parent to be inherited, got %q", project)
+	}
+	if serviceAccount, _, _ := unstructured.NestedString(inherits.Object, "spec", "serviceAccountName"); serviceAccount != "deployer" {
+		t.Errorf("expected the service account of the parent to be inherited, got %q", serviceAccount)
+	}
+
+	violations := make(map[resourceKey]string)
+	if err := r.childViolations(parent, targets, violations); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range targets {
+		_, rejected := violations[keyOfResource(resourceFromObject(target))]
+		want := target == otherProject || target == otherServiceAccount || target == otherNamespace
+		if rejected != want {
+			t.Errorf("%s: expected rejected %v, got %v", target.GetName(), want, rejected)
+		}
+	}
+
+	// projects read from the project namespace are the same in every namespace
+	r.ProjectNamespace = "gitops-system"
+	violations = make(map[resourceKey]string)
+	if err := r.childViolations(parent, []*unstructured.Unstructured{otherNamespace}, violations); err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 0 {
+		t.Errorf("expected children in other namespaces to be permitted, got %v", violations)
+	}
+}
@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	// bundles are held in memory while they are extracted
+	maxBundleSize = 256 << 20
+
+	// the extracted manifests are held in memory as well, this protects against archives that decompress
+	// to far more than their size
+	maxExtractedBundleSize = maxBundleSize
+
+	// prefix of revisions that are the ETag of a bundle rather than its checksum
+	bundleETagPrefix = "etag:"
+
+	defaultS3Region = "us-east-1"
+
+	// sha256 of an empty request body, sent with all S3 requests
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Bundles are tarballs in a bucket or served over http(s), e.g. https://example.com/manifests/app.tar.gz
+func isBundleSource(repoURL string) bool {
+	if isS3Source(repoURL) {
+		return true
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+	for _, suffix := range []string{".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(u.Path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isS3Source(repoURL string) bool {
+	return strings.HasPrefix(repoURL, gitopsv1.S3SourcePrefix)
+}
+
+// Fetches bundles of manifests over http(s) or from S3-compatible buckets. The revision of a bundle is
+// the checksum given as target revision, or else the ETag of the bundle
+type bundleClient struct {
+	httpClient *http.Client
+
+	username string
+	password string
+	token    string
+
+	accessKeyID     string
+	secretAccessKey string
+	region          string
+	endpoint        string
+
+	// bundles without ETag are downloaded to compute their checksum, they are kept here for getRepoObjs
+	downloaded map[string][]byte
+}
+
+func newBundleClient(repoSecret *corev1.Secret, httpClient *http.Client) *bundleClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	c := &bundleClient{httpClient: httpClient, region: defaultS3Region, downloaded: make(map[string][]byte)}
+	if repoSecret != nil {
+		c.username = string(repoSecret.Data[gitopsv1.RepoSecretUsernameKey])
+		c.password = string(repoSecret.Data[gitopsv1.RepoSecretPasswordKey])
+		c.token = string(repoSecret.Data[apiTokenSecretKey])
+		c.accessKeyID = string(repoSecret.Data[gitopsv1.RepoSecretAccessKeyIDKey])
+		c.secretAccessKey = string(repoSecret.Data[gitopsv1.RepoSecretSecretAccessKeyKey])
+		c.endpoint = strings.TrimSuffix(string(repoSecret.Data[gitopsv1.RepoSecretEndpointKey]), "/")
+		if region := string(repoSecret.Data[gitopsv1.RepoSecretRegionKey]); region != "" {
+			c.region = region
+		}
+	}
+	return c
+}
+
+// Resolves a bundle to its checksum if the target revision is one, or else to its current ETag
+func (c *bundleClient) resolveRevision(ctx context.Context, source gitopsv1.ApplicationSource, lastRevision string) (string, error) {
+	if sha256DigestPattern.MatchString(source.TargetRevision) {
+		return source.TargetRevision, nil
+	}
+
+	resp, err := c.do(ctx, http.MethodHead, source.RepoURL)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMethodNotAllowed {
+		return "", fmt.Errorf("could not get bundle %s: %s", source.RepoURL, resp.Status)
+	}
+	if etag := bundleETag(resp); etag != "" {
+		return etag, nil
+	}
+
+	// servers without ETags, the revision is the checksum of the current content
+	bundle, err := c.download(ctx, source.RepoURL, "")
+	if err != nil {
+		return "", err
+	}
+	revision := sha256Digest(bundle)
+	c.downloaded[revision] = bundle
+	return revision, nil
+}
+
+// Downloads the bundle at the given revision and reads the manifests at the source path
+func (c *bundleClient) getRepoObjs(ctx context.Context, source gitopsv1.ApplicationSource, revision string) ([]*unstructured.Unstructured, error) {
+	bundle, ok := c.downloaded[revision]
+	if !ok {
+		var err error
+		if bundle, err = c.download(ctx, source.RepoURL, revision); err != nil {
+			return nil, err
+		}
+	}
+
+	objs, found, err := getResourcesFromBundle(bundle, source.Path)
+	if err != nil {
+		return nil, fmt.Errorf("could not extract bundle %s: %w", source.RepoURL, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("path %s not found in bundle %s", source.Path, source.RepoURL)
+	}
+	return objs, nil
+}
+
+// Downloads a bundle and verifies that it is still at the given revision
+func (c *bundleClient) download(ctx context.Context, repoURL, revision string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, repoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not get bundle %s: %s", repoURL, resp.Status)
+	}
+	if strings.HasPrefix(revision, bundleETagPrefix) {
+		if etag := bundleETag(resp); etag != revision {
+			return nil, fmt.Errorf("bundle %s changed while syncing, expected %s, got %s", repoURL, revision, etag)
+		}
+	}
+
+	bundle, err := io.ReadAll(io.LimitReader(resp.Body, maxBundleSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(bundle) > maxBundleSize {
+		return nil, fmt.Errorf("bundle %s is larger than %d bytes", repoURL, maxBundleSize)
+	}
+	if sha256DigestPattern.MatchString(revision) {
+		if checksum := sha256Digest(bundle); checksum != revision {
+			return nil, fmt.Errorf("checksum of bundle %s does not match %s, got %s", repoURL, revision, checksum)
+		}
+	}
+	return bundle, nil
+}
+
+// Sends a request for a bundle. S3 requests are signed with the access key of the client, other
+// requests send the token or username and password of the client
+func (c *bundleClient) do(ctx context.Context, method, repoURL string) (*http.Response, error) {
+	target := repoURL
+	if isS3Source(repoURL) {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(repoURL, gitopsv1.S3SourcePrefix), "/")
+		endpoint := c.endpoint
+		if endpoint == "" {
+			endpoint = "https://s3." + c.region + ".amazonaws.com"
+		}
+		// path-style requests work with AWS and S3-compatible services like MinIO alike
+		target = endpoint + (&url.URL{Path: "/" + bucket + "/" + key}).EscapedPath()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case isS3Source(repoURL) && c.accessKeyID != "":
+		req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+		signV4(req, c.accessKeyID, c.secretAccessKey, c.region, "s3", time.Now())
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return c.httpClient.Do(req)
+}
+
+// Returns the revision for the ETag of a response, or an empty string if there is none
+func bundleETag(resp *http.Response) string {
+	etag := strings.Trim(strings.TrimPrefix(resp.Header.Get("ETag"), "W/"), `"`)
+	if etag == "" {
+		return ""
+	}
+	// revisions of several sources are separated by commas
+	return bundleETagPrefix + strings.ReplaceAll(etag, ",", "")
+}
+
+// Signs a request with AWS signature version 4. The host and all headers set on the request are signed
+func signV4(req *http.Request, accessKeyID, secretAccessKey, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = emptyPayloadHash
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, canonicalURI, canonicalQuery(req.URL.Query()), canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// Query parameters sorted by name and value, with spaces encoded as %20
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
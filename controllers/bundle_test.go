@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+// A MinIO-like S3 service serving objects with path-style requests. Requests must be signed with the
+// given access key
+type testBucketService struct {
+	objects         map[string][]byte
+	accessKeyID     string
+	secretAccessKey string
+}
+
+func (s *testBucketService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.validSignature(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	content, ok := s.objects[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sum := sha256.Sum256(content)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(content)
+	}
+}
+
+// Signs a copy of the request with the signed headers and compares the signatures
+func (s *testBucketService) validSignature(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	_, signedHeaders, ok := strings.Cut(authorization, "SignedHeaders=")
+	if !ok {
+		return false
+	}
+	signedHeaders, _, _ = strings.Cut(signedHeaders, ",")
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	for _, name := range strings.Split(signedHeaders, ";") {
+		if name != "host" && name != "x-amz-date" {
+			req.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	signV4(req, s.accessKeyID, s.secretAccessKey, defaultS3Region, "s3", date)
+	return req.Header.Get("Authorization") == authorization
+}
+
+func TestSignV4(t *testing.T) {
+	// example from the AWS signature version 4 documentation
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4(req, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "iam",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestBundleClientHTTP(t *testing.T) {
+	bundle := newTarball(t, "", map[string]string{
+		"prod/config.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n",
+		"dev/config.yaml":  "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: dev-config\n",
+	}).Bytes()
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "ci" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(bundle)
+		}
+	}))
+	defer server.Close()
+
+	repoSecret := &corev1.Secret{Data: map[string][]byte{
+		gitopsv1.RepoSecretUsernameKey: []byte("ci"),
+		gitopsv1.RepoSecretPasswordKey: []byte("secret"),
+	}}
+	ctx := context.Background()
+	source := gitopsv1.ApplicationSource{RepoURL: server.URL + "/manifests/app.tar.gz", TargetRevision: "HEAD", Path: "prod"}
+
+	revision, err := newBundleClient(repoSecret, server.Client()).resolveRevision(ctx, source, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != "etag:v1" {
+		t.Fatalf("expected the ETag as revision, got %s", revision)
+	}
+	objs, err := newBundleClient(repoSecret, server.Client()).getRepoObjs(ctx, source, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].GetName() != "config" {
+		t.Errorf("expected the manifests of the path, got %v", objs)
+	}
+
+	if _, err := newBundleClient(nil, server.Client()).resolveRevision(ctx, source, ""); err == nil {
+		t.Error("expected an error without credentials")
+	}
+
+	// the bundle is replaced between resolving the revision and downloading it
+	etag = `"v2"`
+	if _, err := newBundleClient(repoSecret, server.Client()).getRepoObjs(ctx, source, revision); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("expected an error for a changed bundle, got %v", err)
+	}
+
+	// without ETag the revision is the checksum of the content
+	etag = ""
+	client := newBundleClient(repoSecret, server.Client())
+	if revision, err = client.resolveRevision(ctx, source, ""); err != nil || revision != sha256Digest(bundle) {
+		t.Errorf("expected the checksum as revision, got %s %v", revision, err)
+	}
+	if _, err := client.getRepoObjs(ctx, source, revision); err != nil {
+		t.Error(err)
+	}
+
+	source.TargetRevision = "sha256:" + strings.Repeat("a", 64)
+	client = newBundleClient(repoSecret, server.Client())
+	if revision, err = client.resolveRevision(ctx, source, ""); err != nil || revision != source.TargetRevision {
+		t.Errorf("expected the checksum of the target revision, got %s %v", revision, err)
+	}
+	if _, err := client.getRepoObjs(ctx, source, revision); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestBundleClientS3(t *testing.T) {
+	service := &testBucketService{
+		objects: map[string][]byte{
+			"manifests/apps/app.tar.gz": newTarball(t, "", map[string]string{
+				"config.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n",
+			}).Bytes(),
+		},
+		accessKeyID:     "minio",
+		secretAccessKey: "minio-secret",
+	}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	repoSecret := &corev1.Secret{Data: map[string][]byte{
+		gitopsv1.RepoSecretAccessKeyIDKey:     []byte("minio"),
+		gitopsv1.RepoSecretSecretAccessKeyKey: []byte("minio-secret"),
+		gitopsv1.RepoSecretEndpointKey:        []byte(server.URL),
+	}}
+	ctx := context.Background()
+	source := gitopsv1.ApplicationSource{RepoURL: "s3://manifests/apps/app.tar.gz", TargetRevision: "HEAD"}
+
+	client := newBundleClient(repoSecret, server.Client())
+	revision, err := client.resolveRevision(ctx, source, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(revision, bundleETagPrefix) {
+		t.Errorf("expected the ETag as revision, got %s", revision)
+	}
+	objs, err := client.getRepoObjs(ctx, source, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].GetName() != "config" {
+		t.Errorf("unexpected objects %v", objs)
+	}
+
+	repoSecret.Data[gitopsv1.RepoSecretSecretAccessKeyKey] = []byte("wrong")
+	if _, err := newBundleClient(repoSecret, server.Client()).resolveRevision(ctx, source, ""); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected the request to be rejected, got %v", err)
+	}
+
+	for repoURL, want := range map[string]bool{
+		"s3://bucket/app.tar.gz":                true,
+		"https://example.com/app.tgz":           true,
+		"https://github.com/org/repo":           false,
+		"oci://registry.example.com/app:v1":     false,
+		"https://example.com/app.tar.gz?x=1":    true,
+		"git@github.com:org/repo-bundle.tar.gz": false,
+	} {
+		if got := isBundleSource(repoURL); got != want {
+			t.Errorf("%s: expected %v, got %v", repoURL, want, got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+// Version of how fetched files are rendered into objects. It is part of the cache key, so it must be
+// bumped whenever the rendered objects change, or manifests spilled to disk by older versions are reused
+const manifestRenderVersion = 1
+
+// ManifestCacheKey identifies a set of manifests fetched from a repository.
+// Since the revision is always a resolved commit SHA the cached manifests never go stale.
+type ManifestCacheKey struct {
+	RepoURL  string
+	Revision string
+	Path     string
+
+	// manifests fetched or rendered differently are cached separately
+	FetchMode     FetchMode
+	RenderVersion int
+}
+
+func newManifestCacheKey(source gitopsv1.ApplicationSource, revision string, fetchMode FetchMode) ManifestCacheKey {
+	return ManifestCacheKey{
+		RepoURL:       source.RepoURL,
+		Revision:      revision,
+		Path:          source.Path,
+		FetchMode:     fetchMode,
+		RenderVersion: manifestRenderVersion,
+	}
+}
+
+func (k ManifestCacheKey) String() string {
+	return fmt.Sprintf("%s@%s:%s?fetchMode=%s&renderVersion=%d", k.RepoURL, k.Revision, k.Path, k.FetchMode, k.RenderVersion)
+}
+
+type manifestCacheEntry struct {
+	key  string
+	objs []*unstructured.Unstructured
+}
+
+// ManifestCache is a controller wide, size bounded LRU cache of manifests fetched from git
+// that is shared by all Applications. Entries evicted from memory are optionally spilled to disk.
+// Concurrent fetches of the same key are deduplicated so only one of them hits the git provider.
+type ManifestCache struct {
+	mu sync.Mutex
+
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+
+	// if set, entries evicted from memory are written to this directory
+	spillDir        string
+	maxSpillEntries int
+	spilled         map[string]*list.Element
+	spillLRU        *list.List
+
+	group singleflight.Group
+}
+
+// NewManifestCache creates a cache holding at most maxEntries manifest sets in memory.
+// If spillDir is not empty, up to maxSpillEntries evicted manifest sets are kept on disk.
+func NewManifestCache(maxEntries int, spillDir string, maxSpillEntries int) (*ManifestCache, error) {
+	if spillDir != "" {
+		if err := os.MkdirAll(spillDir, 0o700); err != nil {
+			return nil, fmt.Errorf("could not create manifest cache directory %s: %w", spillDir, err)
+		}
+	}
+	return &ManifestCache{
+		maxEntries:      maxEntries,
+		entries:         make(map[string]*list.Element),
+		lru:             list.New(),
+		spillDir:        spillDir,
+		maxSpillEntries: maxSpillEntries,
+		spilled:         make(map[string]*list.Element),
+		spillLRU:        list.New(),
+	}, nil
+}
+
+// GetOrFetch returns the manifests for key from the cache, calling fetch to populate it on a miss.
+// A nil cache always calls fetch. Returned objects are copies and can be safely modified by the caller.
+func (c *ManifestCache) GetOrFetch(ctx context.Context, key ManifestCacheKey, fetch func() ([]*unstructured.Unstructured, error)) ([]*unstructured.Unstructured, error) {
+	if c == nil {
+		return fetch()
+	}
+
+	k := key.String()
+	if objs, ok := c.get(ctx, k); ok {
+		manifestCacheRequestsTotal.WithLabelValues("hit").Inc()
+		return deepCopyObjs(objs), nil
+	}
+	manifestCacheRequestsTotal.WithLabelValues("miss").Inc()
+
+	v, err, _ := c.group.Do(k, func() (interface{}, error) {
+		objs, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		c.add(ctx, k, deepCopyObjs(objs))
+		return objs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deepCopyObjs(v.([]*unstructured.Unstructured)), nil
+}
+
+func (c *ManifestCache) get(ctx context.Context, key string) ([]*unstructured.Unstructured, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*manifestCacheEntry).objs, true
+	}
+
+	if _, ok := c.spilled[key]; !ok {
+		return nil, false
+	}
+	objs, err := c.readSpilled(key)
+	c.removeSpilled(ctx, key)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "could not read spilled manifests, fetching again", "key", key)
+		return nil, false
+	}
+	c.addLocked(ctx, key, objs)
+	return objs, true
+}
+
+func (c *ManifestCache) add(ctx context.Context, key string, objs []*unstructured.Unstructured) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(ctx, key, objs)
+}
+
+func (c *ManifestCache) addLocked(ctx context.Context, key string, objs []*unstructured.Unstructured) {
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		elem.Value.(*manifestCacheEntry).objs = objs
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&manifestCacheEntry{key: key, objs: objs})
+
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*manifestCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		if c.spillDir != "" {
+			c.spill(ctx, entry)
+		}
+	}
+}
+
+// Writes an entry evicted from memory to disk, evicting the oldest spilled entry if the disk is full.
+// Must be called with the lock held
+func (c *ManifestCache) spill(ctx context.Context, entry *manifestCacheEntry) {
+	data, err := json.Marshal(entry.objs)
+	if err == nil {
+		err = os.WriteFile(c.spillPath(entry.key), data, 0o600)
+	}
+	if err != nil {
+		log.FromContext(ctx).Error(err, "could not spill manifests to disk", "key", entry.key)
+		return
+	}
+	c.spilled[entry.key] = c.spillLRU.PushFront(entry.key)
+
+	for c.spillLRU.Len() > c.maxSpillEntries {
+		c.removeSpilled(ctx, c.spillLRU.Back().Value.(string))
+	}
+}
+
+func (c *ManifestCache) readSpilled(key string) ([]*unstructured.Unstructured, error) {
+	data, err := os.ReadFile(c.spillPath(key))
+	if err != nil {
+		return nil, err
+	}
+	var objs []*unstructured.Unstructured
+	if err := json.Unmarshal(data, &objs); err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+func (c *ManifestCache) removeSpilled(ctx context.Context, key string) {
+	if elem, ok := c.spilled[key]; ok {
+		c.spillLRU.Remove(elem)
+		delete(c.spilled, key)
+	}
+	if err := os.Remove(c.spillPath(key)); err != nil && !os.IsNotExist(err) {
+		log.FromContext(ctx).Error(err, "could not remove spilled manifests", "key", key)
+	}
+}
+
+func (c *ManifestCache) spillPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.spillDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func deepCopyObjs(objs []*unstructured.Unstructured) []*unstructured.Unstructured {
+	copied := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		copied = append(copied, obj.DeepCopy())
+	}
+	return copied
+}
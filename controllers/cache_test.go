@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestManifestCacheSpillsEvictedEntries(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewManifestCache(1, t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches int
+	fetch := func(name string) func() ([]*unstructured.Unstructured, error) {
+		return func() ([]*unstructured.Unstructured, error) {
+			fetches++
+			return []*unstructured.Unstructured{newObject("v1", "ConfigMap", "", name)}, nil
+		}
+	}
+
+	first := ManifestCacheKey{RepoURL: "https://github.com/org/repo", Revision: "abc", Path: "first"}
+	second := ManifestCacheKey{RepoURL: "https://github.com/org/repo", Revision: "abc", Path: "second"}
+	third := ManifestCacheKey{RepoURL: "https://github.com/org/repo", Revision: "abc", Path: "third"}
+
+	for _, key := range []ManifestCacheKey{first, second, first} {
+		if _, err := cache.GetOrFetch(ctx, key, fetch(key.Path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// first was evicted to disk by second and read back from there
+	if fetches != 2 {
+		t.Fatalf("expected 2 fetches, got %d", fetches)
+	}
+
+	objs, err := cache.GetOrFetch(ctx, second, fetch(second.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 2 || len(objs) != 1 || objs[0].GetName() != "second" {
+		t.Fatalf("expected spilled manifests for second, got %d fetches and %v", fetches, objs)
+	}
+
+	// the disk only holds one entry, so spilling second drops first entirely
+	if _, err := cache.GetOrFetch(ctx, third, fetch(third.Path)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetOrFetch(ctx, first, fetch(first.Path)); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 4 {
+		t.Fatalf("expected 4 fetches, got %d", fetches)
+	}
+}
+
+func TestManifestCacheDeduplicatesConcurrentFetches(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewManifestCache(10, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := ManifestCacheKey{RepoURL: "https://github.com/org/repo", Revision: "abc", Path: "manifests"}
+	var fetches int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			objs, err := cache.GetOrFetch(ctx, key, func() ([]*unstructured.Unstructured, error) {
+				atomic.AddInt32(&fetches, 1)
+				time.Sleep(50 * time.Millisecond)
+				return []*unstructured.Unstructured{newObject("v1", "ConfigMap", "", "cm")}, nil
+			})
+			if err != nil || len(objs) != 1 {
+				t.Errorf("unexpected result %v, %v", objs, err)
+				return
+			}
+			// callers get their own copies
+			objs[0].SetNamespace("modified")
+		}()
+	}
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Fatalf("expected a single fetch, got %d", fetches)
+	}
+	objs, _ := cache.GetOrFetch(ctx, key, nil)
+	if objs[0].GetNamespace() != "" {
+		t.Fatalf("cached manifests were modified by a caller")
+	}
+}
+
+func TestManifestCacheKeyIncludesFetchMode(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewManifestCache(10, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := gitopsv1.ApplicationSource{RepoURL: "https://github.com/org/repo", Path: "manifests"}
+	var fetches int
+	fetch := func() ([]*unstructured.Unstructured, error) {
+		fetches++
+		return []*unstructured.Unstructured{newObject("v1", "ConfigMap", "", "cm")}, nil
+	}
+	for _, key := range []ManifestCacheKey{
+		newManifestCacheKey(source, "abc", FetchModeContents),
+		newManifestCacheKey(source, "abc", FetchModeArchive),
+		newManifestCacheKey(source, "abc", FetchModeContents),
+	} {
+		if _, err := cache.GetOrFetch(ctx, key, fetch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 2 {
+		t.Fatalf("expected manifests of each fetch mode to be fetched once, got %d fetches", fetches)
+	}
+}
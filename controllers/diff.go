@@ -0,0 +1,499 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+type pathSegmentKind int
+
+const (
+	// a map key. JSON pointer tokens that are numbers also index into lists
+	segmentField pathSegmentKind = iota
+	// a list index, e.g. [0]
+	segmentIndex
+	// all items of a list, i.e. []
+	segmentAll
+	// the current value if it matches, e.g. select(.name == "app")
+	segmentSelect
+)
+
+type pathSegment struct {
+	kind  pathSegmentKind
+	field string
+	index int
+
+	// for segmentSelect the field compared and the value it has to be equal to
+	selectPath  []pathSegment
+	selectValue string
+}
+
+// ignoreDifferencesRule is a compiled gitopsv1.ResourceIgnoreDifferences
+type ignoreDifferencesRule struct {
+	gitopsv1.ResourceIgnoreDifferences
+	paths [][]pathSegment
+}
+
+// Compiles the ignoreDifferences of an application
+func ignoreDifferencesRules(app *gitopsv1.Application) ([]ignoreDifferencesRule, error) {
+	var rules []ignoreDifferencesRule
+	for _, ignore := range app.Spec.IgnoreDifferences {
+		rule := ignoreDifferencesRule{ResourceIgnoreDifferences: ignore}
+		for _, pointer := range ignore.JSONPointers {
+			path, err := parseJSONPointer(pointer)
+			if err != nil {
+				return nil, fmt.Errorf("invalid json pointer %q: %w", pointer, err)
+			}
+			rule.paths = append(rule.paths, path)
+		}
+		for _, expression := range ignore.JQPathExpressions {
+			path, err := parseJQPath(expression)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path expression %q: %w", expression, err)
+			}
+			rule.paths = append(rule.paths, path)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *ignoreDifferencesRule) matches(obj *unstructured.Unstructured) bool {
+	gvk := obj.GroupVersionKind()
+	return rule.Group == gvk.Group && rule.Kind == gvk.Kind &&
+		(rule.Name == "" || rule.Name == obj.GetName()) &&
+		(rule.Namespace == "" || rule.Namespace == obj.GetNamespace())
+}
+
+// Replaces the ignored fields of the target with their live values, so they are neither
+// reported as differences nor overwritten when the target is applied
+func applyIgnoreDifferences(rules []ignoreDifferencesRule, target, live *unstructured.Unstructured) {
+	for i := range rules {
+		if !rules[i].matches(target) {
+			continue
+		}
+		for _, path := range rules[i].paths {
+			obj, _ := preserveLiveValue(target.Object, true, live.Object, true, path)
+			target.Object = obj.(map[string]interface{})
+		}
+	}
+}
+
+// Sets the value at path in target to the value at path in live, or removes it if live has no value there.
+// Returns the new target value and whether it is set
+func preserveLiveValue(target interface{}, targetOK bool, live interface{}, liveOK bool, path []pathSegment) (interface{}, bool) {
+	if len(path) == 0 {
+		if !liveOK {
+			return nil, false
+		}
+		return runtime.DeepCopyJSONValue(live), true
+	}
+
+	segment, rest := path[0], path[1:]
+	switch segment.kind {
+	case segmentField:
+		if targetList, ok := target.([]interface{}); ok && segment.index >= 0 {
+			return preserveLiveItem(targetList, live, segment.index, rest), true
+		}
+		targetMap, ok := target.(map[string]interface{})
+		if targetOK && !ok {
+			return target, true
+		}
+		if !targetOK {
+			targetMap = map[string]interface{}{}
+		}
+		liveMap, _ := live.(map[string]interface{})
+		liveValue, liveHasValue := liveMap[segment.field]
+		targetValue, targetHasValue := targetMap[segment.field]
+		if value, ok := preserveLiveValue(targetValue, targetHasValue, liveValue, liveHasValue, rest); ok {
+			targetMap[segment.field] = value
+		} else {
+			delete(targetMap, segment.field)
+		}
+		if !targetOK && len(targetMap) == 0 {
+			return nil, false
+		}
+		return targetMap, true
+	case segmentIndex:
+		targetList, ok := target.([]interface{})
+		if !ok {
+			return target, targetOK
+		}
+		return preserveLiveItem(targetList, live, segment.index, rest), true
+	case segmentAll:
+		targetList, ok := target.([]interface{})
+		if !ok {
+			return target, targetOK
+		}
+		liveList, _ := live.([]interface{})
+		for i, item := range targetList {
+			liveItem, liveHasItem := listCounterpart(item, i, liveList)
+			if value, ok := preserveLiveValue(item, true, liveItem, liveHasItem, rest); ok {
+				targetList[i] = value
+			}
+		}
+		return targetList, true
+	case segmentSelect:
+		if !targetOK || !segment.selects(target) {
+			return target, targetOK
+		}
+		return preserveLiveValue(target, targetOK, live, liveOK, rest)
+	}
+	return target, targetOK
+}
+
+// List items can't be removed without shifting the following items, so they are kept if live has no value
+func preserveLiveItem(targetList []interface{}, live interface{}, index int, rest []pathSegment) []interface{} {
+	if index >= len(targetList) {
+		return targetList
+	}
+	liveList, _ := live.([]interface{})
+	liveHasItem := index < len(liveList)
+	var liveItem interface{}
+	if liveHasItem {
+		liveItem = liveList[index]
+	}
+	if value, ok := preserveLiveValue(targetList[index], true, liveItem, liveHasItem, rest); ok {
+		targetList[index] = value
+	}
+	return targetList
+}
+
+// Finds the live item of a list corresponding to a target item. Items with a name (containers, ports, env vars, ...)
+// are matched by name, others by their position in the list
+func listCounterpart(item interface{}, index int, liveList []interface{}) (interface{}, bool) {
+	if name, ok := nameOf(item); ok {
+		for _, liveItem := range liveList {
+			if liveName, ok := nameOf(liveItem); ok && liveName == name {
+				return liveItem, true
+			}
+		}
+		return nil, false
+	}
+	if index < len(liveList) {
+		return liveList[index], true
+	}
+	return nil, false
+}
+
+func nameOf(item interface{}) (string, bool) {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	name, ok := m["name"].(string)
+	return name, ok
+}
+
+func (segment *pathSegment) selects(value interface{}) bool {
+	for _, s := range segment.selectPath {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if value, ok = m[s.field]; !ok {
+			return false
+		}
+	}
+	return fmt.Sprint(value) == segment.selectValue
+}
+
+// Parses a JSON pointer as defined in RFC 6901, e.g. /metadata/annotations/example.com~1key
+func parseJSONPointer(pointer string) ([]pathSegment, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("must start with /")
+	}
+	var path []pathSegment
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		index := -1
+		if i, err := strconv.Atoi(token); err == nil && i >= 0 {
+			index = i
+		}
+		path = append(path, pathSegment{kind: segmentField, field: token, index: index})
+	}
+	return path, nil
+}
+
+// Parses the subset of jq path expressions that select fields: .field, ."field", ["field"], [0], [] and
+// select(.field == "value") filters, optionally separated by pipes
+func parseJQPath(expression string) ([]pathSegment, error) {
+	expression = strings.TrimSpace(expression)
+	if expression == "" {
+		return nil, fmt.Errorf("must not be empty")
+	}
+
+	var path []pathSegment
+	for len(expression) > 0 {
+		switch {
+		case strings.HasPrefix(expression, "|"):
+			expression = strings.TrimSpace(expression[1:])
+		case strings.HasPrefix(expression, "select("):
+			end := closingParen(expression)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated select")
+			}
+			segment, err := parseSelect(expression[len("select("):end])
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, segment)
+			expression = strings.TrimSpace(expression[end+1:])
+		case strings.HasPrefix(expression, "[") || strings.HasPrefix(expression, "."):
+			segment, rest, err := parseJQSegment(expression)
+			if err != nil {
+				return nil, err
+			}
+			if segment != nil {
+				path = append(path, *segment)
+			}
+			expression = strings.TrimSpace(rest)
+		default:
+			return nil, fmt.Errorf("unexpected %q", expression)
+		}
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("must select a field")
+	}
+	return path, nil
+}
+
+// Parses one segment of a path. A lone "." (the identity) returns no segment
+func parseJQSegment(expression string) (*pathSegment, string, error) {
+	if strings.HasPrefix(expression, "[") {
+		end := strings.Index(expression, "]")
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated [")
+		}
+		inner := strings.TrimSpace(expression[1:end])
+		rest := expression[end+1:]
+		switch {
+		case inner == "":
+			return &pathSegment{kind: segmentAll}, rest, nil
+		case strings.HasPrefix(inner, `"`):
+			field, err := strconv.Unquote(inner)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid field %s", inner)
+			}
+			return &pathSegment{kind: segmentField, field: field, index: -1}, rest, nil
+		default:
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, "", fmt.Errorf("invalid index %s", inner)
+			}
+			return &pathSegment{kind: segmentIndex, index: index}, rest, nil
+		}
+	}
+
+	expression = expression[1:]
+	if strings.HasPrefix(expression, `"`) {
+		end := strings.Index(expression[1:], `"`)
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated field")
+		}
+		return &pathSegment{kind: segmentField, field: expression[1 : end+1], index: -1}, expression[end+2:], nil
+	}
+	end := strings.IndexAny(expression, ".[| ")
+	if end < 0 {
+		end = len(expression)
+	}
+	if end == 0 {
+		return nil, expression, nil
+	}
+	return &pathSegment{kind: segmentField, field: expression[:end], index: -1}, expression[end:], nil
+}
+
+// Parses the condition of a select filter, e.g. .name == "app"
+func parseSelect(condition string) (pathSegment, error) {
+	left, right, ok := strings.Cut(condition, "==")
+	if !ok {
+		return pathSegment{}, fmt.Errorf("select only supports == conditions")
+	}
+	selectPath, err := parseJQPath(left)
+	if err != nil {
+		return pathSegment{}, err
+	}
+	for _, s := range selectPath {
+		if s.kind != segmentField {
+			return pathSegment{}, fmt.Errorf("select only supports field paths")
+		}
+	}
+	value := strings.TrimSpace(right)
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+	return pathSegment{kind: segmentSelect, selectPath: selectPath, selectValue: value}, nil
+}
+
+func closingParen(expression string) int {
+	depth, quoted := 0, false
+	for i, c := range expression {
+		switch {
+		case c == '"' && (i == 0 || expression[i-1] != '\\'):
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Checks whether a live resource differs from its target state. Only fields set in git are compared,
+// so defaults and fields added by the API server or other controllers are not differences
+func isOutOfSync(rules []ignoreDifferencesRule, target, live *unstructured.Unstructured) bool {
+	target = target.DeepCopy()
+	unstructured.RemoveNestedField(target.Object, "status")
+	normalizeSecretStringData(target)
+	applyIgnoreDifferences(rules, target, live)
+	return !isSubset(target.Object, live.Object, false)
+}
+
+// The API server merges stringData of secrets into data
+func normalizeSecretStringData(obj *unstructured.Unstructured) {
+	if obj.GroupVersionKind().Group != "" || obj.GetKind() != "Secret" {
+		return
+	}
+	stringData, ok, _ := unstructured.NestedStringMap(obj.Object, "stringData")
+	if !ok {
+		return
+	}
+	for key, value := range stringData {
+		_ = unstructured.SetNestedField(obj.Object, base64.StdEncoding.EncodeToString([]byte(value)), "data", key)
+	}
+	unstructured.RemoveNestedField(obj.Object, "stringData")
+}
+
+// Fields holding resource quantities (or maps of them) in core types, e.g. resources.requests of containers,
+// spec.hard of resource quotas, the limits of limit ranges and emptyDir sizeLimit
+var quantityFields = map[string]bool{
+	"requests":             true,
+	"limits":               true,
+	"hard":                 true,
+	"max":                  true,
+	"min":                  true,
+	"default":              true,
+	"defaultRequest":       true,
+	"maxLimitRequestRatio": true,
+	"overhead":             true,
+	"capacity":             true,
+	"sizeLimit":            true,
+}
+
+// The API server stores quantities in canonical form, e.g. 0.5 becomes 500m and 1Gi stays 1Gi.
+// Values of quantity fields are compared by their value instead
+func isSubset(target, live interface{}, quantities bool) bool {
+	if quantities {
+		if equal, ok := equalQuantities(target, live); ok {
+			return equal
+		}
+	}
+	switch t := target.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return len(t) == 0 && live == nil
+		}
+		for key, value := range t {
+			liveValue, ok := l[key]
+			if !ok {
+				if isEmpty(value) {
+					continue
+				}
+				return false
+			}
+			if !isSubset(value, liveValue, quantities || quantityFields[key]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok {
+			return len(t) == 0 && live == nil
+		}
+		if len(t) != len(l) {
+			return false
+		}
+		for i := range t {
+			if !isSubset(t[i], l[i], false) {
+				return false
+			}
+		}
+		return true
+	case int64, float64:
+		tf, _ := toFloat(t)
+		lf, ok := toFloat(live)
+		return ok && tf == lf
+	default:
+		return reflect.DeepEqual(target, live)
+	}
+}
+
+func isEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Compares two quantities. Returns false for ok if either value is not a quantity
+func equalQuantities(target, live interface{}) (equal bool, ok bool) {
+	targetQuantity, ok := parseQuantity(target)
+	if !ok {
+		return false, false
+	}
+	liveQuantity, ok := parseQuantity(live)
+	if !ok {
+		return false, false
+	}
+	return targetQuantity.Cmp(liveQuantity) == 0, true
+}
+
+// Quantities may be written as numbers in YAML, e.g. cpu: 0.5
+func parseQuantity(value interface{}) (resource.Quantity, bool) {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return resource.Quantity{}, false
+	}
+	quantity, err := resource.ParseQuantity(s)
+	return quantity, err == nil
+}
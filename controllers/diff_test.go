@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func newDeployment(replicas int64, image string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"replicas": replicas,
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "sidecar", "image": "proxy:1"},
+						map[string]interface{}{"name": "app", "image": image},
+					},
+				},
+			},
+		},
+	}}
+}
+
+func TestParseJQPath(t *testing.T) {
+	valid := []string{
+		".spec.replicas",
+		`.metadata.annotations["example.com/key"]`,
+		`.metadata."example.com/key"`,
+		".webhooks[].clientConfig.caBundle",
+		".spec.ports[0].nodePort",
+		`.spec.template.spec.containers[] | select(.name == "app") | .image`,
+		`.spec.template.spec.containers[] | select(.name == "app").image`,
+	}
+	for _, expression := range valid {
+		if _, err := parseJQPath(expression); err != nil {
+			t.Errorf("%s: %v", expression, err)
+		}
+	}
+
+	invalid := []string{"", "spec.replicas", ".spec[", ".spec[-1]", `select(.name != "app")`, `select(.name == "app"`}
+	for _, expression := range invalid {
+		if _, err := parseJQPath(expression); err == nil {
+			t.Errorf("%s: expected error", expression)
+		}
+	}
+}
+
+func TestIsOutOfSync(t *testing.T) {
+	live := newDeployment(5, "app:1")
+	live.SetResourceVersion("42")
+	live.Object["status"] = map[string]interface{}{"readyReplicas": int64(5)}
+
+	replicas := []gitopsv1.ResourceIgnoreDifferences{{Group: "apps", Kind: "Deployment", JSONPointers: []string{"/spec/replicas"}}}
+	image := []gitopsv1.ResourceIgnoreDifferences{{Group: "apps", Kind: "Deployment", JQPathExpressions: []string{`.spec.template.spec.containers[] | select(.name == "app") | .image`}}}
+	otherName := []gitopsv1.ResourceIgnoreDifferences{{Group: "apps", Kind: "Deployment", Name: "api", JSONPointers: []string{"/spec/replicas"}}}
+
+	tests := []struct {
+		name   string
+		target *unstructured.Unstructured
+		ignore []gitopsv1.ResourceIgnoreDifferences
+		want   bool
+	}{
+		{name: "in sync", target: newDeployment(5, "app:1"), want: false},
+		{name: "replicas changed", target: newDeployment(3, "app:1"), want: true},
+		{name: "replicas ignored", target: newDeployment(3, "app:1"), ignore: replicas, want: false},
+		{name: "rule for other resource", target: newDeployment(3, "app:1"), ignore: otherName, want: true},
+		{name: "image changed", target: newDeployment(5, "app:2"), want: true},
+		{name: "image ignored", target: newDeployment(5, "app:2"), ignore: image, want: false},
+	}
+	for _, tt := range tests {
+		rules, err := ignoreDifferencesRules(&gitopsv1.Application{Spec: gitopsv1.ApplicationSpec{IgnoreDifferences: tt.ignore}})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := isOutOfSync(rules, tt.target, live); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestIsOutOfSyncQuantities(t *testing.T) {
+	withResources := func(requests, limits map[string]interface{}) *unstructured.Unstructured {
+		deployment := newDeployment(5, "app:1")
+		containers, _, _ := unstructured.NestedSlice(deployment.Object, "spec", "template", "spec", "containers")
+		containers[1].(map[string]interface{})["resources"] = map[string]interface{}{"requests": requests, "limits": limits}
+		_ = unstructured.SetNestedSlice(deployment.Object, containers, "spec", "template", "spec", "containers")
+		return deployment
+	}
+	// the API server stores quantities in canonical form
+	live := withResources(map[string]interface{}{"cpu": "500m", "memory": "1Gi"}, map[string]interface{}{"cpu": "2", "memory": "1500M"})
+
+	tests := []struct {
+		name   string
+		target *unstructured.Unstructured
+		want   bool
+	}{
+		{name: "canonical", target: withResources(map[string]interface{}{"cpu": "500m", "memory": "1Gi"}, map[string]interface{}{"cpu": "2", "memory": "1500M"}), want: false},
+		{name: "decimal and milli", target: withResources(map[string]interface{}{"cpu": "0.5", "memory": "1024Mi"}, map[string]interface{}{"cpu": "2000m", "memory": "1.5G"}), want: false},
+		{name: "numbers", target: withResources(map[string]interface{}{"cpu": 0.5, "memory": "1Gi"}, map[string]interface{}{"cpu": int64(2), "memory": "1500M"}), want: false},
+		{name: "cpu changed", target: withResources(map[string]interface{}{"cpu": "0.25", "memory": "1Gi"}, map[string]interface{}{"cpu": "2", "memory": "1500M"}), want: true},
+		{name: "memory changed", target: withResources(map[string]interface{}{"cpu": "500m", "memory": "1G"}, map[string]interface{}{"cpu": "2", "memory": "1500M"}), want: true},
+	}
+	for _, tt := range tests {
+		if got := isOutOfSync(nil, tt.target, live); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	// other fields are not compared as quantities
+	target, liveConfig := newDeployment(5, "app:1"), newDeployment(5, "app:1")
+	_ = unstructured.SetNestedField(target.Object, "0.5", "metadata", "annotations", "scale")
+	_ = unstructured.SetNestedField(liveConfig.Object, "500m", "metadata", "annotations", "scale")
+	if !isOutOfSync(nil, target, liveConfig) {
+		t.Errorf("expected annotation change to be out of sync")
+	}
+}
+
+func TestApplyIgnoreDifferences(t *testing.T) {
+	rules, err := ignoreDifferencesRules(&gitopsv1.Application{Spec: gitopsv1.ApplicationSpec{
+		IgnoreDifferences: []gitopsv1.ResourceIgnoreDifferences{{
+			Group:             "apps",
+			Kind:              "Deployment",
+			JSONPointers:      []string{"/spec/replicas"},
+			JQPathExpressions: []string{".metadata.annotations"},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := newDeployment(5, "app:1")
+	target := newDeployment(1, "app:2")
+	target.SetAnnotations(map[string]string{"example.com/key": "value"})
+	applyIgnoreDifferences(rules, target, live)
+
+	if replicas, _, _ := unstructured.NestedInt64(target.Object, "spec", "replicas"); replicas != 5 {
+		t.Errorf("expected live replicas to be kept, got %d", replicas)
+	}
+	if _, ok, _ := unstructured.NestedFieldNoCopy(target.Object, "metadata", "annotations"); ok {
+		t.Error("expected annotations not set on the live resource to be removed")
+	}
+	containers, _, _ := unstructured.NestedSlice(target.Object, "spec", "template", "spec", "containers")
+	if image := containers[1].(map[string]interface{})["image"]; image != "app:2" {
+		t.Errorf("expected fields that are not ignored to be applied, got image %v", image)
+	}
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+// A sync is a dry-run if the sync policy or the requested operation asks for one
+func isDryRun(app *gitopsv1.Application) bool {
+	if app.Spec.SyncPolicy != nil && app.Spec.SyncPolicy.DryRun {
+		return true
+	}
+	return app.Operation != nil && app.Operation.Sync != nil && app.Operation.Sync.DryRun
+}
+
+// A dry-run is required if the spec changed or the target revision resolves to a new commit since the last one
+func isDryRunRequired(app *gitopsv1.Application, revision string) bool {
+	last := app.Status.DryRun
+	return last == nil || last.ObservedGeneration != app.Generation || last.Revision != revision
+}
+
+// Runs the create, update and prune steps of a sync with server-side dry-run. Rejections are not
+// sync errors, they are recorded per resource in the application status and the next resource is tried
+func (r *ApplicationReconciler) dryRunSync(ctx context.Context, resourceClient client.Client, app *gitopsv1.Application, revision string, targetObjs []*unstructured.Unstructured, selectors []gitopsv1.ResourceSelector, rules []ignoreDifferencesRule, violations map[resourceKey]string) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+	log.Info("Running dry-run sync", "revision", revision)
+
+	var results []gitopsv1.DryRunResult
+	var resourceList []gitopsv1.Resource
+	for _, target := range targetObjs {
+		resource := resourceFromObject(target)
+		resourceList = append(resourceList, resource)
+		if violation, ok := violations[keyOfResource(resource)]; ok {
+			results = append(results, dryRunResult(resource, gitopsv1.DryRunActionUpdate, fmt.Errorf("%s: %s", gitopsv1.ResourceWarningProjectViolation, violation)))
+			continue
+		}
+
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(target.GroupVersionKind())
+		action := gitopsv1.DryRunActionUpdate
+		err := resourceClient.Get(ctx, client.ObjectKey{Namespace: target.GetNamespace(), Name: target.GetName()}, u)
+		switch {
+		case errors.IsNotFound(err):
+			action = gitopsv1.DryRunActionCreate
+			setTracking(target, app)
+			err = resourceClient.Create(ctx, target, client.DryRunAll)
+		case meta.IsNoMatchError(err):
+			// the kind is not known to the cluster (yet), so a real sync would fail to create it as well
+			action = gitopsv1.DryRunActionCreate
+		case err != nil:
+			return r.handleSyncError(ctx, app, fmt.Errorf("could not fetch %s %s/%s: %w", target.GetKind(), target.GetNamespace(), target.GetName(), err))
+		default:
+			owner, other, ownerErr := r.managedByOther(ctx, u, app)
+			if ownerErr != nil {
+				return r.handleSyncError(ctx, app, fmt.Errorf("could not check owner of %s %s/%s: %w", target.GetKind(), target.GetNamespace(), target.GetName(), ownerErr))
+			}
+			if other {
+				err = fmt.Errorf("%s: managed by application %s", gitopsv1.ResourceWarningSharedResource, owner)
+				break
+			}
+			if owner != "" {
+				log.Info("Dry-run adopts orphaned resource", "kind", target.GetKind(), "namespace", target.GetNamespace(), "name", target.GetName(), "application", owner)
+			}
+			applyIgnoreDifferences(rules, target, u)
+			preserveChildState(target, u)
+			setTracking(target, app)
+			err = resourceClient.Update(ctx, target, client.DryRunAll)
+		}
+		results = append(results, dryRunResult(resource, action, err))
+	}
+
+	managed, err := r.managedResources(ctx, app)
+	if err != nil {
+		return r.handleSyncError(ctx, app, fmt.Errorf("could not find managed resources: %w", err))
+	}
+	orphans := r.findOrphans(managed, resourceList)
+	if len(selectors) > 0 {
+		if orphans, err = r.selectOrphans(ctx, resourceClient, orphans, selectors); err != nil {
+			return r.handleSyncError(ctx, app, fmt.Errorf("could not select orphans: %w", err))
+		}
+	}
+	for _, orphan := range orphans {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(schema.GroupVersionKind{Group: orphan.Group, Version: orphan.Version, Kind: orphan.Kind})
+		if err := resourceClient.Get(ctx, client.ObjectKey{Namespace: orphan.Namespace, Name: orphan.Name}, u); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return r.handleSyncError(ctx, app, fmt.Errorf("could not fetch %s %s/%s: %w", orphan.Kind, orphan.Namespace, orphan.Name, err))
+		}
+		if _, other := trackedByOther(u, app); other {
+			continue
+		}
+		results = append(results, dryRunResult(orphan, gitopsv1.DryRunActionDelete, resourceClient.Delete(ctx, u, client.DryRunAll)))
+	}
+
+	if err := r.completeOperation(ctx, app); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var rejected int
+	for _, result := range results {
+		if result.Error != "" {
+			log.Info("Dry-run rejected", "action", result.Action, "kind", result.Kind, "namespace", result.Namespace, "name", result.Name, "error", result.Error)
+			rejected++
+		}
+	}
+	condition := metav1.Condition{
+		Type:               gitopsv1.ConditionTypeDryRunSucceeded,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: app.Generation,
+		Reason:             "ResourcesAccepted",
+		Message:            fmt.Sprintf("all %d resources passed the dry-run of revision %s", len(results), revision),
+	}
+	if rejected > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ResourcesRejected"
+		condition.Message = fmt.Sprintf("%d of %d resources were rejected in the dry-run of revision %s", rejected, len(results), revision)
+	}
+	meta.SetStatusCondition(&app.Status.Conditions, condition)
+
+	app.Status.ReconciledAt = &metav1.Time{Time: time.Now()}
+	app.Status.DryRun = &gitopsv1.DryRunStatus{
+		Revision:           revision,
+		ObservedGeneration: app.Generation,
+		RanAt:              metav1.Now(),
+		Resources:          results,
+	}
+	if err := r.Status().Update(ctx, app); err != nil {
+		log.Error(err, fmt.Sprintf("could not update application %s", app.Name))
+		return ctrl.Result{}, err
+	}
+	return r.requeueAfterSyncPeriod(app), nil
+}
+
+func dryRunResult(resource gitopsv1.Resource, action gitopsv1.DryRunAction, err error) gitopsv1.DryRunResult {
+	result := gitopsv1.DryRunResult{
+		Group:     resource.Group,
+		Version:   resource.Version,
+		Kind:      resource.Kind,
+		Name:      resource.Name,
+		Namespace: resource.Namespace,
+		Action:    action,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestDryRunSync(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+
+	orphan := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "orphan", Namespace: "default"}}
+	app := &gitopsv1.Application{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Generation: 2},
+		Spec:       gitopsv1.ApplicationSpec{SyncPolicy: &gitopsv1.SyncPolicy{DryRun: true}},
+		Status: gitopsv1.ApplicationStatus{
+			Resources: []gitopsv1.Resource{{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "orphan"}},
+		},
+	}
+	r := &ApplicationReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(app, orphan).Build(), Scheme: scheme}
+
+	target := newObject("v1", "ConfigMap", "default", "new")
+
+	ctx := context.Background()
+	if _, err := r.dryRunSync(ctx, r.Client, app, "abc123", []*unstructured.Unstructured{target}, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var configMaps corev1.ConfigMapList
+	if err := r.List(ctx, &configMaps); err != nil {
+		t.Fatal(err)
+	}
+	if len(configMaps.Items) != 1 || configMaps.Items[0].Name != "orphan" {
+		t.Errorf("dry-run changed the cluster: %v", configMaps.Items)
+	}
+
+	var got gitopsv1.Application
+	if err := r.Get(ctx, client.ObjectKeyFromObject(app), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.DryRun == nil || got.Status.DryRun.Revision != "abc123" || len(got.Status.DryRun.Resources) != 2 {
+		t.Fatalf("unexpected dry-run status %+v", got.Status.DryRun)
+	}
+	if create := got.Status.DryRun.Resources[0]; create.Name != "new" || create.Action != gitopsv1.DryRunActionCreate || create.Error != "" {
+		t.Errorf("unexpected result %+v", create)
+	}
+	if prune := got.Status.DryRun.Resources[1]; prune.Name != "orphan" || prune.Action != gitopsv1.DryRunActionDelete || prune.Error != "" {
+		t.Errorf("unexpected result %+v", prune)
+	}
+	if !meta.IsStatusConditionTrue(got.Status.Conditions, gitopsv1.ConditionTypeDryRunSucceeded) {
+		t.Errorf("expected %s condition, got %v", gitopsv1.ConditionTypeDryRunSucceeded, got.Status.Conditions)
+	}
+	if len(got.Status.Resources) != 1 || got.Status.Sync.Revision != "" {
+		t.Errorf("dry-run changed the sync status: %+v", got.Status)
+	}
+	if isDryRunRequired(&got, "abc123") {
+		t.Error("expected dry-run of the same revision to be skipped")
+	}
+}
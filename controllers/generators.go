@@ -0,0 +1,347 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+// The parameters the template of an ApplicationSet is rendered with
+type generatorParams map[string]string
+
+// References a parameter in a template, e.g. {{path.basename}}
+var templateParamPattern = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// Characters that are replaced by path.basenameNormalized
+var unnormalizedCharPattern = regexp.MustCompile(`[^a-z0-9.-]`)
+
+// Returns the parameters of all generators of an ApplicationSet
+func (r *ApplicationSetReconciler) generateParams(ctx context.Context, appSet *gitopsv1.ApplicationSet) ([]generatorParams, error) {
+	var allParams []generatorParams
+	for i, generator := range appSet.Spec.Generators {
+		params, err := r.generate(ctx, appSet, generator)
+		if err != nil {
+			return nil, fmt.Errorf("generator %d: %w", i, err)
+		}
+		allParams = append(allParams, params...)
+	}
+	return allParams, nil
+}
+
+func (r *ApplicationSetReconciler) generate(ctx context.Context, appSet *gitopsv1.ApplicationSet, generator gitopsv1.ApplicationSetGenerator) ([]generatorParams, error) {
+	set := 0
+	for _, isSet := range []bool{generator.List != nil, generator.Git != nil, generator.Clusters != nil, generator.Matrix != nil, generator.Merge != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one generator must be set but found %d", set)
+	}
+
+	switch {
+	case generator.Matrix != nil:
+		return r.generateMatrix(ctx, appSet, generator.Matrix)
+	case generator.Merge != nil:
+		return r.generateMerge(ctx, appSet, generator.Merge)
+	default:
+		return r.generateBase(ctx, appSet, generator.ApplicationSetBaseGenerator)
+	}
+}
+
+func (r *ApplicationSetReconciler) generateBase(ctx context.Context, appSet *gitopsv1.ApplicationSet, generator gitopsv1.ApplicationSetBaseGenerator) ([]generatorParams, error) {
+	switch {
+	case generator.List != nil && generator.Git == nil && generator.Clusters == nil:
+		return generateList(generator.List), nil
+	case generator.Git != nil && generator.List == nil && generator.Clusters == nil:
+		return r.generateGitDirectories(ctx, appSet, generator.Git)
+	case generator.Clusters != nil && generator.List == nil && generator.Git == nil:
+		return r.generateClusters(ctx, appSet, generator.Clusters)
+	}
+	return nil, fmt.Errorf("exactly one of list, git and clusters must be set")
+}
+
+func generateList(list *gitopsv1.ListGenerator) []generatorParams {
+	params := make([]generatorParams, 0, len(list.Elements))
+	for _, element := range list.Elements {
+		params = append(params, copyParams(element))
+	}
+	return params
+}
+
+// Generates parameters for the matching directories of a git repository
+func (r *ApplicationSetReconciler) generateGitDirectories(ctx context.Context, appSet *gitopsv1.ApplicationSet, git *gitopsv1.GitGenerator) ([]generatorParams, error) {
+	apiToken, err := getRepoAPIToken(ctx, r.Client, appSet.Namespace, git.RepoSecret)
+	if err != nil {
+		return nil, err
+	}
+	stateManager := NewAppStateManager(apiToken, FetchModeContents, r.ResponseCache)
+
+	revision := git.Revision
+	if revision == "" {
+		revision = gitopsv1.DefaultTargetRevision
+	}
+
+	dirs, err := matchDirectories(git.Directories, func(dirPath string) ([]string, error) {
+		return stateManager.listDirectories(ctx, git.RepoURL, revision, dirPath)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list directories of %s: %w", git.RepoURL, err)
+	}
+
+	params := make([]generatorParams, 0, len(dirs))
+	for _, dir := range dirs {
+		basename := path.Base(dir)
+		params = append(params, generatorParams{
+			"path":                    dir,
+			"path.basename":           basename,
+			"path.basenameNormalized": unnormalizedCharPattern.ReplaceAllString(strings.ToLower(basename), "-"),
+		})
+	}
+	return params, nil
+}
+
+// Returns the sorted paths of the directories matched by the included and not matched by the excluded items.
+// Only the last path segment of an item may be a glob, so only its parent directory has to be listed
+func matchDirectories(items []gitopsv1.GitDirectoryGeneratorItem, listDirectories func(dirPath string) ([]string, error)) ([]string, error) {
+	listed := make(map[string][]string)
+	included := make(map[string]bool)
+	excluded := make(map[string]bool)
+
+	for _, item := range items {
+		pattern := strings.Trim(path.Clean("/"+item.Path), "/")
+		parent := path.Dir(pattern)
+		if parent == "." {
+			parent = ""
+		}
+		if hasGlob(parent) {
+			return nil, fmt.Errorf("only the last segment of path %s may be a glob", item.Path)
+		}
+
+		var matches []string
+		if !hasGlob(path.Base(pattern)) {
+			matches = []string{pattern}
+		} else {
+			dirs, ok := listed[parent]
+			if !ok {
+				var err error
+				if dirs, err = listDirectories(parent); err != nil {
+					return nil, err
+				}
+				listed[parent] = dirs
+			}
+			for _, dir := range dirs {
+				if matched, err := path.Match(pattern, dir); err != nil {
+					return nil, fmt.Errorf("invalid path %s: %w", item.Path, err)
+				} else if matched {
+					matches = append(matches, dir)
+				}
+			}
+		}
+
+		for _, match := range matches {
+			if item.Exclude {
+				excluded[match] = true
+			} else {
+				included[match] = true
+			}
+		}
+	}
+
+	var dirs []string
+	for dir := range included {
+		if !excluded[dir] {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+func hasGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// Generates parameters for the clusters registered with cluster secrets in the namespace of the ApplicationSet.
+// Applications are always deployed to the cluster the controller runs in, so secrets of other clusters are
+// rejected instead of generating applications that would be deployed to the wrong cluster
+func (r *ApplicationSetReconciler) generateClusters(ctx context.Context, appSet *gitopsv1.ApplicationSet, clusters *gitopsv1.ClusterGenerator) ([]generatorParams, error) {
+	selector := labels.SelectorFromSet(labels.Set{gitopsv1.ClusterSecretTypeLabel: gitopsv1.ClusterSecretType})
+	if clusters.Selector != nil {
+		clusterSelector, err := metav1.LabelSelectorAsSelector(clusters.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster selector: %w", err)
+		}
+		requirements, _ := clusterSelector.Requirements()
+		selector = selector.Add(requirements...)
+	}
+
+	var secrets corev1.SecretList
+	if err := r.List(ctx, &secrets, client.InNamespace(appSet.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, fmt.Errorf("could not list cluster secrets: %w", err)
+	}
+
+	var params []generatorParams
+	if clusters.Selector == nil {
+		params = append(params, generatorParams{"name": gitopsv1.InClusterName, "server": gitopsv1.InClusterServer})
+	}
+	for _, secret := range secrets.Items {
+		name := string(secret.Data["name"])
+		if name == "" {
+			name = secret.Name
+		}
+		server := string(secret.Data["server"])
+		if server != gitopsv1.InClusterServer {
+			return nil, fmt.Errorf("cluster secret %s has server %q, but applications can only be deployed to the cluster of the controller (%s)", secret.Name, server, gitopsv1.InClusterServer)
+		}
+		clusterParams := generatorParams{"name": name, "server": server}
+		for key, value := range secret.Labels {
+			clusterParams["metadata.labels."+key] = value
+		}
+		params = append(params, clusterParams)
+	}
+	return params, nil
+}
+
+// Combines every set of parameters of the first generator with every set of the second
+func (r *ApplicationSetReconciler) generateMatrix(ctx context.Context, appSet *gitopsv1.ApplicationSet, matrix *gitopsv1.MatrixGenerator) ([]generatorParams, error) {
+	if len(matrix.Generators) != 2 {
+		return nil, fmt.Errorf("matrix generator needs exactly 2 generators but has %d", len(matrix.Generators))
+	}
+	left, err := r.generateBase(ctx, appSet, matrix.Generators[0])
+	if err != nil {
+		return nil, err
+	}
+	right, err := r.generateBase(ctx, appSet, matrix.Generators[1])
+	if err != nil {
+		return nil, err
+	}
+	return combineParams(left, right)
+}
+
+func combineParams(left, right []generatorParams) ([]generatorParams, error) {
+	var combined []generatorParams
+	for _, l := range left {
+		for _, r := range right {
+			params := copyParams(l)
+			for key, value := range r {
+				if existing, ok := params[key]; ok && existing != value {
+					return nil, fmt.Errorf("matrix generators produce different values for parameter %s: %q and %q", key, existing, value)
+				}
+				params[key] = value
+			}
+			combined = append(combined, params)
+		}
+	}
+	return combined, nil
+}
+
+// Overrides the parameters of the first generator with the parameters of the following generators
+// that have the same values for all merge keys
+func (r *ApplicationSetReconciler) generateMerge(ctx context.Context, appSet *gitopsv1.ApplicationSet, merge *gitopsv1.MergeGenerator) ([]generatorParams, error) {
+	if len(merge.Generators) < 2 || len(merge.MergeKeys) == 0 {
+		return nil, fmt.Errorf("merge generator needs at least 2 generators and one merge key")
+	}
+	var generated [][]generatorParams
+	for _, generator := range merge.Generators {
+		params, err := r.generateBase(ctx, appSet, generator)
+		if err != nil {
+			return nil, err
+		}
+		generated = append(generated, params)
+	}
+	return mergeParams(merge.MergeKeys, generated[0], generated[1:]...), nil
+}
+
+func mergeParams(mergeKeys []string, base []generatorParams, overrides ...[]generatorParams) []generatorParams {
+	merged := make([]generatorParams, 0, len(base))
+	for _, params := range base {
+		merged = append(merged, copyParams(params))
+	}
+	for _, override := range overrides {
+		for _, params := range merged {
+			for _, overrideParams := range override {
+				if !sameMergeKeys(mergeKeys, params, overrideParams) {
+					continue
+				}
+				for key, value := range overrideParams {
+					params[key] = value
+				}
+			}
+		}
+	}
+	return merged
+}
+
+func sameMergeKeys(mergeKeys []string, a, b generatorParams) bool {
+	for _, key := range mergeKeys {
+		aValue, aOK := a[key]
+		bValue, bOK := b[key]
+		if !aOK || !bOK || aValue != bValue {
+			return false
+		}
+	}
+	return true
+}
+
+func copyParams(params map[string]string) generatorParams {
+	copied := make(generatorParams, len(params))
+	for key, value := range params {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Renders the template of an ApplicationSet with a set of parameters. Referencing a parameter
+// that was not generated is an error
+func renderApplication(appSet *gitopsv1.ApplicationSet, params generatorParams) (*gitopsv1.Application, error) {
+	tmpl, err := json.Marshal(appSet.Spec.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+	rendered := templateParamPattern.ReplaceAllStringFunc(string(tmpl), func(ref string) string {
+		key := templateParamPattern.FindStringSubmatch(ref)[1]
+		value, ok := params[key]
+		if !ok {
+			unknown = append(unknown, key)
+			return ref
+		}
+		// the value is substituted into a JSON string
+		escaped, _ := json.Marshal(value)
+		return string(escaped[1 : len(escaped)-1])
+	})
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("template references unknown parameters %s", strings.Join(unknown, ", "))
+	}
+
+	var template gitopsv1.ApplicationSetTemplate
+	if err := json.Unmarshal([]byte(rendered), &template); err != nil {
+		return nil, fmt.Errorf("could not parse rendered template: %w", err)
+	}
+	if template.Metadata.Name == "" {
+		return nil, fmt.Errorf("rendered template has no name")
+	}
+
+	return &gitopsv1.Application{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        template.Metadata.Name,
+			Namespace:   appSet.Namespace,
+			Labels:      template.Metadata.Labels,
+			Annotations: template.Metadata.Annotations,
+		},
+		Spec: template.Spec,
+	}, nil
+}
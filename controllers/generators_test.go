@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestMatchDirectories(t *testing.T) {
+	repo := map[string][]string{
+		"":     {"apps", "infra"},
+		"apps": {"apps/api", "apps/web", "apps/experimental"},
+	}
+	var listed []string
+	list := func(dirPath string) ([]string, error) {
+		listed = append(listed, dirPath)
+		return repo[dirPath], nil
+	}
+
+	dirs, err := matchDirectories([]gitopsv1.GitDirectoryGeneratorItem{
+		{Path: "apps/*"},
+		{Path: "/apps/experimental", Exclude: true},
+		{Path: "infra"},
+		{Path: "apps/w*"},
+	}, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"apps/api", "apps/web", "infra"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("expected %v, got %v", want, dirs)
+	}
+	if want := []string{"apps"}; !reflect.DeepEqual(listed, want) {
+		t.Errorf("expected each directory to be listed once, got %v", listed)
+	}
+
+	if _, err := matchDirectories([]gitopsv1.GitDirectoryGeneratorItem{{Path: "*/overlays"}}, list); err == nil {
+		t.Error("expected an error for a glob in a parent directory")
+	}
+}
+
+func TestCombineParams(t *testing.T) {
+	combined, err := combineParams(
+		[]generatorParams{{"cluster": "dev"}, {"cluster": "prod"}},
+		[]generatorParams{{"app": "api"}, {"app": "web"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []generatorParams{
+		{"cluster": "dev", "app": "api"},
+		{"cluster": "dev", "app": "web"},
+		{"cluster": "prod", "app": "api"},
+		{"cluster": "prod", "app": "web"},
+	}
+	if !reflect.DeepEqual(combined, want) {
+		t.Errorf("expected %v, got %v", want, combined)
+	}
+
+	if _, err := combineParams([]generatorParams{{"name": "a"}}, []generatorParams{{"name": "b"}}); err == nil {
+		t.Error("expected an error for conflicting parameters")
+	}
+}
+
+func TestMergeParams(t *testing.T) {
+	base := []generatorParams{
+		{"name": "dev", "replicas": "1"},
+		{"name": "prod", "replicas": "1"},
+	}
+	merged := mergeParams([]string{"name"}, base,
+		[]generatorParams{{"name": "prod", "replicas": "3"}, {"name": "staging", "replicas": "2"}},
+	)
+	want := []generatorParams{
+		{"name": "dev", "replicas": "1"},
+		{"name": "prod", "replicas": "3"},
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("expected %v, got %v", want, merged)
+	}
+	if base[1]["replicas"] != "1" {
+		t.Error("expected the base parameters to be left unchanged")
+	}
+}
+
+func TestRenderApplication(t *testing.T) {
+	appSet := &gitopsv1.ApplicationSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "apps", Namespace: "gitops"},
+		Spec: gitopsv1.ApplicationSetSpec{
+			Template: gitopsv1.ApplicationSetTemplate{
+				Metadata: gitopsv1.ApplicationSetTemplateMeta{
+					Name:   "{{ path.basenameNormalized }}",
+					Labels: map[string]string{"team": "{{team}}"},
+				},
+				Spec: gitopsv1.ApplicationSpec{
+					Source: gitopsv1.ApplicationSource{
+						RepoURL: "https://github.com/org/repo",
+						Path:    "{{path}}/overlays",
+					},
+					Destination: gitopsv1.ApplicationDestination{Namespace: "{{path.basename}}"},
+				},
+			},
+		},
+	}
+
+	app, err := renderApplication(appSet, generatorParams{
+		"path":                    "apps/My_App",
+		"path.basename":           "My_App",
+		"path.basenameNormalized": "my-app",
+		"team":                    `a "quoted" team`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Name != "my-app" || app.Namespace != "gitops" {
+		t.Errorf("unexpected application %s/%s", app.Namespace, app.Name)
+	}
+	if app.Spec.Source.Path != "apps/My_App/overlays" || app.Spec.Destination.Namespace != "My_App" {
+		t.Errorf("unexpected spec %+v", app.Spec)
+	}
+	if app.Labels["team"] != `a "quoted" team` {
+		t.Errorf("expected parameters to be escaped, got %q", app.Labels["team"])
+	}
+
+	if _, err := renderApplication(appSet, generatorParams{"path": "apps/api"}); err == nil {
+		t.Error("expected an error for unknown parameters")
+	}
+}
+
+func TestGenerateClusters(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+
+	cluster := func(name, namespace, env string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{
+				gitopsv1.ClusterSecretTypeLabel: gitopsv1.ClusterSecretType,
+				"env":                           env,
+			}},
+			Data: map[string][]byte{"name": []byte(name), "server": []byte(gitopsv1.InClusterServer)},
+		}
+	}
+	r := &ApplicationSetReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		cluster("dev", "gitops", "dev"),
+		cluster("prod", "gitops", "prod"),
+		cluster("elsewhere", "other", "prod"),
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "not-a-cluster", Namespace: "gitops"}},
+	).Build()}
+	appSet := &gitopsv1.ApplicationSet{ObjectMeta: metav1.ObjectMeta{Name: "apps", Namespace: "gitops"}}
+
+	params, err := r.generateClusters(context.Background(), appSet, &gitopsv1.ClusterGenerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 3 || params[0]["name"] != gitopsv1.InClusterName {
+		t.Errorf("expected in-cluster and the two clusters of the namespace, got %v", params)
+	}
+
+	params, err = r.generateClusters(context.Background(), appSet, &gitopsv1.ClusterGenerator{
+		Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "prod"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []generatorParams{{
+		"name":                "prod",
+		"server":              gitopsv1.InClusterServer,
+		"metadata.labels.env": "prod",
+		"metadata.labels." + gitopsv1.ClusterSecretTypeLabel: gitopsv1.ClusterSecretType,
+	}}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("expected %v, got %v", want, params)
+	}
+
+	// applications can't be deployed to other clusters
+	remote := cluster("remote", "gitops", "prod")
+	remote.Data["server"] = []byte("https://remote.example.com")
+	r.Client = fake.NewClientBuilder().WithScheme(scheme).WithObjects(remote).Build()
+	if _, err := r.generateClusters(context.Background(), appSet, &gitopsv1.ClusterGenerator{}); err == nil || !strings.Contains(err.Error(), "https://remote.example.com") {
+		t.Errorf("expected an error for the remote cluster, got %v", err)
+	}
+}
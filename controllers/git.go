@@ -1,9 +1,16 @@
 package controllers
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"path"
 	"strings"
 
 	"github.com/google/go-github/v48/github"
@@ -13,33 +20,90 @@ import (
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
+// FetchMode determines how manifests are fetched from a github repository
+type FetchMode string
+
+const (
+	// Download every file with a separate request to the contents API
+	FetchModeContents FetchMode = "contents"
+
+	// Download the whole repository at the target revision as a single tarball
+	FetchModeArchive FetchMode = "archive"
+)
+
 type AppStateManager struct {
-	client *github.Client
+	client    *github.Client
+	fetchMode FetchMode
+
+	// identifies the rate limit quota used by the client
+	credential string
 }
 
-func getGithubClient(ctx context.Context, accessToken string) *github.Client {
+// Creates a github client for the access token. If responseCache is not nil, responses are
+// cached and revalidated with conditional requests
+func getGithubClient(ctx context.Context, accessToken string, responseCache *GithubResponseCache) *github.Client {
+	credential := credentialID(accessToken)
+
+	var tc *http.Client
 	if accessToken == "" {
-		return github.NewClient(nil)
+		tc = &http.Client{Transport: http.DefaultTransport}
+	} else {
+		ts := oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: accessToken},
+		)
+		tc = oauth2.NewClient(ctx, ts)
 	}
 
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: accessToken},
-	)
-	tc := oauth2.NewClient(ctx, ts)
+	tc.Transport = &rateLimitTransport{credential: credential, base: tc.Transport}
+	if responseCache != nil {
+		tc.Transport = &conditionalRequestTransport{credential: credential, cache: responseCache, base: tc.Transport}
+	}
 
 	return github.NewClient(tc)
 
 }
 
-func NewAppStateManager(accessToken string) *AppStateManager {
-	return &AppStateManager{client: getGithubClient(context.Background(), accessToken)}
+func NewAppStateManager(accessToken string, fetchMode FetchMode, responseCache *GithubResponseCache) *AppStateManager {
+	return &AppStateManager{
+		client:     getGithubClient(context.Background(), accessToken, responseCache),
+		fetchMode:  fetchMode,
+		credential: credentialID(accessToken),
+	}
+}
+
+// Resolves the target revision of an app source to a commit SHA.
+// The last synced SHA is sent along so that github can answer with a (cheap) 304 if the revision has not moved
+func (a *AppStateManager) resolveRevision(ctx context.Context, source gitopsv1.ApplicationSource, lastSHA string) (string, error) {
+	repoOwner, repoName := getRepoOwnerAndNameFromSourceURL(source.RepoURL)
+
+	targetRevision := source.TargetRevision
+	if targetRevision == "" {
+		targetRevision = gitopsv1.DefaultTargetRevision
+	}
+
+	sha, resp, err := a.client.Repositories.GetCommitSHA1(ctx, repoOwner, repoName, targetRevision, lastSHA)
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		return lastSHA, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return sha, nil
+}
+
+// Gets unstructured objects from git repo at the given revision
+func (a *AppStateManager) getRepoObjs(ctx context.Context, source gitopsv1.ApplicationSource, revision string) ([]*unstructured.Unstructured, error) {
+	if a.fetchMode == FetchModeArchive {
+		return a.getRepoObjsFromArchive(ctx, source, revision)
+	}
+	return a.getRepoObjsFromContents(ctx, source, revision)
 }
 
-// Gets unstructured objects from git repo
-func (a *AppStateManager) getRepoObjs(ctx context.Context, app *gitopsv1.Application) ([]*unstructured.Unstructured, error) {
+// Gets unstructured objects by downloading each file under the source path with the contents API
+func (a *AppStateManager) getRepoObjsFromContents(ctx context.Context, source gitopsv1.ApplicationSource, revision string) ([]*unstructured.Unstructured, error) {
 
-	// get repo information from app source
-	repoOwner, repoName := getRepoOwnerAndNameFromSourceURL(app.Spec.Source.RepoURL)
+	// get repo information from source
+	repoOwner, repoName := getRepoOwnerAndNameFromSourceURL(source.RepoURL)
 
 	var targetObjs []*unstructured.Unstructured
 
@@ -47,8 +111,8 @@ func (a *AppStateManager) getRepoObjs(ctx context.Context, app *gitopsv1.Applica
 		ctx,
 		repoOwner,
 		repoName,
-		app.Spec.Source.Path,
-		&github.RepositoryContentGetOptions{Ref: app.Spec.Source.TargetRevision})
+		source.Path,
+		&github.RepositoryContentGetOptions{Ref: revision})
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +124,7 @@ func (a *AppStateManager) getRepoObjs(ctx context.Context, app *gitopsv1.Applica
 			return nil, err
 		}
 
-		objs, err := getResourcesFromYAMLOrJSON(strings.NewReader(content))
+		objs, err := getResourcesFromYAMLOrJSON(strings.NewReader(content), source.Path)
 		if err != nil {
 			return nil, err
 		}
@@ -72,17 +136,20 @@ func (a *AppStateManager) getRepoObjs(ctx context.Context, app *gitopsv1.Applica
 
 	if directoryContent != nil {
 		for _, fileContent := range directoryContent {
+			if !isManifestFile(fileContent.GetPath()) {
+				continue
+			}
 			downloadedFile, _, err := a.client.Repositories.DownloadContents(
 				ctx,
 				repoOwner,
 				repoName,
 				*fileContent.Path,
-				&github.RepositoryContentGetOptions{Ref: app.Spec.Source.TargetRevision})
+				&github.RepositoryContentGetOptions{Ref: revision})
 			if err != nil {
 				return nil, err
 			}
 
-			objs, err := getResourcesFromYAMLOrJSON(downloadedFile)
+			objs, err := getResourcesFromYAMLOrJSON(downloadedFile, fileContent.GetPath())
 			if err != nil {
 				return nil, err
 			}
@@ -96,6 +163,169 @@ func (a *AppStateManager) getRepoObjs(ctx context.Context, app *gitopsv1.Applica
 
 }
 
+// Gets unstructured objects by downloading a tarball of the whole repository.
+// This takes a single API request regardless of the number of files and is not subject to the contents API directory limits
+func (a *AppStateManager) getRepoObjsFromArchive(ctx context.Context, source gitopsv1.ApplicationSource, revision string) ([]*unstructured.Unstructured, error) {
+	repoOwner, repoName := getRepoOwnerAndNameFromSourceURL(source.RepoURL)
+
+	archiveURL, _, err := a.client.Repositories.GetArchiveLink(
+		ctx,
+		repoOwner,
+		repoName,
+		github.Tarball,
+		&github.RepositoryContentGetOptions{Ref: revision},
+		true)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, archiveURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download repository archive: %s", resp.Status)
+	}
+
+	return getResourcesFromTarball(resp.Body, source.Path)
+}
+
+// Reads the manifests at sourcePath from a gzipped tarball of a github repository.
+// Like with the contents API, sourcePath can point to a single file or to a directory,
+// in which case only the YAML and JSON files directly within that directory are read
+func getResourcesFromTarball(r io.Reader, sourcePath string) ([]*unstructured.Unstructured, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	// github archives have a single top level directory named after the repo and commit
+	targetObjs, found, err := getResourcesFromTar(tar.NewReader(gz), sourcePath, true)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("path %s not found in repository archive", sourcePath)
+	}
+	return targetObjs, nil
+}
+
+// Reads the manifests at sourcePath from a tar archive and reports whether sourcePath exists in the archive
+func getResourcesFromTar(tr *tar.Reader, sourcePath string, stripTopLevelDir bool) ([]*unstructured.Unstructured, bool, error) {
+	sourcePath = strings.Trim(path.Clean("/"+sourcePath), "/")
+	sourceDir := sourcePath
+	if sourceDir == "" {
+		sourceDir = "."
+	}
+
+	var targetObjs []*unstructured.Unstructured
+	found := sourcePath == ""
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		name := header.Name
+		if stripTopLevelDir {
+			_, name, _ = strings.Cut(name, "/")
+		}
+		name = strings.Trim(path.Clean("/"+name), "/")
+
+		if header.Typeflag == tar.TypeDir && name == sourcePath {
+			found = true
+		}
+		if header.Typeflag != tar.TypeReg || (name != sourcePath && path.Dir(name) != sourceDir) {
+			continue
+		}
+		found = true
+		if name != sourcePath && !isManifestFile(name) {
+			continue
+		}
+
+		objs, err := getResourcesFromYAMLOrJSON(tr, name)
+		if err != nil {
+			return nil, false, err
+		}
+		targetObjs = append(targetObjs, objs...)
+	}
+	return targetObjs, found, nil
+}
+
+// Files in a directory are only read if they are YAML or JSON, so that e.g. a README next to the manifests is ignored
+func isManifestFile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// Lists the paths of the directories directly within dirPath of a repository at the given revision
+func (a *AppStateManager) listDirectories(ctx context.Context, repoURL, revision, dirPath string) ([]string, error) {
+	repoOwner, repoName := getRepoOwnerAndNameFromSourceURL(repoURL)
+
+	_, directoryContent, _, err := a.client.Repositories.GetContents(
+		ctx,
+		repoOwner,
+		repoName,
+		dirPath,
+		&github.RepositoryContentGetOptions{Ref: revision})
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, content := range directoryContent {
+		if content.GetType() == "dir" {
+			dirs = append(dirs, content.GetPath())
+		}
+	}
+	return dirs, nil
+}
+
+// Lists the names of all tags of a repository
+func (a *AppStateManager) listTags(ctx context.Context, source gitopsv1.ApplicationSource) ([]string, error) {
+	repoOwner, repoName := getRepoOwnerAndNameFromSourceURL(source.RepoURL)
+
+	var names []string
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		tags, resp, err := a.client.Repositories.ListTags(ctx, repoOwner, repoName, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			names = append(names, tag.GetName())
+		}
+		if resp.NextPage == 0 {
+			return names, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// Returns the signature of a commit as reported by github and the commit object it signs
+func (a *AppStateManager) getCommitSignature(ctx context.Context, source gitopsv1.ApplicationSource, sha string) (string, string, error) {
+	repoOwner, repoName := getRepoOwnerAndNameFromSourceURL(source.RepoURL)
+
+	commit, _, err := a.client.Git.GetCommit(ctx, repoOwner, repoName, sha)
+	if err != nil {
+		return "", "", err
+	}
+	verification := commit.GetVerification()
+	return verification.GetSignature(), verification.GetPayload(), nil
+}
+
 func getRepoOwnerAndNameFromSourceURL(url string) (repoOwner, repoName string) {
 	res := strings.Split(url, "github.com/")[1]
 	repoOwner = strings.Split(res, "/")[0]
@@ -104,20 +334,109 @@ func getRepoOwnerAndNameFromSourceURL(url string) (repoOwner, repoName string) {
 
 }
 
-func getResourcesFromYAMLOrJSON(f io.Reader) ([]*unstructured.Unstructured, error) {
-
-	decoder := yaml.NewYAMLOrJSONDecoder(f, 1024)
+// Reads the objects of a manifest file, which holds YAML documents or JSON objects. Empty documents are
+// skipped and every object must have an apiVersion and kind. The file and line of each object are recorded
+// in its origin annotation, SOPS-encrypted objects also record the encrypted file and objects referencing
+// variables the text of their document
+func getResourcesFromYAMLOrJSON(f io.Reader, fileName string) ([]*unstructured.Unstructured, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := splitManifestDocuments(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
 
 	var objs []*unstructured.Unstructured
-	for {
-		var v unstructured.Unstructured
-		if err := decoder.Decode(&v); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
+	for _, document := range documents {
+		obj, err := decodeManifestDocument(document.content)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fileName, document.line, err)
 		}
-		objs = append(objs, &v)
+		if obj == nil {
+			continue
+		}
+		setOrigin(obj, fileName, document.line)
+		setSOPSFile(obj, data, len(objs))
+		setSubstituteDocument(obj, document.content)
+		objs = append(objs, obj)
 	}
 	return objs, nil
 }
+
+// A YAML document or JSON object of a manifest file and the line it starts at
+type manifestDocument struct {
+	line    int
+	content []byte
+}
+
+// Splits a manifest file into its YAML documents, or into its JSON objects if it starts with one
+func splitManifestDocuments(data []byte) ([]manifestDocument, error) {
+	if isJSONManifest(data) {
+		var documents []manifestDocument
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			// the object starts after the whitespace following the previous one
+			rest := data[decoder.InputOffset():]
+			start := len(data) - len(bytes.TrimLeft(rest, " \t\r\n"))
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err == io.EOF {
+				return documents, nil
+			} else if err != nil {
+				return nil, err
+			}
+			documents = append(documents, manifestDocument{line: 1 + bytes.Count(data[:start], []byte("\n")), content: raw})
+		}
+	}
+
+	var documents []manifestDocument
+	document := manifestDocument{line: 1}
+	for i, line := range bytes.SplitAfter(data, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		switch {
+		case bytes.HasPrefix(line, []byte("---")) && len(bytes.TrimSpace(line[3:])) == 0:
+			documents = append(documents, document)
+			document = manifestDocument{line: i + 2}
+		case len(document.content) == 0 && (len(trimmed) == 0 || trimmed[0] == '#'):
+			// a document starts at its first line with content
+			document.line = i + 2
+		default:
+			document.content = append(document.content, line...)
+		}
+	}
+	return append(documents, document), nil
+}
+
+func isJSONManifest(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("{"))
+}
+
+// Decodes a YAML document or JSON object. Returns nil for empty documents
+func decodeManifestDocument(content []byte) (*unstructured.Unstructured, error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, nil
+	}
+	data, err := yaml.ToJSON(content)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+	var typeMeta struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+	}
+	if err := json.Unmarshal(data, &typeMeta); err != nil {
+		return nil, fmt.Errorf("not a kubernetes object: %w", err)
+	}
+	if typeMeta.APIVersion == "" || typeMeta.Kind == "" {
+		return nil, fmt.Errorf("apiVersion and kind must be set")
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
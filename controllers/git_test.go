@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Builds a gzipped tarball of the files below the root directory (e.g. org-repo-abc123/ like github archives)
+func newTarball(t *testing.T, root string, files map[string]string) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	write := func(header *tar.Header, content string) {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if root != "" {
+		write(&tar.Header{Name: root, Typeflag: tar.TypeDir, Mode: 0o755}, "")
+	}
+	for name, content := range files {
+		write(&tar.Header{Name: root + name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}, content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestGetResourcesFromTarball(t *testing.T) {
+	files := map[string]string{
+		"manifests/cm.yaml":        "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n",
+		"manifests/nested/cm.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: nested\n",
+		"manifests/cm.json":        `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "json"}}`,
+		"manifests/README.md":      "# Manifests\n",
+		"other/cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: other\n",
+	}
+
+	tests := []struct {
+		path  string
+		names []string
+	}{
+		{path: "manifests", names: []string{"a", "b", "json"}},
+		{path: "./manifests/", names: []string{"a", "b", "json"}},
+		{path: "other/cm.yaml", names: []string{"other"}},
+	}
+	for _, tt := range tests {
+		objs, err := getResourcesFromTarball(newTarball(t, "org-repo-abc123/", files), tt.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		var names []string
+		for _, obj := range objs {
+			names = append(names, obj.GetName())
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+			t.Errorf("%s: expected %v, got %v", tt.path, tt.names, names)
+		}
+	}
+
+	if _, err := getResourcesFromTarball(newTarball(t, "org-repo-abc123/", files), "missing"); err == nil {
+		t.Errorf("expected error for missing path")
+	}
+}
+
+func TestGetResourcesFromYAMLOrJSON(t *testing.T) {
+	manifests := "# config maps\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\n---\n# empty\n\n---\n\n# b\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n  annotations:\n    team: web\n"
+	objs, err := getResourcesFromYAMLOrJSON(strings.NewReader(manifests), "manifests/cm.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 2 {
+		t.Fatalf("expected empty documents to be skipped, got %d objects", len(objs))
+	}
+	for i, want := range []string{"manifests/cm.yaml:3", "manifests/cm.yaml:14"} {
+		if origin := popOrigin(objs[i]); origin != want {
+			t.Errorf("%s: expected origin %s, got %s", objs[i].GetName(), want, origin)
+		}
+	}
+	if annotations := objs[0].GetAnnotations(); annotations != nil {
+		t.Errorf("expected the origin annotation to be removed, got %v", annotations)
+	}
+	if annotations := objs[1].GetAnnotations(); len(annotations) != 1 || annotations["team"] != "web" {
+		t.Errorf("expected other annotations to be kept, got %v", annotations)
+	}
+
+	objs, err = getResourcesFromYAMLOrJSON(strings.NewReader("{\"apiVersion\": \"v1\", \"kind\": \"ConfigMap\", \"metadata\": {\"name\": \"a\"}}\n\n{\"apiVersion\": \"v1\",\n \"kind\": \"ConfigMap\", \"metadata\": {\"name\": \"b\"}}"), "cm.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 2 || popOrigin(objs[1]) != "cm.json:3" {
+		t.Errorf("expected two JSON objects, got %v", objs)
+	}
+
+	for name, tc := range map[string]struct {
+		manifests string
+		err       string
+	}{
+		"missing kind":       {manifests: "apiVersion: v1\nkind: ConfigMap\n---\napiVersion: v1\nmetadata:\n  name: a\n", err: "cm.yaml:4: apiVersion and kind must be set"},
+		"missing apiVersion": {manifests: "kind: ConfigMap\nmetadata:\n  name: a\n", err: "cm.yaml:1: apiVersion and kind must be set"},
+		"not an object":      {manifests: "- a\n- b\n", err: "cm.yaml:1: not a kubernetes object"},
+		"invalid yaml":       {manifests: "apiVersion: v1\nkind: [\n", err: "cm.yaml:1:"},
+	} {
+		_, err := getResourcesFromYAMLOrJSON(strings.NewReader(tc.manifests), "cm.yaml")
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("%s: expected error %q, got %v", name, tc.err, err)
+		}
+	}
+}
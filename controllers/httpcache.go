@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"sync"
+)
+
+type cachedResponse struct {
+	key    string
+	header http.Header
+	body   []byte
+}
+
+// GithubResponseCache is a size bounded LRU cache of github responses that carry an ETag or Last-Modified header.
+// Cached responses are revalidated with conditional requests, which do not count against the github rate limit
+// when answered with a 304. Entries are keyed by credential so responses are only shared between Applications
+// that use the same credential.
+type GithubResponseCache struct {
+	mu sync.Mutex
+
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+// NewGithubResponseCache creates a cache holding at most maxBytes of response bodies
+func NewGithubResponseCache(maxBytes int64) *GithubResponseCache {
+	return &GithubResponseCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *GithubResponseCache) get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedResponse), true
+}
+
+func (c *GithubResponseCache) add(entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	if int64(len(entry.body)) > c.maxBytes {
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.body))
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Must be called with the lock held
+func (c *GithubResponseCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cachedResponse)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+}
+
+// conditionalRequestTransport revalidates cached github responses with If-None-Match and If-Modified-Since
+// headers and serves the cached response if github answers with a 304
+type conditionalRequestTransport struct {
+	credential string
+	cache      *GithubResponseCache
+	base       http.RoundTripper
+}
+
+func (t *conditionalRequestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// requests that are already conditional (e.g. resolving a commit SHA) are handled by the caller
+	if req.Method != http.MethodGet || req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// the same URL returns different representations depending on the requested media type
+	key := t.credential + " " + req.Header.Get("Accept") + " " + req.URL.String()
+	cached, ok := t.cache.get(key)
+	if ok {
+		req = req.Clone(req.Context())
+		if etag := cached.header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok && resp.StatusCode == http.StatusNotModified {
+		githubResponseCacheRequestsTotal.WithLabelValues("hit").Inc()
+		resp.Body.Close()
+
+		header := cached.header.Clone()
+		// tells go-github not to update its rate limit information from this response
+		header.Set("X-From-Cache", "1")
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(cached.body)),
+			ContentLength: int64(len(cached.body)),
+			Request:       req,
+		}, nil
+	}
+	githubResponseCacheRequestsTotal.WithLabelValues("miss").Inc()
+
+	if resp.StatusCode != http.StatusOK || (resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "") {
+		return resp, nil
+	}
+	if resp.ContentLength > t.cache.maxBytes {
+		return resp, nil
+	}
+
+	// responses without a content length are only read up to the size of the cache
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.cache.maxBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > t.cache.maxBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	t.cache.add(&cachedResponse{key: key, header: resp.Header.Clone(), body: body})
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
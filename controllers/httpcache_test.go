@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConditionalRequestTransport(t *testing.T) {
+	var requests, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	cache := NewGithubResponseCache(1 << 20)
+	newClient := func(credential string) *http.Client {
+		return &http.Client{Transport: &conditionalRequestTransport{credential: credential, cache: cache, base: http.DefaultTransport}}
+	}
+
+	get := func(c *http.Client) string {
+		resp, err := c.Get(server.URL + "/repos/org/repo/contents/app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	// a client with the same credential shares the cache
+	for _, c := range []*http.Client{newClient("token-a"), newClient("token-a")} {
+		if body := get(c); body != "content" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+	if requests != 2 || notModified != 1 {
+		t.Fatalf("expected the second request to be revalidated, got %d requests and %d not modified", requests, notModified)
+	}
+
+	// a different credential does not
+	get(newClient("token-b"))
+	if notModified != 1 {
+		t.Fatalf("expected cached response not to be shared between credentials")
+	}
+}
+
+func TestConditionalRequestTransportSkipsLargeChunkedResponses(t *testing.T) {
+	content := strings.Repeat("x", 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		// flushing before the end of the body makes the response chunked, without a content length
+		_, _ = w.Write([]byte(content[:10]))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte(content[10:]))
+	}))
+	defer server.Close()
+
+	cache := NewGithubResponseCache(100)
+	c := &http.Client{Transport: &conditionalRequestTransport{credential: "token-a", cache: cache, base: http.DefaultTransport}}
+	resp, err := c.Get(server.URL + "/repos/org/repo/tarball/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != -1 {
+		t.Fatalf("expected a chunked response, got content length %d", resp.ContentLength)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != content {
+		t.Errorf("expected the whole body, got %d bytes", len(body))
+	}
+	if len(cache.entries) != 0 {
+		t.Errorf("expected the response not to be cached")
+	}
+}
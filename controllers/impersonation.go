@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+// impersonatingClients builds and caches clients impersonating service accounts
+type impersonatingClients struct {
+	mu      sync.Mutex
+	clients map[string]client.Client
+}
+
+// Returns the client used for all requests on the resources managed by an application. If the application
+// sets a service account, or a default one is configured, the client impersonates it, so the application
+// is limited to the account's RBAC
+func (r *ApplicationReconciler) resourceClient(app *gitopsv1.Application) (client.Client, error) {
+	serviceAccountName := r.serviceAccountName(app)
+	if serviceAccountName == "" {
+		return r.Client, nil
+	}
+	if r.Config == nil {
+		return nil, fmt.Errorf("service account %s can't be impersonated without a rest config", serviceAccountName)
+	}
+
+	username := fmt.Sprintf("system:serviceaccount:%s:%s", app.Namespace, serviceAccountName)
+
+	r.impersonatingClients.mu.Lock()
+	defer r.impersonatingClients.mu.Unlock()
+	if c, ok := r.impersonatingClients.clients[username]; ok {
+		return c, nil
+	}
+
+	config := rest.CopyConfig(r.Config)
+	config.Impersonate = rest.ImpersonationConfig{UserName: username}
+	// the service account may not be allowed to list and watch, so objects are read from the API server directly
+	c, err := client.New(config, client.Options{Scheme: r.Scheme, Mapper: r.RESTMapper()})
+	if err != nil {
+		return nil, fmt.Errorf("could not create client impersonating %s: %w", username, err)
+	}
+	if r.impersonatingClients.clients == nil {
+		r.impersonatingClients.clients = make(map[string]client.Client)
+	}
+	r.impersonatingClients.clients[username] = c
+	return c, nil
+}
+
+// Returns the service account impersonated for an application, or an empty string if the controller's own client is used
+func (r *ApplicationReconciler) serviceAccountName(app *gitopsv1.Application) string {
+	if app.Spec.ServiceAccountName != "" {
+		return app.Spec.ServiceAccountName
+	}
+	return r.DefaultServiceAccountName
+}
+
+// Returns the reader used to search for the objects tracked by an application. It is limited to the RBAC of the
+// impersonated service account like the resource client. The controller's cached client is not used, as it would
+// start informers for all kinds searched
+func (r *ApplicationReconciler) resourceReader(app *gitopsv1.Application) (client.Reader, error) {
+	if r.serviceAccountName(app) == "" {
+		return r.APIReader, nil
+	}
+	return r.resourceClient(app)
+}
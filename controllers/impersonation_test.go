@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestResourceClient(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	r := &ApplicationReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).Build(),
+		Scheme: scheme,
+		Config: &rest.Config{Host: "https://127.0.0.1:6443"},
+	}
+
+	app := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}}
+	if c, err := r.resourceClient(app); err != nil || c != r.Client {
+		t.Fatalf("expected the controller's client without a service account, got %v", err)
+	}
+
+	app.Spec.ServiceAccountName = "deployer"
+	c, err := r.resourceClient(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == r.Client {
+		t.Fatal("expected an impersonating client")
+	}
+	if again, _ := r.resourceClient(app); again != c {
+		t.Error("expected the impersonating client to be reused")
+	}
+	if _, ok := r.impersonatingClients.clients["system:serviceaccount:team-a:deployer"]; !ok {
+		t.Errorf("expected a client impersonating the service account, got %v", r.impersonatingClients.clients)
+	}
+	if r.Config.Impersonate.UserName != "" {
+		t.Error("the controller's rest config must not be modified")
+	}
+
+	// tracked objects are searched with the impersonating client as well
+	if reader, err := r.resourceReader(app); err != nil || reader != c {
+		t.Errorf("expected the impersonating client to search tracked objects, got %v", err)
+	}
+
+	// applications without a service account impersonate the default one if configured
+	r.DefaultServiceAccountName = "default"
+	app.Spec.ServiceAccountName = ""
+	if _, err := r.resourceClient(app); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.impersonatingClients.clients["system:serviceaccount:team-a:default"]; !ok {
+		t.Errorf("expected a client impersonating the default service account, got %v", r.impersonatingClients.clients)
+	}
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	syncTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitops_application_sync_total",
+			Help: "Number of times an application was synced with its git repository",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	syncSkippedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitops_application_sync_skipped_total",
+			Help: "Number of syncs skipped because the target revision was unchanged and no drift was detected",
+		},
+		[]string{"namespace", "name"},
+	)
+
+	manifestCacheRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitops_manifest_cache_requests_total",
+			Help: "Number of manifest cache lookups partitioned by result (hit or miss)",
+		},
+		[]string{"result"},
+	)
+
+	githubResponseCacheRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitops_github_response_cache_requests_total",
+			Help: "Number of cacheable github requests partitioned by result (hit if revalidated with a 304 or miss)",
+		},
+		[]string{"result"},
+	)
+
+	githubRateLimitRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gitops_github_rate_limit_remaining",
+			Help: "Number of github API requests remaining in the current rate limit window per credential",
+		},
+		[]string{"credential"},
+	)
+)
+
+func init() {
+	// register with the controller-runtime registry so metrics are served on the manager's metrics endpoint
+	metrics.Registry.MustRegister(
+		syncTotal,
+		syncSkippedTotal,
+		manifestCacheRequestsTotal,
+		githubResponseCacheRequestsTotal,
+		githubRateLimitRemaining,
+	)
+}
@@ -0,0 +1,461 @@
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	ociIndexMediaType       = "application/vnd.oci.image.index.v1+json"
+	dockerListMediaType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// file name of layers that were pushed as single files, e.g. with oras
+	ociTitleAnnotation = "org.opencontainers.image.title"
+
+	// tag of OCI sources without tag, digest or target revision
+	defaultOCITag = "latest"
+
+	// manifests are small, this only protects against misbehaving registries
+	maxOCIManifestSize = 4 << 20
+
+	// layers are held in memory while they are extracted, like bundles
+	maxOCIBlobSize = maxBundleSize
+)
+
+var (
+	sha256DigestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	ociChallengePattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+func isOCISource(repoURL string) bool {
+	return strings.HasPrefix(repoURL, gitopsv1.OCISourcePrefix)
+}
+
+// Reference of an OCI artifact, e.g. oci://registry.example.com/manifests/app:v1
+type ociReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+func parseOCIReference(repoURL string) (ociReference, error) {
+	var ref ociReference
+	registry, repository, ok := strings.Cut(strings.TrimPrefix(repoURL, gitopsv1.OCISourcePrefix), "/")
+	if !ok || registry == "" || repository == "" {
+		return ref, fmt.Errorf("invalid OCI reference %s, expected oci://<registry>/<repository>[:<tag>|@<digest>]", repoURL)
+	}
+	ref.registry = registry
+	if repository, ref.digest, ok = strings.Cut(repository, "@"); ok && !sha256DigestPattern.MatchString(ref.digest) {
+		return ref, fmt.Errorf("invalid digest %s, only sha256 digests are supported", ref.digest)
+	}
+	if i := strings.LastIndex(repository, ":"); i >= 0 {
+		repository, ref.tag = repository[:i], repository[i+1:]
+	}
+	ref.repository = repository
+	return ref, nil
+}
+
+// Manifest of an OCI artifact or a docker image
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Pulls manifests from OCI artifacts in registries implementing the OCI distribution API.
+// The revision of an OCI source is the digest of the artifact's manifest
+type ociClient struct {
+	httpClient *http.Client
+
+	username string
+	password string
+	token    string
+
+	// authorization obtained from the registry, reused for all requests of the client
+	authorization string
+}
+
+func newOCIClient(repoSecret *corev1.Secret, httpClient *http.Client) *ociClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	c := &ociClient{httpClient: httpClient}
+	if repoSecret != nil {
+		c.username = string(repoSecret.Data[gitopsv1.RepoSecretUsernameKey])
+		c.password = string(repoSecret.Data[gitopsv1.RepoSecretPasswordKey])
+		c.token = string(repoSecret.Data[apiTokenSecretKey])
+	}
+	if c.token != "" {
+		c.authorization = "Bearer " + c.token
+	}
+	return c
+}
+
+// Resolves the tag of an OCI source to the digest of its manifest. References with a digest are already resolved
+func (c *ociClient) resolveRevision(ctx context.Context, source gitopsv1.ApplicationSource, lastRevision string) (string, error) {
+	ref, err := parseOCIReference(source.RepoURL)
+	if err != nil {
+		return "", err
+	}
+	if ref.digest != "" {
+		return ref.digest, nil
+	}
+
+	tag := ref.tag
+	if tag == "" {
+		tag = source.TargetRevision
+	}
+	if tag == "" || tag == gitopsv1.DefaultTargetRevision {
+		tag = defaultOCITag
+	}
+
+	resp, err := c.do(ctx, http.MethodHead, ref, "manifests/"+tag)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not resolve tag %s of %s: %s", tag, ref.repository, resp.Status)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); sha256DigestPattern.MatchString(digest) {
+		return digest, nil
+	}
+
+	// registries don't have to return the digest, so compute it from the manifest
+	body, err := c.getManifestBytes(ctx, ref, tag)
+	if err != nil {
+		return "", err
+	}
+	return sha256Digest(body), nil
+}
+
+// Pulls the layers of the artifact with the given manifest digest and reads the manifests at the source path
+func (c *ociClient) getRepoObjs(ctx context.Context, source gitopsv1.ApplicationSource, revision string) ([]*unstructured.Unstructured, error) {
+	ref, err := parseOCIReference(source.RepoURL)
+	if err != nil {
+		return nil, err
+	}
+	if !sha256DigestPattern.MatchString(revision) {
+		return nil, fmt.Errorf("invalid digest %s", revision)
+	}
+
+	body, err := c.getManifestBytes(ctx, ref, revision)
+	if err != nil {
+		return nil, err
+	}
+	if digest := sha256Digest(body); digest != revision {
+		return nil, fmt.Errorf("digest of manifest %s does not match, got %s", revision, digest)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s: %w", revision, err)
+	}
+	if manifest.MediaType == ociIndexMediaType || manifest.MediaType == dockerListMediaType {
+		return nil, fmt.Errorf("%s is an index, reference the manifest of a single artifact instead", source.RepoURL)
+	}
+
+	var targetObjs []*unstructured.Unstructured
+	found := false
+	for _, layer := range manifest.Layers {
+		blob, err := c.getBlob(ctx, ref, layer)
+		if err != nil {
+			return nil, err
+		}
+		objs, layerFound, err := getResourcesFromLayer(blob, layer, source.Path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read layer %s: %w", layer.Digest, err)
+		}
+		found = found || layerFound
+		targetObjs = append(targetObjs, objs...)
+	}
+	if !found {
+		return nil, fmt.Errorf("path %s not found in artifact %s", source.Path, source.RepoURL)
+	}
+	return targetObjs, nil
+}
+
+// Lists the tags of the repository of an OCI source, following the pagination links of the registry
+func (c *ociClient) listTags(ctx context.Context, source gitopsv1.ApplicationSource) ([]string, error) {
+	ref, err := parseOCIReference(source.RepoURL)
+	if err != nil {
+		return nil, err
+	}
+	if ref.tag != "" || ref.digest != "" {
+		return nil, fmt.Errorf("%s already references a tag or digest", source.RepoURL)
+	}
+
+	var tags []string
+	apiPath := "tags/list"
+	for apiPath != "" {
+		resp, err := c.do(ctx, http.MethodGet, ref, apiPath)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxOCIManifestSize)).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("could not list tags of %s: %s", ref.repository, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse tags of %s: %w", ref.repository, err)
+		}
+		tags = append(tags, list.Tags...)
+
+		// e.g. Link: </v2/manifests/app/tags/list?n=100&last=v1.4.0>; rel="next"
+		nextPath := ""
+		if _, next, ok := strings.Cut(resp.Header.Get("Link"), "/tags/list"); ok && strings.Contains(next, `rel="next"`) {
+			query, _, _ := strings.Cut(next, ">")
+			nextPath = "tags/list" + query
+		}
+		if nextPath == apiPath {
+			nextPath = ""
+		}
+		apiPath = nextPath
+	}
+	return tags, nil
+}
+
+// Reads the manifests at sourcePath from a layer, which is either a (gzipped) tarball or a single file
+func getResourcesFromLayer(blob []byte, layer ociDescriptor, sourcePath string) ([]*unstructured.Unstructured, bool, error) {
+	if isGzip(blob) || strings.Contains(layer.MediaType, "tar") {
+		return getResourcesFromBundle(blob, sourcePath)
+	}
+
+	sourcePath = strings.Trim(path.Clean("/"+sourcePath), "/")
+	sourceDir := sourcePath
+	if sourceDir == "" {
+		sourceDir = "."
+	}
+	name := strings.Trim(path.Clean("/"+layer.Annotations[ociTitleAnnotation]), "/")
+	if name != sourcePath && path.Dir(name) != sourceDir {
+		return nil, sourcePath == "", nil
+	}
+	// like in tarballs, files in the directory are only read if they are YAML or JSON
+	if name != sourcePath && !isManifestFile(name) {
+		return nil, true, nil
+	}
+	if name == "" {
+		name = layer.Digest
+	}
+	objs, err := getResourcesFromYAMLOrJSON(bytes.NewReader(blob), name)
+	return objs, true, err
+}
+
+// Reads the manifests at sourcePath from a tarball, which may be gzipped. Reading fails once more than
+// maxExtractedBundleSize bytes were extracted
+func getResourcesFromBundle(blob []byte, sourcePath string) ([]*unstructured.Unstructured, bool, error) {
+	var r io.Reader = bytes.NewReader(blob)
+	if isGzip(blob) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, false, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return getResourcesFromTar(tar.NewReader(&extractLimitReader{r: r, limit: maxExtractedBundleSize}), sourcePath, false)
+}
+
+func isGzip(blob []byte) bool {
+	return len(blob) > 2 && blob[0] == 0x1f && blob[1] == 0x8b
+}
+
+// Like io.LimitReader, but fails instead of ending the stream once more than limit bytes were read, so a
+// truncated archive isn't mistaken for a complete one
+type extractLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *extractLimitReader) Read(p []byte) (int, error) {
+	if remaining := l.limit - l.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, fmt.Errorf("archive is larger than %d bytes when extracted", l.limit)
+	}
+	return n, err
+}
+
+func (c *ociClient) getManifestBytes(ctx context.Context, ref ociReference, reference string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, ref, "manifests/"+reference)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not get manifest %s of %s: %s", reference, ref.repository, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOCIManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxOCIManifestSize {
+		return nil, fmt.Errorf("manifest %s of %s is too large", reference, ref.repository)
+	}
+	return body, nil
+}
+
+// Downloads a blob and verifies its size and digest
+func (c *ociClient) getBlob(ctx context.Context, ref ociReference, desc ociDescriptor) ([]byte, error) {
+	if !sha256DigestPattern.MatchString(desc.Digest) {
+		return nil, fmt.Errorf("unsupported digest %s", desc.Digest)
+	}
+	// the size is taken from the manifest, so it must not decide how much is read
+	if desc.Size < 0 || desc.Size > maxOCIBlobSize {
+		return nil, fmt.Errorf("blob %s of %s is larger than %d bytes", desc.Digest, ref.repository, maxOCIBlobSize)
+	}
+	resp, err := c.do(ctx, http.MethodGet, ref, "blobs/"+desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not get blob %s of %s: %s", desc.Digest, ref.repository, resp.Status)
+	}
+	blob, err := io.ReadAll(io.LimitReader(resp.Body, desc.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(blob)) != desc.Size {
+		return nil, fmt.Errorf("size of blob %s does not match, expected %d bytes", desc.Digest, desc.Size)
+	}
+	if digest := sha256Digest(blob); digest != desc.Digest {
+		return nil, fmt.Errorf("digest of blob %s does not match, got %s", desc.Digest, digest)
+	}
+	return blob, nil
+}
+
+// Sends a request to the registry. If the registry asks for authentication, a token is requested with the
+// credentials of the client and the request is repeated
+func (c *ociClient) do(ctx context.Context, method string, ref ociReference, apiPath string) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, "https://"+ref.registry+"/v2/"+ref.repository+"/"+apiPath, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join([]string{ociManifestMediaType, dockerManifestMediaType, ociIndexMediaType, dockerListMediaType}, ", "))
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	if c.authorization, err = c.authenticate(ctx, ref, resp.Header.Get("WWW-Authenticate")); err != nil {
+		return nil, err
+	}
+	if req, err = newRequest(); err != nil {
+		return nil, err
+	}
+	return c.httpClient.Do(req)
+}
+
+// Answers an authentication challenge of the registry and returns the Authorization header to send
+func (c *ociClient) authenticate(ctx context.Context, ref ociReference, challenge string) (string, error) {
+	scheme, _, _ := strings.Cut(challenge, " ")
+	params := make(map[string]string)
+	for _, match := range ociChallengePattern.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return "", fmt.Errorf("registry %s requires credentials", ref.registry)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge from registry %s: %q", ref.registry, challenge)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm %q of registry %s", params["realm"], ref.registry)
+	}
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + ref.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not get token for registry %s: %s", ref.registry, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("could not parse token of registry %s: %w", ref.registry, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
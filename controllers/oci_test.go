@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+// An in-process registry serving a single repository. Requests need a bearer token that is issued
+// by the token endpoint for the given credentials
+type testRegistry struct {
+	repository string
+	manifests  map[string][]byte
+	blobs      map[string][]byte
+	username   string
+	password   string
+	tags       []string
+	// tags per page of the tag list, all tags if zero
+	pageSize int
+}
+
+func (reg *testRegistry) push(tag string, layers ...ociDescriptor) string {
+	manifest, _ := json.Marshal(ociManifest{MediaType: ociManifestMediaType, Layers: layers})
+	digest := sha256Digest(manifest)
+	reg.manifests[tag] = manifest
+	reg.manifests[digest] = manifest
+	reg.tags = append(reg.tags, tag)
+	return digest
+}
+
+func (reg *testRegistry) addBlob(mediaType string, blob []byte, annotations map[string]string) ociDescriptor {
+	digest := sha256Digest(blob)
+	reg.blobs[digest] = blob
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(blob)), Annotations: annotations}
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if username, password, ok := r.BasicAuth(); !ok || username != reg.username || password != reg.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "pull-token"})
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer pull-token" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="https://`+r.Host+`/token",service="test-registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/v2/" + reg.repository + "/"
+	kind, reference, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	var content []byte
+	switch {
+	case !strings.HasPrefix(r.URL.Path, prefix):
+	case kind == "manifests":
+		content = reg.manifests[reference]
+		w.Header().Set("Content-Type", ociManifestMediaType)
+		w.Header().Set("Docker-Content-Digest", sha256Digest(content))
+	case kind == "blobs":
+		content = reg.blobs[reference]
+	case kind == "tags" && reference == "list":
+		content = reg.tagList(w, r.URL.Query().Get("last"))
+	}
+	if content == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(content)
+	}
+}
+
+// Returns the page of tags after the last one, linking to the next page
+func (reg *testRegistry) tagList(w http.ResponseWriter, last string) []byte {
+	tags := reg.tags
+	for i, tag := range tags {
+		if tag == last {
+			tags = tags[i+1:]
+			break
+		}
+	}
+	if reg.pageSize > 0 && len(tags) > reg.pageSize {
+		tags = tags[:reg.pageSize]
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`, reg.repository, reg.pageSize, tags[len(tags)-1]))
+	}
+	content, _ := json.Marshal(map[string]interface{}{"name": reg.repository, "tags": tags})
+	return content
+}
+
+func TestParseOCIReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for repoURL, want := range map[string]ociReference{
+		"oci://registry.example.com/manifests/app:v1": {registry: "registry.example.com", repository: "manifests/app", tag: "v1"},
+		"oci://localhost:5000/app":                    {registry: "localhost:5000", repository: "app"},
+		"oci://localhost:5000/app@" + digest:          {registry: "localhost:5000", repository: "app", digest: digest},
+	} {
+		ref, err := parseOCIReference(repoURL)
+		if err != nil || ref != want {
+			t.Errorf("%s: expected %+v, got %+v %v", repoURL, want, ref, err)
+		}
+	}
+	for _, repoURL := range []string{"oci://registry.example.com", "oci://registry.example.com/app@sha256:short"} {
+		if _, err := parseOCIReference(repoURL); err == nil {
+			t.Errorf("%s: expected an error", repoURL)
+		}
+	}
+}
+
+func TestOCIClient(t *testing.T) {
+	reg := &testRegistry{
+		repository: "manifests/app",
+		manifests:  map[string][]byte{},
+		blobs:      map[string][]byte{},
+		username:   "ci",
+		password:   "secret",
+	}
+	server := httptest.NewTLSServer(reg)
+	defer server.Close()
+
+	bundle := reg.addBlob("application/vnd.oci.image.layer.v1.tar+gzip", newTarball(t, "", map[string]string{
+		"./prod/config.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n",
+		"dev/config.yaml":    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: dev-config\n",
+	}).Bytes(), nil)
+	single := reg.addBlob("application/yaml", []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: api\n"),
+		map[string]string{ociTitleAnnotation: "prod/service.yaml"})
+	readme := reg.addBlob("text/markdown", []byte("# Manifests\n\nApplied by the gitops controller.\n"), map[string]string{ociTitleAnnotation: "prod/README.md"})
+	digest := reg.push("v1", bundle, single, readme)
+
+	repoSecret := &corev1.Secret{Data: map[string][]byte{
+		gitopsv1.RepoSecretUsernameKey: []byte("ci"),
+		gitopsv1.RepoSecretPasswordKey: []byte("secret"),
+	}}
+	ctx := context.Background()
+	registry := strings.TrimPrefix(server.URL, "https://")
+	source := gitopsv1.ApplicationSource{RepoURL: "oci://" + registry + "/manifests/app", TargetRevision: "v1", Path: "prod"}
+
+	revision, err := newOCIClient(repoSecret, server.Client()).resolveRevision(ctx, source, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != digest {
+		t.Fatalf("expected tag to resolve to %s, got %s", digest, revision)
+	}
+
+	objs, err := newOCIClient(repoSecret, server.Client()).getRepoObjs(ctx, source, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, obj := range objs {
+		names = append(names, obj.GetKind()+"/"+obj.GetName())
+	}
+	if strings.Join(names, ",") != "ConfigMap/config,Service/api" {
+		t.Errorf("unexpected objects %v", names)
+	}
+
+	if _, err := newOCIClient(nil, server.Client()).resolveRevision(ctx, source, ""); err == nil {
+		t.Error("expected an error without credentials")
+	}
+
+	// a registry serving tampered content
+	reg.blobs[single.Digest] = []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: evil\n")
+	if _, err := newOCIClient(repoSecret, server.Client()).getRepoObjs(ctx, source, revision); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+
+	// a manifest claiming a huge layer
+	huge := bundle
+	huge.Size = maxOCIBlobSize + 1
+	hugeDigest := reg.push("huge", huge)
+	if _, err := newOCIClient(repoSecret, server.Client()).getRepoObjs(ctx, source, hugeDigest); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("expected the layer to be rejected, got %v", err)
+	}
+}
+
+func TestExtractLimitReader(t *testing.T) {
+	manifest := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  padding: " + strings.Repeat("x", 4096) + "\n"
+	tarball := newTarball(t, "", map[string]string{"app.yaml": manifest})
+	extract := func(limit int64) ([]*unstructured.Unstructured, error) {
+		gz, err := gzip.NewReader(bytes.NewReader(tarball.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs, _, err := getResourcesFromTar(tar.NewReader(&extractLimitReader{r: gz, limit: limit}), "", false)
+		return objs, err
+	}
+
+	if objs, err := extract(1 << 20); err != nil || len(objs) != 1 {
+		t.Errorf("expected the object within the limit, got %v, %v", objs, err)
+	}
+	// the archive is far smaller than the limit, but not once extracted
+	if tarball.Len() > 2048 {
+		t.Fatalf("expected the tarball to be compressed, got %d bytes", tarball.Len())
+	}
+	if _, err := extract(2048); err == nil || !strings.Contains(err.Error(), "larger than 2048 bytes") {
+		t.Errorf("expected an error for the extracted size, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+// number of syncs kept in the application history
+const syncHistoryLimit = 10
+
+// Returns the selectors a sync is restricted to. A nil result means all resources are synced
+func syncSelectors(app *gitopsv1.Application) []gitopsv1.ResourceSelector {
+	if app.Operation == nil || app.Operation.Sync == nil {
+		return nil
+	}
+	return app.Operation.Sync.Resources
+}
+
+// Checks whether a resource matches any of the selectors
+func matchesSelectors(selectors []gitopsv1.ResourceSelector, resource gitopsv1.Resource, resourceLabels map[string]string) (bool, error) {
+	for _, selector := range selectors {
+		if selector.Group != "" && selector.Group != resource.Group ||
+			selector.Kind != "" && selector.Kind != resource.Kind ||
+			selector.Namespace != "" && selector.Namespace != resource.Namespace ||
+			selector.Name != "" && selector.Name != resource.Name {
+			continue
+		}
+		if selector.LabelSelector != nil {
+			labelSelector, err := metav1.LabelSelectorAsSelector(selector.LabelSelector)
+			if err != nil {
+				return false, err
+			}
+			if !labelSelector.Matches(labels.Set(resourceLabels)) {
+				continue
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func hasLabelSelector(selectors []gitopsv1.ResourceSelector) bool {
+	for _, selector := range selectors {
+		if selector.LabelSelector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the requested operation once it is done. This refreshes the app, so it has to happen
+// before the status is updated. The status set during the sync is kept, as the update overwrites it with
+// the stored one. Removing the operation bumps the generation, so if the spec is still the one last
+// synced, e.g. after a dry-run, the new generation is recorded as synced as well
+func (r *ApplicationReconciler) completeOperation(ctx context.Context, app *gitopsv1.Application) error {
+	if app.Operation == nil {
+		return nil
+	}
+	status := app.Status.DeepCopy()
+	app.Operation = nil
+	if err := r.Update(ctx, app); err != nil {
+		log.FromContext(ctx).Error(err, fmt.Sprintf("could not remove completed operation from application %s", app.Name))
+		return err
+	}
+	app.Status = *status
+	if hash, err := specHash(app); err == nil && app.Status.ObservedSpecHash == hash {
+		app.Status.ObservedGeneration = app.Generation
+	}
+	return nil
+}
+
+// Hash of the application spec, to tell spec changes apart from other changes bumping the generation
+func specHash(app *gitopsv1.Application) (string, error) {
+	data, err := json.Marshal(app.Spec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Restricts the target objects of a partial sync to those matching the selectors
+func selectTargets(targetObjs []*unstructured.Unstructured, selectors []gitopsv1.ResourceSelector) ([]*unstructured.Unstructured, error) {
+	var selected []*unstructured.Unstructured
+	for _, target := range targetObjs {
+		ok, err := matchesSelectors(selectors, resourceFromObject(target), target.GetLabels())
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			selected = append(selected, target)
+		}
+	}
+	return selected, nil
+}
+
+// Restricts the orphans pruned by a partial sync to those matching the selectors.
+// Orphans are only known from the application status, so label selectors are matched against the live objects
+func (r *ApplicationReconciler) selectOrphans(ctx context.Context, resourceClient client.Client, orphans []gitopsv1.Resource, selectors []gitopsv1.ResourceSelector) ([]gitopsv1.Resource, error) {
+	var selected []gitopsv1.Resource
+	for _, orphan := range orphans {
+		var orphanLabels map[string]string
+		if hasLabelSelector(selectors) {
+			u := &unstructured.Unstructured{}
+			u.SetGroupVersionKind(schema.GroupVersionKind{Group: orphan.Group, Version: orphan.Version, Kind: orphan.Kind})
+			if err := resourceClient.Get(ctx, client.ObjectKey{Namespace: orphan.Namespace, Name: orphan.Name}, u); client.IgnoreNotFound(err) != nil {
+				return nil, err
+			}
+			orphanLabels = u.GetLabels()
+		}
+		ok, err := matchesSelectors(selectors, orphan, orphanLabels)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			selected = append(selected, orphan)
+		}
+	}
+	return selected, nil
+}
+
+// Updates the managed resources of an application after a partial sync
+func mergeResources(managed, synced, pruned []gitopsv1.Resource) []gitopsv1.Resource {
+	removed := make(map[resourceKey]bool)
+	for _, resource := range pruned {
+		removed[keyOfResource(resource)] = true
+	}
+	for _, resource := range synced {
+		removed[keyOfResource(resource)] = true
+	}
+
+	var merged []gitopsv1.Resource
+	for _, resource := range managed {
+		if !removed[keyOfResource(resource)] {
+			merged = append(merged, resource)
+		}
+	}
+	return append(merged, synced...)
+}
+
+func resourceFromObject(obj *unstructured.Unstructured) gitopsv1.Resource {
+	gvk := obj.GroupVersionKind()
+	return gitopsv1.Resource{
+		Group:     gvk.Group,
+		Version:   gvk.Version,
+		Kind:      gvk.Kind,
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+	}
+}
+
+// Records a completed sync in the application history
+func addSyncHistory(app *gitopsv1.Application, revision string, selectors []gitopsv1.ResourceSelector) {
+	entry := gitopsv1.SyncHistoryEntry{
+		Revision:  revision,
+		SyncedAt:  metav1.Now(),
+		Partial:   len(selectors) > 0,
+		Resources: selectors,
+	}
+	app.Status.History = append([]gitopsv1.SyncHistoryEntry{entry}, app.Status.History...)
+	if len(app.Status.History) > syncHistoryLimit {
+		app.Status.History = app.Status.History[:syncHistoryLimit]
+	}
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestMatchesSelectors(t *testing.T) {
+	deployment := gitopsv1.Resource{Group: "apps", Version: "v1", Kind: "Deployment", Namespace: "default", Name: "web"}
+	webLabels := map[string]string{"app": "web"}
+
+	tests := []struct {
+		name      string
+		selectors []gitopsv1.ResourceSelector
+		want      bool
+	}{
+		{name: "kind and name", selectors: []gitopsv1.ResourceSelector{{Kind: "Deployment", Name: "web"}}, want: true},
+		{name: "other name", selectors: []gitopsv1.ResourceSelector{{Kind: "Deployment", Name: "api"}}, want: false},
+		{name: "other group", selectors: []gitopsv1.ResourceSelector{{Group: "batch", Name: "web"}}, want: false},
+		{name: "any selector", selectors: []gitopsv1.ResourceSelector{{Name: "api"}, {Namespace: "default"}}, want: true},
+		{
+			name:      "label selector",
+			selectors: []gitopsv1.ResourceSelector{{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}}},
+			want:      true,
+		},
+		{
+			name:      "other labels",
+			selectors: []gitopsv1.ResourceSelector{{Kind: "Deployment", LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}}},
+			want:      false,
+		},
+	}
+	for _, tt := range tests {
+		got, err := matchesSelectors(tt.selectors, deployment, webLabels)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestMergeResources(t *testing.T) {
+	web := gitopsv1.Resource{Group: "apps", Version: "v1", Kind: "Deployment", Namespace: "default", Name: "web"}
+	api := gitopsv1.Resource{Group: "apps", Version: "v1", Kind: "Deployment", Namespace: "default", Name: "api"}
+	cm := gitopsv1.Resource{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "config"}
+
+	syncedWeb := web
+	syncedWeb.Status = gitopsv1.SyncStatusSynced
+
+	merged := mergeResources([]gitopsv1.Resource{web, api, cm}, []gitopsv1.Resource{syncedWeb}, []gitopsv1.Resource{cm})
+	if len(merged) != 2 || merged[0] != api || merged[1] != syncedWeb {
+		t.Errorf("unexpected resources after partial sync: %v", merged)
+	}
+}
+
+func TestCompleteOperationKeepsSyncedGeneration(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+
+	for _, tc := range []struct {
+		name        string
+		specChanged bool
+		want        int64
+	}{
+		{name: "dry-run on synced spec", want: 3},
+		{name: "spec changed with operation", specChanged: true, want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &gitopsv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Generation: 3},
+				Spec:       gitopsv1.ApplicationSpec{Source: gitopsv1.ApplicationSource{RepoURL: "https://github.com/org/repo", Path: "deploy"}},
+			}
+			hash, err := specHash(app)
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.Status.ObservedGeneration = 1
+			app.Status.ObservedSpecHash = hash
+			if tc.specChanged {
+				app.Spec.Source.Path = "other"
+			}
+			app.Operation = &gitopsv1.Operation{Sync: &gitopsv1.SyncOperation{DryRun: true}}
+
+			r := &ApplicationReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(app).Build(), Scheme: scheme}
+			if err := r.completeOperation(context.Background(), app); err != nil {
+				t.Fatal(err)
+			}
+			if app.Operation != nil {
+				t.Errorf("expected operation to be removed")
+			}
+			if app.Status.ObservedGeneration != tc.want {
+				t.Errorf("expected observed generation %d, got %d", tc.want, app.Status.ObservedGeneration)
+			}
+		})
+	}
+}
+
+func TestCompleteOperationKeepsStatus(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+
+	app := &gitopsv1.Application{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Generation: 2},
+		Spec:       gitopsv1.ApplicationSpec{Source: gitopsv1.ApplicationSource{RepoURL: "https://github.com/org/repo", Path: "deploy"}},
+		Operation:  &gitopsv1.Operation{Sync: &gitopsv1.SyncOperation{}},
+	}
+	c := statusSubresourceClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(app).Build()}
+	r := &ApplicationReconciler{Client: c, Scheme: scheme}
+
+	// status set during the sync, which is not stored yet
+	app.Status.LastAttemptedRevision = "abc123"
+	meta.SetStatusCondition(&app.Status.Conditions, metav1.Condition{
+		Type:   gitopsv1.ConditionTypeCommitVerified,
+		Status: metav1.ConditionTrue,
+		Reason: reasonCommitVerified,
+	})
+	if err := r.completeOperation(context.Background(), app); err != nil {
+		t.Fatal(err)
+	}
+	if app.Operation != nil {
+		t.Errorf("expected operation to be removed")
+	}
+	if app.Status.LastAttemptedRevision != "abc123" {
+		t.Errorf("expected the last attempted revision to be kept, got %q", app.Status.LastAttemptedRevision)
+	}
+	if !meta.IsStatusConditionTrue(app.Status.Conditions, gitopsv1.ConditionTypeCommitVerified) {
+		t.Errorf("expected the CommitVerified condition to be kept, got %v", app.Status.Conditions)
+	}
+}
+
+// Updates applications like the API server with the status subresource: the status of the update is
+// ignored and the stored one is returned
+type statusSubresourceClient struct {
+	client.Client
+}
+
+func (c statusSubresourceClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if app, ok := obj.(*gitopsv1.Application); ok {
+		var stored gitopsv1.Application
+		if err := c.Get(ctx, client.ObjectKeyFromObject(app), &stored); err != nil {
+			return err
+		}
+		app.Status = stored.Status
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
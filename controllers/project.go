@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	projectIndexKey = ".spec.project"
+
+	// project of applications that don't reference one if projects are read from the ProjectNamespace
+	defaultProjectName = "default"
+)
+
+// Returns the name of the project restricting an application, or an empty string if it is not restricted
+func (r *ApplicationReconciler) projectName(app *gitopsv1.Application) string {
+	if app.Spec.Project == "" && r.ProjectNamespace != "" {
+		return defaultProjectName
+	}
+	return app.Spec.Project
+}
+
+// Returns the namespace the project of an application is read from
+func (r *ApplicationReconciler) projectNamespace(app *gitopsv1.Application) string {
+	if r.ProjectNamespace != "" {
+		return r.ProjectNamespace
+	}
+	return app.Namespace
+}
+
+// Returns the project of an application or nil if it is not restricted by one. A missing project fails the sync,
+// so applications are never deployed without the restrictions of their project
+func (r *ApplicationReconciler) getProject(ctx context.Context, app *gitopsv1.Application) (*gitopsv1.Project, error) {
+	name := r.projectName(app)
+	if name == "" {
+		return nil, nil
+	}
+	var project gitopsv1.Project
+	if err := r.Get(ctx, types.NamespacedName{Namespace: r.projectNamespace(app), Name: name}, &project); err != nil {
+		return nil, fmt.Errorf("could not get project %s: %w", name, err)
+	}
+	return &project, nil
+}
+
+func sourcePermitted(project *gitopsv1.Project, repoURL string) bool {
+	for _, pattern := range project.Spec.SourceRepos {
+		if globMatch(normalizeRepoURL(pattern), normalizeRepoURL(repoURL)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the target objects against the project and returns why the objects that are not permitted were rejected
+func (r *ApplicationReconciler) projectViolations(project *gitopsv1.Project, targetObjs []*unstructured.Unstructured) (map[resourceKey]string, error) {
+	violations := make(map[resourceKey]string)
+	if project == nil {
+		return violations, nil
+	}
+	scopes := crdScopes(targetObjs)
+	for _, target := range targetObjs {
+		violation, err := r.projectViolation(project, target.GroupVersionKind(), target.GetNamespace(), scopes)
+		if err != nil {
+			return nil, err
+		}
+		if violation != "" {
+			violations[keyOfResource(resourceFromObject(target))] = violation
+		}
+	}
+	return violations, nil
+}
+
+// Returns the scopes of the kinds defined by the CustomResourceDefinitions among the target objects
+func crdScopes(targetObjs []*unstructured.Unstructured) map[schema.GroupKind]meta.RESTScopeName {
+	scopes := make(map[schema.GroupKind]meta.RESTScopeName)
+	for _, target := range targetObjs {
+		if target.GroupVersionKind().GroupKind() != (schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}) {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(target.Object, "spec", "group")
+		kind, _, _ := unstructured.NestedString(target.Object, "spec", "names", "kind")
+		scope, _, _ := unstructured.NestedString(target.Object, "spec", "scope")
+		if scope == "Cluster" {
+			scopes[schema.GroupKind{Group: group, Kind: kind}] = meta.RESTScopeNameRoot
+		} else {
+			scopes[schema.GroupKind{Group: group, Kind: kind}] = meta.RESTScopeNameNamespace
+		}
+	}
+	return scopes
+}
+
+// Returns the scope of a kind. Kinds the cluster doesn't know yet, e.g. custom resources whose CRD is synced by
+// the same application, take the scope of their CRD among the target objects. Otherwise they are treated as
+// namespaced, applying them fails anyway
+func (r *ApplicationReconciler) kindScope(gvk schema.GroupVersionKind, scopes map[schema.GroupKind]meta.RESTScopeName) (meta.RESTScopeName, error) {
+	mapping, err := r.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		if scope, ok := scopes[gvk.GroupKind()]; ok {
+			return scope, nil
+		}
+		return meta.RESTScopeNameNamespace, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not determine scope of %s: %w", gvk.Kind, err)
+	}
+	return mapping.Scope.Name(), nil
+}
+
+// Returns why the project does not permit a resource, or an empty string if it is permitted
+func (r *ApplicationReconciler) projectViolation(project *gitopsv1.Project, gvk schema.GroupVersionKind, namespace string, scopes map[schema.GroupKind]meta.RESTScopeName) (string, error) {
+	if project == nil {
+		return "", nil
+	}
+
+	scope, err := r.kindScope(gvk, scopes)
+	if err != nil {
+		return "", err
+	}
+	groupKind := metav1.GroupKind{Group: gvk.Group, Kind: gvk.Kind}
+
+	if scope == meta.RESTScopeNameRoot {
+		if !matchesGroupKinds(project.Spec.ClusterResourceAllowList, groupKind) || matchesGroupKinds(project.Spec.ClusterResourceDenyList, groupKind) {
+			return fmt.Sprintf("cluster-scoped kind %s is not permitted by project %s", gvk.GroupKind(), project.Name), nil
+		}
+		return "", nil
+	}
+
+	if matchesGroupKinds(project.Spec.NamespaceResourceDenyList, groupKind) {
+		return fmt.Sprintf("kind %s is not permitted by project %s", gvk.GroupKind(), project.Name), nil
+	}
+	if !destinationPermitted(project, namespace) {
+		return fmt.Sprintf("namespace %s is not a destination of project %s", namespace, project.Name), nil
+	}
+	return "", nil
+}
+
+// Filters out the resources the project does not permit
+func (r *ApplicationReconciler) permittedResources(project *gitopsv1.Project, resources []gitopsv1.Resource) ([]gitopsv1.Resource, error) {
+	if project == nil {
+		return resources, nil
+	}
+	var permitted []gitopsv1.Resource
+	for _, resource := range resources {
+		gvk := schema.GroupVersionKind{Group: resource.Group, Version: resource.Version, Kind: resource.Kind}
+		violation, err := r.projectViolation(project, gvk, resource.Namespace, nil)
+		if err != nil {
+			return nil, err
+		}
+		if violation == "" {
+			permitted = append(permitted, resource)
+		}
+	}
+	return permitted, nil
+}
+
+func destinationPermitted(project *gitopsv1.Project, namespace string) bool {
+	for _, destination := range project.Spec.Destinations {
+		server, destinationNamespace := destination.Server, destination.Namespace
+		if server == "" {
+			server = "*"
+		}
+		if destinationNamespace == "" {
+			destinationNamespace = "*"
+		}
+		if globMatch(server, gitopsv1.InClusterServer) && globMatch(destinationNamespace, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesGroupKinds(groupKinds []metav1.GroupKind, groupKind metav1.GroupKind) bool {
+	for _, gk := range groupKinds {
+		if globMatch(gk.Group, groupKind.Group) && globMatch(gk.Kind, groupKind.Kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// globPatterns caches the compiled glob patterns of projects, which are matched for every object on every sync
+var globPatterns = struct {
+	mu          sync.Mutex
+	expressions map[string]*regexp.Regexp
+}{expressions: make(map[string]*regexp.Regexp)}
+
+// Matches a glob where * matches any sequence of characters, including /
+func globMatch(pattern, s string) bool {
+	globPatterns.mu.Lock()
+	expression, ok := globPatterns.expressions[pattern]
+	if !ok {
+		quoted := regexp.QuoteMeta(pattern)
+		quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+		quoted = strings.ReplaceAll(quoted, `\?`, ".")
+		// quoted patterns always compile
+		expression = regexp.MustCompile("^" + quoted + "$")
+		globPatterns.expressions[pattern] = expression
+	}
+	globPatterns.mu.Unlock()
+	return expression.MatchString(s)
+}
+
+// Enqueues the applications of a project when it changes
+func (r *ApplicationReconciler) applicationsForProject(obj client.Object) []reconcile.Request {
+	opts := []client.ListOption{client.MatchingFields{projectIndexKey: obj.GetName()}}
+	if r.ProjectNamespace == "" {
+		opts = append(opts, client.InNamespace(obj.GetNamespace()))
+	} else if obj.GetNamespace() != r.ProjectNamespace {
+		return nil
+	}
+	var appList gitopsv1.ApplicationList
+	if err := r.List(context.Background(), &appList, opts...); err != nil {
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(appList.Items))
+	for _, app := range appList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&app)})
+	}
+	return requests
+}
@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func newObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestSourcePermitted(t *testing.T) {
+	project := &gitopsv1.Project{Spec: gitopsv1.ProjectSpec{SourceRepos: []string{"https://github.com/team-a/*"}}}
+	for repoURL, want := range map[string]bool{
+		"https://github.com/team-a/app.git":   true,
+		"https://github.com/Team-A/app":       true,
+		"https://github.com/team-b/app":       false,
+		"https://github.com/team-a-fork/app":  false,
+		"https://gitlab.com/team-a/something": false,
+	} {
+		if got := sourcePermitted(project, repoURL); got != want {
+			t.Errorf("%s: expected %v, got %v", repoURL, want, got)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"team-a-*", "team-a-dev", true},
+		{"team-a-*", "team-b-dev", false},
+		{"*", "", true},
+		{"https://github.com/*", "https://github.com/org/repo", true},
+		{"apps.k8s.io", "apps.k8s.io", true},
+		{"apps.k8s.io", "appsXk8sXio", false},
+		{"v?", "v1", true},
+		{"v?", "v10", false},
+	} {
+		// matched twice to use the cached pattern
+		for i := 0; i < 2; i++ {
+			if got := globMatch(tc.pattern, tc.s); got != tc.want {
+				t.Errorf("%s %s: expected %v, got %v", tc.pattern, tc.s, tc.want, got)
+			}
+		}
+	}
+}
+
+func TestProjectViolations(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	mapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+	r := &ApplicationReconciler{Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithRESTMapper(mapper).Build()}
+
+	project := &gitopsv1.Project{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+		Spec: gitopsv1.ProjectSpec{
+			Destinations:              []gitopsv1.ProjectDestination{{Server: gitopsv1.InClusterServer, Namespace: "team-a-*"}},
+			ClusterResourceAllowList:  []metav1.GroupKind{{Group: "", Kind: "*"}},
+			ClusterResourceDenyList:   []metav1.GroupKind{{Group: "", Kind: "Node"}},
+			NamespaceResourceDenyList: []metav1.GroupKind{{Group: "", Kind: "Secret"}},
+		},
+	}
+
+	targets := []*unstructured.Unstructured{
+		newObject("v1", "ConfigMap", "team-a-dev", "permitted"),
+		newObject("v1", "ConfigMap", "kube-system", "other-namespace"),
+		newObject("v1", "Secret", "team-a-dev", "denied-kind"),
+		newObject("v1", "Namespace", "", "team-a-dev"),
+		newObject("rbac.authorization.k8s.io/v1", "ClusterRole", "", "not-allowed"),
+	}
+	violations, err := r.projectViolations(project, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range targets {
+		_, violated := violations[keyOfResource(resourceFromObject(target))]
+		want := target.GetName() != "permitted" && target.GetName() != "team-a-dev"
+		if violated != want {
+			t.Errorf("%s: expected violation %v, got %v", target.GetName(), want, violations)
+		}
+	}
+
+	if violations, err := r.projectViolations(nil, targets); err != nil || len(violations) != 0 {
+		t.Errorf("expected applications without a project to be unrestricted, got %v %v", violations, err)
+	}
+}
+
+func TestProjectViolationsOfUnknownKinds(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}, meta.RESTScopeRoot)
+	r := &ApplicationReconciler{Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithRESTMapper(mapper).Build()}
+
+	project := &gitopsv1.Project{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+		Spec: gitopsv1.ProjectSpec{
+			Destinations:             []gitopsv1.ProjectDestination{{Namespace: "team-a"}},
+			ClusterResourceAllowList: []metav1.GroupKind{{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}},
+		},
+	}
+	newCRD := func(kind, scope string) *unstructured.Unstructured {
+		crd := newObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", strings.ToLower(kind)+"s.example.com")
+		crd.Object["spec"] = map[string]interface{}{
+			"group": "example.com",
+			"names": map[string]interface{}{"kind": kind},
+			"scope": scope,
+		}
+		return crd
+	}
+
+	// the CRDs are synced by the same application, so the cluster doesn't know their kinds yet
+	targets := []*unstructured.Unstructured{
+		newCRD("Widget", "Namespaced"),
+		newCRD("Gadget", "Cluster"),
+		newObject("example.com/v1", "Widget", "team-a", "permitted"),
+		newObject("example.com/v1", "Widget", "team-b", "other-namespace"),
+		newObject("example.com/v1", "Gadget", "", "cluster-scoped"),
+		// without a CRD, applying the object fails, so it is treated as namespaced
+		newObject("other.example.com/v1", "Thing", "team-a", "unknown"),
+	}
+	violations, err := r.projectViolations(project, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range targets {
+		_, violated := violations[keyOfResource(resourceFromObject(target))]
+		want := target.GetName() == "other-namespace" || target.GetName() == "cluster-scoped"
+		if violated != want {
+			t.Errorf("%s: expected violation %v, got %v", target.GetName(), want, violations)
+		}
+	}
+}
+
+func TestGetProject(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+
+	controllerProject := &gitopsv1.Project{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Namespace: "gitops-system"}}
+	defaultProject := &gitopsv1.Project{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "gitops-system"}}
+	// created by the tenant to lift the restrictions of its project
+	tenantProject := &gitopsv1.Project{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Namespace: "team-a"}}
+	r := &ApplicationReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(controllerProject, defaultProject, tenantProject).Build()}
+	ctx := context.Background()
+
+	app := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}}
+	if project, err := r.getProject(ctx, app); err != nil || project != nil {
+		t.Fatalf("expected applications without a project to be unrestricted, got %v %v", project, err)
+	}
+	app.Spec.Project = "team-a"
+	if project, err := r.getProject(ctx, app); err != nil || project.Namespace != "team-a" {
+		t.Fatalf("expected the project in the namespace of the application, got %v %v", project, err)
+	}
+
+	r.ProjectNamespace = "gitops-system"
+	if project, err := r.getProject(ctx, app); err != nil || project.Namespace != "gitops-system" {
+		t.Fatalf("expected the project in the project namespace, got %v %v", project, err)
+	}
+	app.Spec.Project = ""
+	if project, err := r.getProject(ctx, app); err != nil || project.Name != "default" {
+		t.Fatalf("expected the default project, got %v %v", project, err)
+	}
+	app.Spec.Project = "missing"
+	if _, err := r.getProject(ctx, app); err == nil {
+		t.Fatal("expected a missing project to fail")
+	}
+}
+
+func TestReconcileRejectsSourceBeforeFetching(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+	project := &gitopsv1.Project{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a", Namespace: "team-a"},
+		Spec:       gitopsv1.ProjectSpec{SourceRepos: []string{"https://github.com/team-a/*"}},
+	}
+	app := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"}}
+	app.Spec.Project = "team-a"
+	app.Spec.Source = gitopsv1.ApplicationSource{RepoURL: server.URL + "/manifests.tar.gz"}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(project, app).Build()
+	r := &ApplicationReconciler{Client: c, Scheme: scheme, HTTPClient: server.Client()}
+
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(app)}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 {
+		t.Errorf("expected no requests to a source the project does not permit, got %d", requests)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(app), app); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(app.Status.LastSyncError, "is not permitted by project team-a") {
+		t.Errorf("expected the sync to fail, got %q", app.Status.LastSyncError)
+	}
+}
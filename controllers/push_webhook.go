@@ -0,0 +1,375 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	// Field index on the normalized .spec.source.repoURL of Applications
+	repoURLIndexKey string = ".spec.source.repoURL"
+
+	// github limits webhook payloads to 25MB
+	maxPushPayloadBytes int64 = 25 << 20
+)
+
+// pushEvent is the provider independent part of a push webhook payload
+type pushEvent struct {
+	// URLs of the pushed repository, normalized with normalizeRepoURL
+	repoURLs []string
+
+	// short names of the pushed branches and tags
+	revisions []string
+
+	// short names of the pushed tags, which can match semver constraints
+	tags []string
+
+	// default branch of the repository if included in the payload
+	defaultBranch string
+}
+
+// PushWebhookReceiver is an HTTP endpoint for git push webhooks from GitHub, GitLab, Gitea and Bitbucket.
+// Applications tracking the pushed repository and revision are enqueued so they are synced right away
+// instead of at the end of their sync period.
+type PushWebhookReceiver struct {
+	client.Client
+
+	// Address the receiver listens on
+	BindAddress string
+
+	// Shared secret used to verify the signature (or token for GitLab) of webhook requests.
+	// The receiver does not start without it
+	Secret []byte
+
+	// Applications to be synced are sent to this channel
+	Events chan<- event.GenericEvent
+}
+
+// Start runs the HTTP server until the context is cancelled. Implements manager.Runnable
+func (r *PushWebhookReceiver) Start(ctx context.Context) error {
+	log := log.FromContext(ctx)
+
+	// unverified requests would let anyone who can reach the receiver trigger syncs
+	if len(r.Secret) == 0 {
+		return errors.New("push webhook receiver requires a secret")
+	}
+
+	server := &http.Server{
+		Addr:              r.BindAddress,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error(err, "could not shut down push webhook receiver")
+		}
+	}()
+
+	log.Info("Starting push webhook receiver", "address", r.BindAddress)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (r *PushWebhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	log := log.FromContext(ctx)
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxPushPayloadBytes))
+	if err != nil {
+		http.Error(w, "could not read payload", http.StatusBadRequest)
+		return
+	}
+
+	push, err := r.parsePushEvent(req.Header, payload)
+	if err != nil {
+		log.Info("Rejecting push webhook", "reason", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if push == nil {
+		// valid request for an event other than a push (e.g. ping)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	apps, err := r.findApplications(ctx, push)
+	if err != nil {
+		log.Error(err, "could not find applications for push webhook")
+		http.Error(w, "could not find applications", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range apps {
+		log.Info("Push received, enqueuing application", "app", client.ObjectKeyFromObject(&apps[i]), "revisions", push.revisions)
+		select {
+		case r.Events <- event.GenericEvent{Object: &apps[i]}:
+		case <-ctx.Done():
+			http.Error(w, "timed out enqueuing applications", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Verifies the request and parses the payload based on the headers set by the git provider.
+// Returns a nil event if the request is valid but not a push
+func (r *PushWebhookReceiver) parsePushEvent(header http.Header, payload []byte) (*pushEvent, error) {
+	switch {
+	// gitea also sets the github event headers so it has to be checked first
+	case header.Get("X-Gitea-Event") != "":
+		if err := r.verifyHMAC(header.Get("X-Gitea-Signature"), payload); err != nil {
+			return nil, err
+		}
+		if header.Get("X-Gitea-Event") != "push" {
+			return nil, nil
+		}
+		return parseGithubPush(payload)
+	case header.Get("X-GitHub-Event") != "":
+		if err := r.verifyHMAC(strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256="), payload); err != nil {
+			return nil, err
+		}
+		if header.Get("X-GitHub-Event") != "push" {
+			return nil, nil
+		}
+		return parseGithubPush(payload)
+	case header.Get("X-Gitlab-Event") != "":
+		// gitlab sends the secret as is instead of signing the payload
+		if subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), r.Secret) != 1 {
+			return nil, errors.New("invalid gitlab token")
+		}
+		if event := header.Get("X-Gitlab-Event"); event != "Push Hook" && event != "Tag Push Hook" {
+			return nil, nil
+		}
+		return parseGitlabPush(payload)
+	case header.Get("X-Event-Key") != "":
+		if err := r.verifyHMAC(strings.TrimPrefix(header.Get("X-Hub-Signature"), "sha256="), payload); err != nil {
+			return nil, err
+		}
+		if header.Get("X-Event-Key") != "repo:push" {
+			return nil, nil
+		}
+		return parseBitbucketPush(payload)
+	}
+	return nil, errors.New("unknown webhook provider")
+}
+
+// Checks a hex encoded HMAC-SHA256 signature of the payload
+func (r *PushWebhookReceiver) verifyHMAC(signature string, payload []byte) error {
+	if signature == "" {
+		return errors.New("missing signature")
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	mac := hmac.New(sha256.New, r.Secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// Lists the Applications tracking the pushed repository whose target revision may have moved
+func (r *PushWebhookReceiver) findApplications(ctx context.Context, push *pushEvent) ([]gitopsv1.Application, error) {
+	var apps []gitopsv1.Application
+	seen := make(map[client.ObjectKey]bool)
+	for _, repoURL := range push.repoURLs {
+		var appList gitopsv1.ApplicationList
+		if err := r.List(ctx, &appList, client.MatchingFields{repoURLIndexKey: repoURL}); err != nil {
+			return nil, err
+		}
+		for _, app := range appList.Items {
+			key := client.ObjectKeyFromObject(&app)
+			if seen[key] || !push.matchesSource(app.Spec.GetSources(), repoURL) {
+				continue
+			}
+			seen[key] = true
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+// A push matches an application if it moved the target revision of any of its sources in the pushed repository,
+// or pushed a tag matching the semver constraint of a source
+func (p *pushEvent) matchesSource(sources []gitopsv1.ApplicationSource, repoURL string) bool {
+	for _, source := range sources {
+		if normalizeRepoURL(source.RepoURL) != repoURL {
+			continue
+		}
+		if p.matchesRevision(source.TargetRevision) || p.matchesSemverConstraint(source.TargetRevision, source.IncludePrerelease) {
+			return true
+		}
+	}
+	return false
+}
+
+// A push matches a target revision naming one of the pushed branches or tags. An empty or HEAD
+// target revision tracks the default branch, which not all providers include in the payload.
+// Pushes can never move a commit SHA
+func (p *pushEvent) matchesRevision(targetRevision string) bool {
+	targetRevision = strings.TrimPrefix(strings.TrimPrefix(targetRevision, "refs/heads/"), "refs/tags/")
+	if targetRevision == "" || targetRevision == "HEAD" {
+		if p.defaultBranch == "" {
+			return true
+		}
+		targetRevision = p.defaultBranch
+	}
+	for _, revision := range p.revisions {
+		if revision == targetRevision {
+			return true
+		}
+	}
+	return false
+}
+
+// A push matches a semver constraint if one of the pushed tags satisfies it. The tag isn't necessarily the
+// latest one matching, the sync resolves the constraint again
+func (p *pushEvent) matchesSemverConstraint(targetRevision string, includePrerelease bool) bool {
+	if len(p.tags) == 0 || !isSemverConstraint(targetRevision) {
+		return false
+	}
+	constraint, err := parseSemverConstraint(targetRevision)
+	if err != nil {
+		return false
+	}
+	return constraint.latest(p.tags, includePrerelease) != ""
+}
+
+func parseGithubPush(payload []byte) (*pushEvent, error) {
+	var push struct {
+		Ref        string `json:"ref"`
+		Repository struct {
+			HTMLURL       string `json:"html_url"`
+			CloneURL      string `json:"clone_url"`
+			SSHURL        string `json:"ssh_url"`
+			DefaultBranch string `json:"default_branch"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, fmt.Errorf("could not decode push payload: %w", err)
+	}
+	return newPushEvent([]string{push.Ref}, push.Repository.DefaultBranch,
+		push.Repository.HTMLURL, push.Repository.CloneURL, push.Repository.SSHURL)
+}
+
+func parseGitlabPush(payload []byte) (*pushEvent, error) {
+	var push struct {
+		Ref     string `json:"ref"`
+		Project struct {
+			WebURL        string `json:"web_url"`
+			GitHTTPURL    string `json:"git_http_url"`
+			GitSSHURL     string `json:"git_ssh_url"`
+			DefaultBranch string `json:"default_branch"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, fmt.Errorf("could not decode push payload: %w", err)
+	}
+	return newPushEvent([]string{push.Ref}, push.Project.DefaultBranch,
+		push.Project.WebURL, push.Project.GitHTTPURL, push.Project.GitSSHURL)
+}
+
+func parseBitbucketPush(payload []byte) (*pushEvent, error) {
+	var push struct {
+		Push struct {
+			Changes []struct {
+				New *struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				} `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+		Repository struct {
+			Links struct {
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+			} `json:"links"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, fmt.Errorf("could not decode push payload: %w", err)
+	}
+	// a bitbucket push can update several branches and tags at once. Changes without a new state are deletions
+	var refs []string
+	for _, change := range push.Push.Changes {
+		if change.New != nil && change.New.Type == "tag" {
+			refs = append(refs, "refs/tags/"+change.New.Name)
+		} else if change.New != nil {
+			refs = append(refs, change.New.Name)
+		}
+	}
+	if len(refs) == 0 {
+		return nil, errors.New("push payload does not contain any updated branch or tag")
+	}
+	return newPushEvent(refs, "", push.Repository.Links.HTML.Href)
+}
+
+func newPushEvent(refs []string, defaultBranch string, repoURLs ...string) (*pushEvent, error) {
+	push := &pushEvent{defaultBranch: defaultBranch}
+	for _, ref := range refs {
+		if revision := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/"); revision != "" {
+			push.revisions = append(push.revisions, revision)
+			if strings.HasPrefix(ref, "refs/tags/") {
+				push.tags = append(push.tags, revision)
+			}
+		}
+	}
+	for _, repoURL := range repoURLs {
+		if repoURL != "" {
+			push.repoURLs = append(push.repoURLs, normalizeRepoURL(repoURL))
+		}
+	}
+	if len(push.revisions) == 0 || len(push.repoURLs) == 0 {
+		return nil, errors.New("push payload is missing the ref or repository url")
+	}
+	return push, nil
+}
+
+// Normalizes the different forms of a repository URL (https, ssh, scp-like ssh, with or without .git)
+// to host/path so they can be compared
+func normalizeRepoURL(repoURL string) string {
+	repoURL = strings.ToLower(strings.TrimSpace(repoURL))
+
+	// scp-like ssh urls, e.g. git@github.com:org/repo.git
+	if !strings.Contains(repoURL, "://") {
+		if at := strings.Index(repoURL, "@"); at >= 0 {
+			repoURL = repoURL[at+1:]
+		}
+		repoURL = strings.Replace(repoURL, ":", "/", 1)
+	} else if u, err := url.Parse(repoURL); err == nil {
+		repoURL = u.Hostname() + u.Path
+	}
+
+	repoURL = strings.TrimSuffix(repoURL, "/")
+	return strings.TrimSuffix(repoURL, ".git")
+}
@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestParsePushEvent(t *testing.T) {
+	secret := []byte("secret")
+	receiver := &PushWebhookReceiver{Secret: secret}
+
+	githubPayload := []byte(`{"ref":"refs/heads/main","repository":{"html_url":"https://github.com/Org/Repo","ssh_url":"git@github.com:Org/Repo.git","default_branch":"main"}}`)
+	gitlabPayload := []byte(`{"ref":"refs/tags/v1.0.0","project":{"web_url":"https://gitlab.com/org/repo"}}`)
+	bitbucketPayload := []byte(`{"push":{"changes":[{"new":{"type":"branch","name":"dev"}},{"old":{"type":"branch","name":"old"},"new":null},{"new":{"type":"tag","name":"v1.1.0"}}]},"repository":{"links":{"html":{"href":"https://bitbucket.org/org/repo"}}}}`)
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		payload   []byte
+		wantErr   bool
+		revisions []string
+		tags      []string
+		repoURL   string
+	}{
+		{
+			name:      "github",
+			header:    http.Header{"X-Github-Event": {"push"}, "X-Hub-Signature-256": {"sha256=" + sign(secret, githubPayload)}},
+			payload:   githubPayload,
+			revisions: []string{"main"},
+			repoURL:   "github.com/org/repo",
+		},
+		{
+			name:    "github with invalid signature",
+			header:  http.Header{"X-Github-Event": {"push"}, "X-Hub-Signature-256": {"sha256=" + sign([]byte("wrong"), githubPayload)}},
+			payload: githubPayload,
+			wantErr: true,
+		},
+		{
+			name:      "gitea",
+			header:    http.Header{"X-Gitea-Event": {"push"}, "X-Github-Event": {"push"}, "X-Gitea-Signature": {sign(secret, githubPayload)}},
+			payload:   githubPayload,
+			revisions: []string{"main"},
+			repoURL:   "github.com/org/repo",
+		},
+		{
+			name:      "gitlab",
+			header:    http.Header{"X-Gitlab-Event": {"Tag Push Hook"}, "X-Gitlab-Token": {"secret"}},
+			payload:   gitlabPayload,
+			revisions: []string{"v1.0.0"},
+			tags:      []string{"v1.0.0"},
+			repoURL:   "gitlab.com/org/repo",
+		},
+		{
+			name:    "gitlab with invalid token",
+			header:  http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {"wrong"}},
+			payload: gitlabPayload,
+			wantErr: true,
+		},
+		{
+			name:      "bitbucket",
+			header:    http.Header{"X-Event-Key": {"repo:push"}, "X-Hub-Signature": {"sha256=" + sign(secret, bitbucketPayload)}},
+			payload:   bitbucketPayload,
+			revisions: []string{"dev", "v1.1.0"},
+			tags:      []string{"v1.1.0"},
+			repoURL:   "bitbucket.org/org/repo",
+		},
+		{
+			name:    "unknown provider",
+			header:  http.Header{},
+			payload: githubPayload,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		push, err := receiver.parsePushEvent(tt.header, tt.payload)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if strings.Join(push.revisions, ",") != strings.Join(tt.revisions, ",") || strings.Join(push.tags, ",") != strings.Join(tt.tags, ",") || push.repoURLs[0] != tt.repoURL {
+			t.Errorf("%s: unexpected push event %+v", tt.name, push)
+		}
+	}
+}
+
+func TestPushEventMatchesRevision(t *testing.T) {
+	push := &pushEvent{revisions: []string{"main"}, defaultBranch: "main"}
+	for revision, want := range map[string]bool{
+		"":                true,
+		"HEAD":            true,
+		"main":            true,
+		"refs/heads/main": true,
+		"dev":             false,
+		"4f2a1c9":         false,
+	} {
+		if got := push.matchesRevision(revision); got != want {
+			t.Errorf("%q: expected %v, got %v", revision, want, got)
+		}
+	}
+}
+
+func TestPushEventMatchesSource(t *testing.T) {
+	push := &pushEvent{revisions: []string{"main"}, defaultBranch: "main"}
+	sources := []gitopsv1.ApplicationSource{
+		{RepoURL: "https://github.com/org/base", TargetRevision: "v1.0.0"},
+		{RepoURL: "https://github.com/org/overlays.git", TargetRevision: "main"},
+	}
+	if !push.matchesSource(sources, normalizeRepoURL("https://github.com/org/overlays")) {
+		t.Error("expected a push to the branch of the second source to match")
+	}
+	if push.matchesSource(sources, normalizeRepoURL("https://github.com/org/base")) {
+		t.Error("expected a push to another branch of the first source not to match")
+	}
+}
+
+func TestPushEventMatchesSemverConstraint(t *testing.T) {
+	push := &pushEvent{revisions: []string{"main", "v1.4.2", "v2.0.0-rc.1"}, tags: []string{"v1.4.2", "v2.0.0-rc.1"}}
+	for _, tc := range []struct {
+		source gitopsv1.ApplicationSource
+		want   bool
+	}{
+		{source: gitopsv1.ApplicationSource{TargetRevision: ">=1.4.0 <2.0.0"}, want: true},
+		{source: gitopsv1.ApplicationSource{TargetRevision: "1.4.x"}, want: true},
+		{source: gitopsv1.ApplicationSource{TargetRevision: "~1.3"}, want: false},
+		{source: gitopsv1.ApplicationSource{TargetRevision: "^2.0.0"}, want: false},
+		{source: gitopsv1.ApplicationSource{TargetRevision: "^2.0.0-0", IncludePrerelease: true}, want: true},
+	} {
+		tc.source.RepoURL = "https://github.com/org/repo"
+		if got := push.matchesSource([]gitopsv1.ApplicationSource{tc.source}, "github.com/org/repo"); got != tc.want {
+			t.Errorf("%q: expected %v, got %v", tc.source.TargetRevision, tc.want, got)
+		}
+	}
+
+	// a branch named like a version is not a tag
+	push = &pushEvent{revisions: []string{"1.4.2"}}
+	if push.matchesSemverConstraint("1.4.x", false) {
+		t.Error("expected a pushed branch not to match a semver constraint")
+	}
+}
+
+func TestNormalizeRepoURL(t *testing.T) {
+	for _, repoURL := range []string{
+		"https://github.com/org/repo",
+		"https://github.com/org/repo.git",
+		"https://github.com/org/repo/",
+		"git@github.com:org/repo.git",
+		"ssh://git@github.com/org/repo.git",
+	} {
+		if got := normalizeRepoURL(repoURL); got != "github.com/org/repo" {
+			t.Errorf("%s: got %s", repoURL, got)
+		}
+	}
+}
+
+func TestPushEventMatchesAnyRevision(t *testing.T) {
+	push := &pushEvent{revisions: []string{"dev", "v1.1.0"}}
+	for revision, want := range map[string]bool{
+		"dev":    true,
+		"v1.1.0": true,
+		"HEAD":   true,
+		"main":   false,
+	} {
+		if got := push.matchesRevision(revision); got != want {
+			t.Errorf("%q: expected %v, got %v", revision, want, got)
+		}
+	}
+}
+
+func TestPushWebhookReceiverRequiresSecret(t *testing.T) {
+	receiver := &PushWebhookReceiver{BindAddress: "127.0.0.1:0"}
+	if err := receiver.Start(context.Background()); err == nil {
+		t.Error("expected the receiver not to start without a secret")
+	}
+}
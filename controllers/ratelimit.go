@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v48/github"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	anonymousCredential string = "anonymous"
+
+	// github does not always say how long to back off for when a secondary rate limit is hit
+	defaultAbuseRetryAfter = time.Minute
+)
+
+// Identifies the credential (and with that the rate limit quota) used for github requests without exposing the token
+func credentialID(accessToken string) string {
+	if accessToken == "" {
+		return anonymousCredential
+	}
+	sum := sha256.Sum256([]byte(accessToken))
+	// the full hash, since the ID also keys cached responses that must never be served for another token
+	return "token-" + hex.EncodeToString(sum[:])
+}
+
+// githubRateLimits keeps track of credentials that hit a github rate limit.
+// The zero value is ready to use
+type githubRateLimits struct {
+	mu          sync.Mutex
+	pausedUntil map[string]time.Time
+}
+
+func (g *githubRateLimits) pause(credential string, until time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.pausedUntil == nil {
+		g.pausedUntil = make(map[string]time.Time)
+	}
+	if until.After(g.pausedUntil[credential]) {
+		g.pausedUntil[credential] = until
+	}
+}
+
+// Returns the time until which requests with the credential are paused, if they are
+func (g *githubRateLimits) paused(credential string) (time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	until, ok := g.pausedUntil[credential]
+	if !ok {
+		return time.Time{}, false
+	}
+	if time.Now().After(until) {
+		delete(g.pausedUntil, credential)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// If err is caused by a github rate limit, pauses all requests with the credential until the limit
+// resets and returns a result that requeues the application after the reset
+func (g *githubRateLimits) handleError(ctx context.Context, credential string, err error) (ctrl.Result, bool) {
+	var reset time.Time
+
+	var rateLimitErr *github.RateLimitError
+	var abuseErr *github.AbuseRateLimitError
+	switch {
+	case errors.As(err, &rateLimitErr):
+		reset = rateLimitErr.Rate.Reset.Time
+	case errors.As(err, &abuseErr):
+		retryAfter := defaultAbuseRetryAfter
+		if abuseErr.RetryAfter != nil {
+			retryAfter = *abuseErr.RetryAfter
+		}
+		reset = time.Now().Add(retryAfter)
+	default:
+		return ctrl.Result{}, false
+	}
+
+	log.FromContext(ctx).Info("Github rate limit exceeded, pausing requests", "credential", credential, "until", reset)
+	g.pause(credential, reset)
+	return requeueAt(reset), true
+}
+
+func requeueAt(t time.Time) ctrl.Result {
+	after := time.Until(t)
+	if after < time.Second {
+		after = time.Second
+	}
+	return ctrl.Result{RequeueAfter: after}
+}
+
+// rateLimitTransport records the remaining github API quota of a credential from the response headers
+type rateLimitTransport struct {
+	credential string
+	base       http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if remaining := resp.Header.Get("X-RateLimit-Remaining"); remaining != "" {
+		if n, err := strconv.Atoi(remaining); err == nil {
+			githubRateLimitRemaining.WithLabelValues(t.credential).Set(float64(n))
+		}
+	}
+	return resp, nil
+}
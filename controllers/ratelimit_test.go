@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v48/github"
+)
+
+func TestCredentialID(t *testing.T) {
+	if id := credentialID(""); id != anonymousCredential {
+		t.Errorf("expected requests without a token to be anonymous, got %s", id)
+	}
+	id := credentialID("ghp_secret")
+	if strings.Contains(id, "ghp_secret") {
+		t.Errorf("expected the token not to be part of its ID, got %s", id)
+	}
+	if id != credentialID("ghp_secret") || id == credentialID("ghp_other") {
+		t.Errorf("expected the ID to identify the token, got %s", id)
+	}
+	if len(id) != len("token-")+64 {
+		t.Errorf("expected the full sha256 of the token, got %s", id)
+	}
+}
+
+func TestGithubRateLimitsPause(t *testing.T) {
+	var limits githubRateLimits
+	if _, paused := limits.paused("token-a"); paused {
+		t.Fatal("expected credentials not to be paused initially")
+	}
+
+	until := time.Now().Add(time.Hour)
+	limits.pause("token-a", until)
+	// an earlier reset does not shorten the pause
+	limits.pause("token-a", time.Now().Add(time.Minute))
+	if got, paused := limits.paused("token-a"); !paused || !got.Equal(until) {
+		t.Errorf("expected token-a to be paused until %v, got %v (paused %v)", until, got, paused)
+	}
+	if _, paused := limits.paused("token-b"); paused {
+		t.Error("expected other credentials not to be paused")
+	}
+
+	limits.pause("token-b", time.Now().Add(-time.Second))
+	if _, paused := limits.paused("token-b"); paused {
+		t.Error("expected the pause to end at the reset")
+	}
+}
+
+func TestGithubRateLimitsHandleError(t *testing.T) {
+	ctx := context.Background()
+	retryAfter := 30 * time.Second
+	reset := time.Now().Add(10 * time.Minute)
+	rateLimitErr := &github.RateLimitError{
+		Rate:     github.Rate{Reset: github.Timestamp{Time: reset}},
+		Response: &http.Response{Request: &http.Request{Method: http.MethodGet}},
+	}
+
+	tests := []struct {
+		name    string
+		err     error
+		limited bool
+		after   time.Duration
+	}{
+		{name: "rate limit", err: fmt.Errorf("could not resolve revision: %w", rateLimitErr), limited: true, after: 10 * time.Minute},
+		{name: "abuse with retry after", err: &github.AbuseRateLimitError{RetryAfter: &retryAfter}, limited: true, after: retryAfter},
+		{name: "abuse without retry after", err: &github.AbuseRateLimitError{}, limited: true, after: defaultAbuseRetryAfter},
+		{name: "reset in the past", err: &github.RateLimitError{Rate: github.Rate{Reset: github.Timestamp{Time: time.Now().Add(-time.Minute)}}}, limited: true, after: time.Second},
+		{name: "other error", err: errors.New("not found")},
+	}
+	for _, tt := range tests {
+		var limits githubRateLimits
+		result, limited := limits.handleError(ctx, "token-a", tt.err)
+		if limited != tt.limited {
+			t.Errorf("%s: expected rate limited %v, got %v", tt.name, tt.limited, limited)
+			continue
+		}
+		_, paused := limits.paused("token-a")
+		if !tt.limited {
+			if paused || result.RequeueAfter != 0 {
+				t.Errorf("%s: expected no pause and no requeue, got paused %v and %v", tt.name, paused, result)
+			}
+			continue
+		}
+		// the requeue is at the reset, which is at least a second from now
+		if result.RequeueAfter > tt.after || result.RequeueAfter < tt.after-5*time.Second {
+			t.Errorf("%s: expected a requeue after about %v, got %v", tt.name, tt.after, result.RequeueAfter)
+		}
+		if wantPaused := tt.after > time.Second; paused != wantPaused {
+			t.Errorf("%s: expected paused %v, got %v", tt.name, wantPaused, paused)
+		}
+	}
+}
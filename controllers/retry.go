@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	defaultRetryLimit         int32 = 5
+	defaultRetryBackoff             = 5 * time.Second
+	defaultRetryBackoffFactor int32 = 2
+	defaultRetryMaxBackoff          = 3 * time.Minute
+)
+
+// Returns the retry limit and the backoff before the next attempt after the given number of failed attempts
+func retryBackoff(policy *gitopsv1.SyncPolicy, failedAttempts int32) (limit int32, backoff time.Duration) {
+	limit = defaultRetryLimit
+	backoff = defaultRetryBackoff
+	factor := defaultRetryBackoffFactor
+	maxBackoff := defaultRetryMaxBackoff
+
+	if policy != nil && policy.Retry != nil {
+		if policy.Retry.Limit != nil {
+			limit = *policy.Retry.Limit
+		}
+		if b := policy.Retry.Backoff; b != nil {
+			if b.Duration != nil {
+				backoff = b.Duration.Duration
+			}
+			if b.Factor != nil {
+				factor = *b.Factor
+			}
+			if b.MaxDuration != nil {
+				maxBackoff = b.MaxDuration.Duration
+			}
+		}
+	}
+
+	for i := int32(1); i < failedAttempts && backoff < maxBackoff; i++ {
+		backoff *= time.Duration(factor)
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return limit, backoff
+}
+
+// Records a failed sync attempt in the application status and requeues the application with
+// exponential backoff. Once the retry limit is reached the application is marked as stalled
+// and only requeued after its sync period, to check whether its sources moved to a new revision
+func (r *ApplicationReconciler) handleSyncError(ctx context.Context, app *gitopsv1.Application, syncErr error) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	app.Status.Sync.SyncStatus = gitopsv1.SyncStatusOutOfSync
+	app.Status.FailedSyncAttempts++
+	app.Status.LastSyncError = syncErr.Error()
+	app.Status.ReconciledAt = &metav1.Time{Time: time.Now()}
+
+	limit, backoff := retryBackoff(app.Spec.SyncPolicy, app.Status.FailedSyncAttempts)
+	stalled := limit >= 0 && app.Status.FailedSyncAttempts >= limit
+	if stalled {
+		meta.SetStatusCondition(&app.Status.Conditions, metav1.Condition{
+			Type:               gitopsv1.ConditionTypeStalled,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: app.Generation,
+			Reason:             "RetryLimitExceeded",
+			Message:            fmt.Sprintf("sync failed %d times: %s", app.Status.FailedSyncAttempts, syncErr),
+		})
+	}
+
+	if err := r.Status().Update(ctx, app); err != nil {
+		log.Error(err, fmt.Sprintf("could not update application %s", app.Name))
+		return ctrl.Result{}, err
+	}
+	r.updateParent(ctx, app)
+
+	if stalled {
+		log.Error(syncErr, "Sync failed and retries are exhausted, application is stalled", "attempts", app.Status.FailedSyncAttempts)
+		return r.requeueAfterSyncPeriod(app), nil
+	}
+	log.Error(syncErr, "Sync failed, retrying", "attempts", app.Status.FailedSyncAttempts, "backoff", backoff)
+	return ctrl.Result{RequeueAfter: backoff}, nil
+}
+
+// A stalled application is not synced again until its sources resolve to another revision than the one
+// its last attempt failed on, which resets its retries. Explicitly requested syncs are always run
+func skipStalledSync(app *gitopsv1.Application, revision string) bool {
+	if !meta.IsStatusConditionTrue(app.Status.Conditions, gitopsv1.ConditionTypeStalled) {
+		return false
+	}
+	if app.Operation == nil && revision == app.Status.LastAttemptedRevision {
+		return true
+	}
+	resetRetries(app)
+	return false
+}
+
+// Resets the retry state after the spec changed or a sync succeeded
+func resetRetries(app *gitopsv1.Application) {
+	app.Status.FailedSyncAttempts = 0
+	app.Status.LastSyncError = ""
+	meta.RemoveStatusCondition(&app.Status.Conditions, gitopsv1.ConditionTypeStalled)
+}
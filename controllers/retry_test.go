@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	limit := int32(-1)
+	factor := int32(3)
+	policy := &gitopsv1.SyncPolicy{Retry: &gitopsv1.RetryStrategy{
+		Limit: &limit,
+		Backoff: &gitopsv1.Backoff{
+			Duration:    &metav1.Duration{Duration: time.Second},
+			Factor:      &factor,
+			MaxDuration: &metav1.Duration{Duration: 20 * time.Second},
+		},
+	}}
+
+	for attempts, want := range map[int32]time.Duration{1: time.Second, 2: 3 * time.Second, 3: 9 * time.Second, 4: 20 * time.Second, 50: 20 * time.Second} {
+		gotLimit, got := retryBackoff(policy, attempts)
+		if gotLimit != -1 || got != want {
+			t.Errorf("attempt %d: expected backoff %s, got %s (limit %d)", attempts, want, got, gotLimit)
+		}
+	}
+
+	if gotLimit, got := retryBackoff(nil, 2); gotLimit != defaultRetryLimit || got != 2*defaultRetryBackoff {
+		t.Errorf("expected default retry strategy, got limit %d and backoff %s", gotLimit, got)
+	}
+}
+
+func TestSkipStalledSync(t *testing.T) {
+	newStalledApp := func() *gitopsv1.Application {
+		app := &gitopsv1.Application{}
+		app.Status.FailedSyncAttempts = 5
+		app.Status.LastAttemptedRevision = "abc"
+		meta.SetStatusCondition(&app.Status.Conditions, metav1.Condition{Type: gitopsv1.ConditionTypeStalled, Status: metav1.ConditionTrue, Reason: "RetryLimitExceeded"})
+		return app
+	}
+
+	app := newStalledApp()
+	if !skipStalledSync(app, "abc") {
+		t.Error("expected a stalled application not to be synced while its revision is unchanged")
+	}
+	if app.Status.FailedSyncAttempts != 5 {
+		t.Errorf("expected the retries not to be reset, got %d failed attempts", app.Status.FailedSyncAttempts)
+	}
+
+	app = newStalledApp()
+	if skipStalledSync(app, "def") {
+		t.Error("expected a stalled application to be synced once its revision changes")
+	}
+	if app.Status.FailedSyncAttempts != 0 || meta.FindStatusCondition(app.Status.Conditions, gitopsv1.ConditionTypeStalled) != nil {
+		t.Errorf("expected the retries to be reset, got %+v", app.Status)
+	}
+
+	app = newStalledApp()
+	app.Operation = &gitopsv1.Operation{}
+	if skipStalledSync(app, "abc") {
+		t.Error("expected explicitly requested syncs of stalled applications to be run")
+	}
+
+	if skipStalledSync(&gitopsv1.Application{}, "abc") {
+		t.Error("expected applications that are not stalled to be synced")
+	}
+}
@@ -0,0 +1,266 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/version"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+var (
+	// a version in a constraint, whose missing or wildcard components match anything, e.g. 1.4 or 1.x
+	partialVersionPattern = regexp.MustCompile(`^v?(\d+|[xX*])(?:\.(\d+|[xX*]))?(?:\.(\d+|[xX*]))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+	semverWildcardPattern = regexp.MustCompile(`^v?\d+(\.\d+)?\.[xX*]`)
+	semverOperators       = []string{">=", "<=", "!=", ">", "<", "=", "~", "^"}
+)
+
+// Sources that can list their tags, so that semver constraints can be resolved against them
+type tagLister interface {
+	listTags(ctx context.Context, source gitopsv1.ApplicationSource) ([]string, error)
+}
+
+// Target revisions are semver constraints if they start with an operator, contain a wildcard or consist of
+// several comparators, e.g. ~1.4, 1.x or ">=2.0.0 <3". Plain versions like v1.4.0 are tags
+func isSemverConstraint(targetRevision string) bool {
+	return targetRevision == "*" ||
+		strings.IndexAny(targetRevision, "~^<>=!") == 0 ||
+		strings.ContainsAny(targetRevision, " ,|") ||
+		semverWildcardPattern.MatchString(targetRevision)
+}
+
+// Lists the tags of a source and returns the latest one matching the semver constraint of its target revision
+func resolveSemverConstraint(ctx context.Context, client manifestSource, source gitopsv1.ApplicationSource) (string, error) {
+	lister, ok := client.(tagLister)
+	if !ok {
+		return "", fmt.Errorf("semver constraints are not supported for %s", source.RepoURL)
+	}
+	constraint, err := parseSemverConstraint(source.TargetRevision)
+	if err != nil {
+		return "", err
+	}
+	tags, err := lister.listTags(ctx, source)
+	if err != nil {
+		return "", fmt.Errorf("could not list tags: %w", err)
+	}
+	tag := constraint.latest(tags, source.IncludePrerelease)
+	if tag == "" {
+		return "", fmt.Errorf("no tag matches %s", source.TargetRevision)
+	}
+	return tag, nil
+}
+
+// A comparison with a version, e.g. >=1.4.0
+type semverComparator struct {
+	op      string
+	version *version.Version
+}
+
+// Alternatives separated by ||, each matching if all of its comparators match
+type semverConstraint [][]semverComparator
+
+func parseSemverConstraint(constraint string) (semverConstraint, error) {
+	var parsed semverConstraint
+	for _, alternative := range strings.Split(constraint, "||") {
+		fields := strings.FieldsFunc(alternative, func(r rune) bool { return r == ' ' || r == ',' })
+		comparators := []semverComparator{}
+		for i := 0; i < len(fields); i++ {
+			term := fields[i]
+			// allow a space between operator and version, e.g. >= 1.4
+			if isSemverOperator(term) && i+1 < len(fields) {
+				i++
+				term += fields[i]
+			}
+			expanded, err := expandSemverComparator(term)
+			if err != nil {
+				return nil, fmt.Errorf("invalid semver constraint %q: %w", constraint, err)
+			}
+			comparators = append(comparators, expanded...)
+		}
+		parsed = append(parsed, comparators)
+	}
+	return parsed, nil
+}
+
+func isSemverOperator(term string) bool {
+	for _, op := range semverOperators {
+		if term == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Turns a term with a partial version, a tilde or a caret into comparators with full versions,
+// e.g. ~1.4 into >=1.4.0 <1.5.0-0
+func expandSemverComparator(term string) ([]semverComparator, error) {
+	op := ""
+	for _, candidate := range semverOperators {
+		if strings.HasPrefix(term, candidate) {
+			op = candidate
+			break
+		}
+	}
+	match := partialVersionPattern.FindStringSubmatch(strings.TrimPrefix(term, op))
+	if match == nil {
+		return nil, fmt.Errorf("invalid version in %q", term)
+	}
+
+	// the number of components given before the first wildcard
+	var parts [3]uint
+	n := 0
+	for ; n < 3; n++ {
+		part, err := strconv.ParseUint(match[n+1], 10, 0)
+		if err != nil {
+			break
+		}
+		parts[n] = uint(part)
+	}
+	preRelease := ""
+	if n == 3 {
+		preRelease = match[4]
+	}
+	lower := semanticVersion(parts[0], parts[1], parts[2], preRelease)
+	// the first version after all versions matching the first n components, excluding its pre-releases
+	bump := func(n int) *version.Version {
+		switch n {
+		case 1:
+			return semanticVersion(parts[0]+1, 0, 0, "0")
+		case 2:
+			return semanticVersion(parts[0], parts[1]+1, 0, "0")
+		default:
+			return semanticVersion(parts[0], parts[1], parts[2]+1, "0")
+		}
+	}
+	atLeast := func(v *version.Version) []semverComparator { return []semverComparator{{">=", v}} }
+	between := func(min, max *version.Version) []semverComparator {
+		return []semverComparator{{">=", min}, {"<", max}}
+	}
+	anyVersion := []semverComparator{}
+
+	switch op {
+	case "", "=":
+		if n == 0 {
+			return anyVersion, nil
+		}
+		if n == 3 {
+			return []semverComparator{{"=", lower}}, nil
+		}
+		return between(lower, bump(n)), nil
+	case "!=":
+		if n < 3 {
+			return nil, fmt.Errorf("%s needs a full version", term)
+		}
+		return []semverComparator{{"!=", lower}}, nil
+	case ">":
+		if n == 0 {
+			return nil, fmt.Errorf("%s matches no version", term)
+		}
+		if n == 3 {
+			return []semverComparator{{">", lower}}, nil
+		}
+		return atLeast(bump(n)), nil
+	case ">=":
+		return atLeast(lower), nil
+	case "<":
+		if n == 0 {
+			return nil, fmt.Errorf("%s matches no version", term)
+		}
+		return []semverComparator{{"<", lower}}, nil
+	case "<=":
+		if n == 0 {
+			return anyVersion, nil
+		}
+		if n == 3 {
+			return []semverComparator{{"<=", lower}}, nil
+		}
+		return []semverComparator{{"<", bump(n)}}, nil
+	case "~":
+		// patch updates, or minor updates if only the major version is given
+		switch n {
+		case 0:
+			return anyVersion, nil
+		case 1:
+			return between(lower, bump(1)), nil
+		default:
+			return between(lower, bump(2)), nil
+		}
+	default: // ^
+		// updates that don't change the left-most non-zero component
+		switch {
+		case n == 0:
+			return anyVersion, nil
+		case parts[0] > 0 || n == 1:
+			return between(lower, bump(1)), nil
+		case parts[1] > 0 || n == 2:
+			return between(lower, bump(2)), nil
+		default:
+			return between(lower, bump(3)), nil
+		}
+	}
+}
+
+func (c semverComparator) matches(v *version.Version) bool {
+	switch c.op {
+	case "=":
+		return !v.LessThan(c.version) && !c.version.LessThan(v)
+	case "!=":
+		return v.LessThan(c.version) || c.version.LessThan(v)
+	case ">":
+		return c.version.LessThan(v)
+	case ">=":
+		return !v.LessThan(c.version)
+	case "<":
+		return v.LessThan(c.version)
+	default: // <=
+		return !c.version.LessThan(v)
+	}
+}
+
+// A version matches if it matches all comparators of any alternative. Pre-releases only match if they are
+// included, or if a comparator of the alternative has a pre-release of the same version
+func (c semverConstraint) matches(v *version.Version, includePrerelease bool) bool {
+	for _, comparators := range c {
+		matches, prereleaseAllowed := true, includePrerelease || v.PreRelease() == ""
+		for _, comparator := range comparators {
+			matches = matches && comparator.matches(v)
+			cv := comparator.version
+			if cv.PreRelease() != "" && cv.Major() == v.Major() && cv.Minor() == v.Minor() && cv.Patch() == v.Patch() {
+				prereleaseAllowed = true
+			}
+		}
+		if matches && prereleaseAllowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the tag with the highest version matching the constraint, ignoring tags that are not semantic
+// versions. Returns an empty string if no tag matches
+func (c semverConstraint) latest(tags []string, includePrerelease bool) string {
+	var latestTag string
+	var latestVersion *version.Version
+	for _, tag := range tags {
+		v, err := version.ParseSemantic(tag)
+		if err != nil || !c.matches(v, includePrerelease) {
+			continue
+		}
+		if latestVersion == nil || latestVersion.LessThan(v) {
+			latestTag, latestVersion = tag, v
+		}
+	}
+	return latestTag
+}
+
+func semanticVersion(major, minor, patch uint, preRelease string) *version.Version {
+	v := version.MustParseSemantic(fmt.Sprintf("%d.%d.%d", major, minor, patch))
+	if preRelease != "" {
+		v = v.WithPreRelease(preRelease)
+	}
+	return v
+}
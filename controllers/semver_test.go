@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestIsSemverConstraint(t *testing.T) {
+	for targetRevision, want := range map[string]bool{
+		"~1.4":           true,
+		"^2":             true,
+		">=2.0.0 <3":     true,
+		"1.x":            true,
+		"v1.4.*":         true,
+		"*":              true,
+		"1.2.0 || 1.3.0": true,
+		"v1.4.0":         false,
+		"1.4.0":          false,
+		"main":           false,
+		"HEAD":           false,
+		"release-1.x":    false,
+		"":               false,
+	} {
+		if got := isSemverConstraint(targetRevision); got != want {
+			t.Errorf("%q: expected %v, got %v", targetRevision, want, got)
+		}
+	}
+}
+
+func TestSemverConstraintLatest(t *testing.T) {
+	tags := []string{"v1.3.9", "v1.4.0", "v1.4.7", "v1.5.0-rc.1", "v1.5.0", "v1.10.2", "v2.0.0-beta.1", "v2.0.0", "v2.3.1", "v3.0.0", "latest", "0.1.0", "0.1.5", "0.2.0"}
+	for _, tc := range []struct {
+		constraint        string
+		includePrerelease bool
+		want              string
+	}{
+		{constraint: "~1.4", want: "v1.4.7"},
+		{constraint: "~1", want: "v1.10.2"},
+		{constraint: "^1.4", want: "v1.10.2"},
+		{constraint: "^0.1", want: "0.1.5"},
+		{constraint: "^0.1.0", want: "0.1.5"},
+		{constraint: ">=2.0.0 <3", want: "v2.3.1"},
+		{constraint: ">= 2.0.0, < 3", want: "v2.3.1"},
+		{constraint: "1.x", want: "v1.10.2"},
+		{constraint: "1.4", want: "v1.4.7"},
+		{constraint: "<=1.4", want: "v1.4.7"},
+		{constraint: ">1.4", want: "v3.0.0"},
+		{constraint: "*", want: "v3.0.0"},
+		{constraint: "~1.3 || ~1.4", want: "v1.4.7"},
+		{constraint: ">=1.5.0-rc.0 <1.5.0", want: "v1.5.0-rc.1"},
+		{constraint: "<1.5.0", want: "v1.4.7"},
+		{constraint: "<1.5.0", includePrerelease: true, want: "v1.5.0-rc.1"},
+		{constraint: "<2.0.0", includePrerelease: true, want: "v2.0.0-beta.1"},
+		{constraint: "^1", includePrerelease: true, want: "v1.10.2"},
+		{constraint: "<=2.0.0", includePrerelease: true, want: "v2.0.0"},
+		{constraint: "~4", want: ""},
+	} {
+		constraint, err := parseSemverConstraint(tc.constraint)
+		if err != nil {
+			t.Errorf("%s: %v", tc.constraint, err)
+			continue
+		}
+		if got := constraint.latest(tags, tc.includePrerelease); got != tc.want {
+			t.Errorf("%s (prerelease %v): expected %q, got %q", tc.constraint, tc.includePrerelease, tc.want, got)
+		}
+	}
+
+	for _, constraint := range []string{">", "~main", "!=1.4", ">=1.4 <"} {
+		if _, err := parseSemverConstraint(constraint); err == nil {
+			t.Errorf("%s: expected an error", constraint)
+		}
+	}
+}
+
+func TestResolveSemverConstraintOCI(t *testing.T) {
+	reg := &testRegistry{
+		repository: "manifests/app",
+		manifests:  map[string][]byte{},
+		blobs:      map[string][]byte{},
+		username:   "ci",
+		password:   "secret",
+		pageSize:   2,
+	}
+	server := httptest.NewTLSServer(reg)
+	defer server.Close()
+	for _, tag := range []string{"v1.4.0", "v1.4.3", "v1.5.0", "latest"} {
+		reg.push(tag)
+	}
+
+	repoSecret := &corev1.Secret{Data: map[string][]byte{
+		gitopsv1.RepoSecretUsernameKey: []byte("ci"),
+		gitopsv1.RepoSecretPasswordKey: []byte("secret"),
+	}}
+	ctx := context.Background()
+	registry := strings.TrimPrefix(server.URL, "https://")
+	source := gitopsv1.ApplicationSource{RepoURL: "oci://" + registry + "/manifests/app", TargetRevision: "~1.4"}
+
+	tag, err := resolveSemverConstraint(ctx, newOCIClient(repoSecret, server.Client()), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != "v1.4.3" {
+		t.Errorf("expected v1.4.3, got %s", tag)
+	}
+
+	source.RepoURL += ":v1.4.0"
+	if _, err := resolveSemverConstraint(ctx, newOCIClient(repoSecret, server.Client()), source); err == nil {
+		t.Error("expected an error for a reference with a tag")
+	}
+
+	bundle := gitopsv1.ApplicationSource{RepoURL: "https://example.com/app.tar.gz", TargetRevision: "~1.4"}
+	if _, err := resolveSemverConstraint(ctx, newBundleClient(nil, nil), bundle); err == nil {
+		t.Error("expected an error for a source without tags")
+	}
+}
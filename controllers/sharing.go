@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	// reason of the SharedResource condition of the application that targets resources managed by another one
+	reasonManagedByOtherApplication = "ManagedByOtherApplication"
+	// reason of the SharedResource condition of the application managing the resources
+	reasonTargetedByOtherApplication = "TargetedByOtherApplication"
+)
+
+// Returns the application tracking an object and whether that is another existing application than app.
+// Objects tracked by applications that no longer exist are orphaned and can be adopted, in that case the
+// tracking id of the deleted application is returned with false. The owner is read from the API server, as
+// an application missing from the cache may just have been created
+func (r *ApplicationReconciler) managedByOther(ctx context.Context, obj client.Object, app *gitopsv1.Application) (string, bool, error) {
+	owner, other := trackedByOther(obj, app)
+	if !other {
+		return "", false, nil
+	}
+	key, ok := parseTrackingID(owner)
+	if !ok {
+		// no application can have this tracking id
+		return owner, false, nil
+	}
+	var reader client.Reader = r.Client
+	if r.APIReader != nil {
+		reader = r.APIReader
+	}
+	if err := reader.Get(ctx, key, &gitopsv1.Application{}); err != nil {
+		if errors.IsNotFound(err) {
+			return owner, false, nil
+		}
+		return "", false, err
+	}
+	return owner, true, nil
+}
+
+func parseTrackingID(id string) (types.NamespacedName, bool) {
+	namespace, name, ok := strings.Cut(id, "/")
+	return types.NamespacedName{Namespace: namespace, Name: name}, ok && namespace != "" && name != ""
+}
+
+// Marks a resource as shared with the application managing it
+func markShared(resource *gitopsv1.Resource, owner string) {
+	resource.Status = gitopsv1.SyncStatusOutOfSync
+	resource.Warning = &gitopsv1.ResourceWarning{
+		Type:      gitopsv1.ResourceWarningSharedResource,
+		Message:   fmt.Sprintf("managed by application %s, not applied", owner),
+		ManagedBy: owner,
+	}
+}
+
+// Returns the resources that are shared with other applications by the application managing them
+func sharedResources(resources []gitopsv1.Resource) map[string][]gitopsv1.Resource {
+	shared := make(map[string][]gitopsv1.Resource)
+	for _, resource := range resources {
+		if resource.Warning != nil && resource.Warning.Type == gitopsv1.ResourceWarningSharedResource {
+			shared[resource.Warning.ManagedBy] = append(shared[resource.Warning.ManagedBy], resource)
+		}
+	}
+	return shared
+}
+
+// Sets or clears the SharedResource condition of an application targeting resources managed by other applications
+func setSharedResourceCondition(app *gitopsv1.Application, shared map[string][]gitopsv1.Resource) {
+	if len(shared) == 0 {
+		if condition := meta.FindStatusCondition(app.Status.Conditions, gitopsv1.ConditionTypeSharedResource); condition != nil && condition.Reason == reasonManagedByOtherApplication {
+			meta.RemoveStatusCondition(&app.Status.Conditions, gitopsv1.ConditionTypeSharedResource)
+		}
+		return
+	}
+
+	var owners []string
+	for owner := range shared {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	var messages []string
+	for _, owner := range owners {
+		messages = append(messages, fmt.Sprintf("%s managed by application %s", describeResources(shared[owner]), owner))
+	}
+	meta.SetStatusCondition(&app.Status.Conditions, metav1.Condition{
+		Type:               gitopsv1.ConditionTypeSharedResource,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: app.Generation,
+		Reason:             reasonManagedByOtherApplication,
+		Message:            strings.Join(messages, "; "),
+	})
+}
+
+// Raises the SharedResource condition on the applications managing resources that app also targets and
+// clears it on the applications app no longer shares resources with. Failures are only logged, they don't
+// affect the sync of app
+func (r *ApplicationReconciler) updateSharedResourceOwners(ctx context.Context, app *gitopsv1.Application, previous, current map[string][]gitopsv1.Resource) {
+	log := log.FromContext(ctx)
+
+	for owner, resources := range current {
+		message := fmt.Sprintf("%s also targeted by application %s", describeResources(resources), trackingID(app))
+		err := r.patchOwnerCondition(ctx, owner, func(conditions *[]metav1.Condition, generation int64) {
+			meta.SetStatusCondition(conditions, metav1.Condition{
+				Type:               gitopsv1.ConditionTypeSharedResource,
+				Status:             metav1.ConditionTrue,
+				ObservedGeneration: generation,
+				Reason:             reasonTargetedByOtherApplication,
+				Message:            message,
+			})
+		})
+		if err != nil {
+			log.Error(err, fmt.Sprintf("could not set %s condition of application %s", gitopsv1.ConditionTypeSharedResource, owner))
+		}
+	}
+
+	for owner := range previous {
+		if _, ok := current[owner]; ok {
+			continue
+		}
+		err := r.patchOwnerCondition(ctx, owner, func(conditions *[]metav1.Condition, generation int64) {
+			// another application may have raised the condition since
+			condition := meta.FindStatusCondition(*conditions, gitopsv1.ConditionTypeSharedResource)
+			if condition != nil && condition.Reason == reasonTargetedByOtherApplication &&
+				strings.HasSuffix(condition.Message, "application "+trackingID(app)) {
+				meta.RemoveStatusCondition(conditions, gitopsv1.ConditionTypeSharedResource)
+			}
+		})
+		if err != nil {
+			log.Error(err, fmt.Sprintf("could not clear %s condition of application %s", gitopsv1.ConditionTypeSharedResource, owner))
+		}
+	}
+}
+
+func (r *ApplicationReconciler) patchOwnerCondition(ctx context.Context, owner string, update func(conditions *[]metav1.Condition, generation int64)) error {
+	key, ok := parseTrackingID(owner)
+	if !ok {
+		return fmt.Errorf("invalid tracking id %q", owner)
+	}
+	var ownerApp gitopsv1.Application
+	if err := r.Get(ctx, key, &ownerApp); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	patch := client.MergeFrom(ownerApp.DeepCopy())
+	update(&ownerApp.Status.Conditions, ownerApp.Generation)
+	return r.Status().Patch(ctx, &ownerApp, patch)
+}
+
+func describeResources(resources []gitopsv1.Resource) string {
+	first := resources[0]
+	name := first.Name
+	if first.Namespace != "" {
+		name = first.Namespace + "/" + name
+	}
+	if len(resources) > 1 {
+		return fmt.Sprintf("%s %s and %d more are", first.Kind, name, len(resources)-1)
+	}
+	return fmt.Sprintf("%s %s is", first.Kind, name)
+}
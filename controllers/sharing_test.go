@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestSharedResources(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = gitopsv1.AddToScheme(scheme)
+
+	owner := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "owner", Namespace: "apps"}}
+	app := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}}
+	deleted := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: "apps"}}
+
+	shared := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "default"}}
+	setTracking(shared, owner)
+	abandoned := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "abandoned", Namespace: "default"}}
+	setTracking(abandoned, deleted)
+
+	r := &ApplicationReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(owner, app).Build(), Scheme: scheme}
+	ctx := context.Background()
+
+	if got, other, err := r.managedByOther(ctx, shared, app); err != nil || !other || got != "apps/owner" {
+		t.Fatalf("expected %s to be managed by apps/owner, got %q %v %v", shared.Name, got, other, err)
+	}
+	if got, other, err := r.managedByOther(ctx, abandoned, app); err != nil || other || got != "apps/deleted" {
+		t.Fatalf("expected %s to be orphaned by apps/deleted, got %q %v %v", abandoned.Name, got, other, err)
+	}
+	invalid := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "invalid", Namespace: "default", Annotations: map[string]string{trackingAnnotation: "invalid"}}}
+	if got, other, err := r.managedByOther(ctx, invalid, app); err != nil || other || got != "invalid" {
+		t.Fatalf("expected %s to be orphaned, got %q %v %v", invalid.Name, got, other, err)
+	}
+	if got, other, err := r.managedByOther(ctx, &corev1.ConfigMap{}, app); err != nil || other || got != "" {
+		t.Fatalf("expected untracked objects not to be orphaned, got %q %v %v", got, other, err)
+	}
+
+	// an owner missing from the cache is read from the API server
+	newOwner := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "apps"}}
+	uncached := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "uncached", Namespace: "default"}}
+	setTracking(uncached, newOwner)
+	withReader := &ApplicationReconciler{Client: r.Client, APIReader: fake.NewClientBuilder().WithScheme(scheme).WithObjects(newOwner).Build(), Scheme: scheme}
+	if got, other, err := withReader.managedByOther(ctx, uncached, app); err != nil || !other || got != "apps/new" {
+		t.Fatalf("expected %s to be managed by apps/new, got %q %v %v", uncached.Name, got, other, err)
+	}
+
+	resource := gitopsv1.Resource{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "shared"}
+	markShared(&resource, "apps/owner")
+	current := sharedResources([]gitopsv1.Resource{resource, {Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "other"}})
+	if len(current) != 1 || len(current["apps/owner"]) != 1 {
+		t.Fatalf("unexpected shared resources %v", current)
+	}
+
+	setSharedResourceCondition(app, current)
+	if !meta.IsStatusConditionTrue(app.Status.Conditions, gitopsv1.ConditionTypeSharedResource) {
+		t.Errorf("expected %s condition on app", gitopsv1.ConditionTypeSharedResource)
+	}
+	r.updateSharedResourceOwners(ctx, app, nil, current)
+	if err := r.Get(ctx, client.ObjectKeyFromObject(owner), owner); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(owner.Status.Conditions, gitopsv1.ConditionTypeSharedResource)
+	if condition == nil || condition.Message != "ConfigMap default/shared is also targeted by application apps/app" {
+		t.Fatalf("unexpected condition on owner %v", condition)
+	}
+
+	// the conflict was resolved
+	setSharedResourceCondition(app, nil)
+	if meta.FindStatusCondition(app.Status.Conditions, gitopsv1.ConditionTypeSharedResource) != nil {
+		t.Errorf("expected %s condition to be removed from app", gitopsv1.ConditionTypeSharedResource)
+	}
+	r.updateSharedResourceOwners(ctx, app, current, nil)
+	if err := r.Get(ctx, client.ObjectKeyFromObject(owner), owner); err != nil {
+		t.Fatal(err)
+	}
+	if meta.FindStatusCondition(owner.Status.Conditions, gitopsv1.ConditionTypeSharedResource) != nil {
+		t.Errorf("expected %s condition to be removed from owner", gitopsv1.ConditionTypeSharedResource)
+	}
+}
@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	sopsjson "github.com/getsops/sops/v3/stores/json"
+	sopsyaml "github.com/getsops/sops/v3/stores/yaml"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// top-level field holding the metadata of SOPS-encrypted documents
+	sopsMetadataField = "sops"
+
+	// annotations of SOPS-encrypted objects with the file they were read from and their index among the objects
+	// of the file. The MAC of SOPS covers all documents of a file, so the whole file is decrypted
+	sopsFileAnnotation     = "gitops.jellis18.gitopscontroller.io/sops-file"
+	sopsDocumentAnnotation = "gitops.jellis18.gitopscontroller.io/sops-document"
+
+	// suffixes of the entries of the decryption secret holding age identities and armored PGP private keys
+	sopsAgeKeySuffix = ".agekey"
+	sopsPGPKeySuffix = ".asc"
+)
+
+// Private keys the data keys of SOPS files can be decrypted with
+type sopsKeys struct {
+	age []age.Identity
+	pgp openpgp.EntityList
+}
+
+// Records the encrypted file an object was read from, if it is encrypted with SOPS
+func setSOPSFile(obj *unstructured.Unstructured, file []byte, index int) {
+	if !isSOPSEncrypted(obj) {
+		return
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[sopsFileAnnotation] = string(file)
+	annotations[sopsDocumentAnnotation] = strconv.Itoa(index)
+	obj.SetAnnotations(annotations)
+}
+
+func isSOPSEncrypted(obj *unstructured.Unstructured) bool {
+	metadata, ok := obj.Object[sopsMetadataField].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, hasMAC := metadata["mac"]
+	return hasMAC
+}
+
+// Decrypts the SOPS-encrypted objects among the target objects in place. Each encrypted file is decrypted
+// once and its MAC is verified. The keys are only read if there is an encrypted object. Decrypted values
+// are never part of errors, so they don't end up in logs or the status
+func (r *ApplicationReconciler) decryptObjects(ctx context.Context, objs []*unstructured.Unstructured) error {
+	var files []string
+	objsPerFile := make(map[string][]*unstructured.Unstructured)
+	for _, obj := range objs {
+		file, ok := obj.GetAnnotations()[sopsFileAnnotation]
+		if !ok {
+			continue
+		}
+		if _, ok := objsPerFile[file]; !ok {
+			files = append(files, file)
+		}
+		objsPerFile[file] = append(objsPerFile[file], obj)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	keys, err := r.getDecryptionKeys(ctx)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		encrypted := objsPerFile[file]
+		if err := decryptSOPSFile([]byte(file), encrypted, keys); err != nil {
+			return fmt.Errorf("could not decrypt %s %s: %w", encrypted[0].GetKind(), describeObject(encrypted[0]), err)
+		}
+	}
+	return nil
+}
+
+// Reads the age identities and PGP private keys from the decryption secret of the controller
+func (r *ApplicationReconciler) getDecryptionKeys(ctx context.Context) (*sopsKeys, error) {
+	if r.DecryptionSecret.Name == "" {
+		return nil, fmt.Errorf("manifests are encrypted with SOPS, but no decryption keys are configured")
+	}
+	var secret corev1.Secret
+	if err := r.Get(ctx, r.DecryptionSecret, &secret); err != nil {
+		return nil, fmt.Errorf("could not get decryption keys: %w", err)
+	}
+	return parseSOPSKeys(secret.Data)
+}
+
+func parseSOPSKeys(data map[string][]byte) (*sopsKeys, error) {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := &sopsKeys{}
+	for _, name := range names {
+		switch {
+		case strings.HasSuffix(name, sopsAgeKeySuffix):
+			identities, err := age.ParseIdentities(bytes.NewReader(data[name]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid age identity %s: %w", name, err)
+			}
+			keys.age = append(keys.age, identities...)
+		case strings.HasSuffix(name, sopsPGPKeySuffix):
+			entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data[name]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid PGP key %s: %w", name, err)
+			}
+			keys.pgp = append(keys.pgp, entities...)
+		}
+	}
+	if len(keys.age) == 0 && len(keys.pgp) == 0 {
+		return nil, fmt.Errorf("no decryption keys found, expected entries ending in %s or %s", sopsAgeKeySuffix, sopsPGPKeySuffix)
+	}
+	return keys, nil
+}
+
+// Decrypts a file and replaces the objects read from it with their decrypted version. The namespace
+// the objects were defaulted to is kept
+func decryptSOPSFile(file []byte, objs []*unstructured.Unstructured, keys *sopsKeys) error {
+	plaintext, err := decryptSOPSData(file, keys)
+	if err != nil {
+		return err
+	}
+	decrypted, err := getResourcesFromYAMLOrJSON(bytes.NewReader(plaintext), "")
+	if err != nil {
+		return fmt.Errorf("could not read the decrypted file")
+	}
+	for _, obj := range objs {
+		index, err := strconv.Atoi(obj.GetAnnotations()[sopsDocumentAnnotation])
+		if err != nil || index < 0 || index >= len(decrypted) {
+			return fmt.Errorf("the decrypted file has no document %s", obj.GetAnnotations()[sopsDocumentAnnotation])
+		}
+		namespace := obj.GetNamespace()
+		popOrigin(decrypted[index])
+		obj.Object = decrypted[index].DeepCopy().Object
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+	}
+	return nil
+}
+
+// Decrypts a file like sops -d: the data key is decrypted with one of the keys, then the values, and the
+// MAC over all values is checked, so values can't be removed, reordered or swapped between files
+func decryptSOPSData(file []byte, keys *sopsKeys) ([]byte, error) {
+	var store sops.Store = sopsyaml.NewStore(&config.YAMLStoreConfig{})
+	if isJSONManifest(file) {
+		store = sopsjson.NewStore(&config.JSONStoreConfig{})
+	}
+	tree, err := store.LoadEncryptedFile(file)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := tree.Metadata.GetDataKeyWithKeyServices([]keyservice.KeyServiceClient{sopsKeyService{keys: keys}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("none of the decryption keys can decrypt the data key: %w", err)
+	}
+
+	// errors of the decryption can contain decrypted values, so they must not be returned
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(dataKey, cipher)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the values of the file")
+	}
+	originalMAC, err := cipher.Decrypt(tree.Metadata.MessageAuthenticationCode, dataKey, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil || originalMAC != mac {
+		return nil, fmt.Errorf("the MAC does not match the values of the file")
+	}
+	return store.EmitPlainFile(tree.Branches)
+}
+
+// A keyservice decrypting data keys with the keys of the decryption secret. SOPS otherwise only reads keys
+// from the environment and the file system of the controller
+type sopsKeyService struct {
+	keys *sopsKeys
+}
+
+func (s sopsKeyService) Encrypt(context.Context, *keyservice.EncryptRequest, ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return nil, fmt.Errorf("encryption is not supported")
+}
+
+func (s sopsKeyService) Decrypt(_ context.Context, req *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	var plaintext []byte
+	var err error
+	switch key := req.GetKey().GetKeyType().(type) {
+	case *keyservice.Key_AgeKey:
+		plaintext, err = decryptAge(req.GetCiphertext(), s.keys.age)
+	case *keyservice.Key_PgpKey:
+		plaintext, err = decryptPGP(req.GetCiphertext(), s.keys.pgp)
+	default:
+		err = fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+func decryptAge(armored []byte, identities []age.Identity) ([]byte, error) {
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no age identities configured")
+	}
+	r, err := age.Decrypt(agearmor.NewReader(bytes.NewReader(armored)), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func decryptPGP(armored []byte, keyring openpgp.EntityList) ([]byte, error) {
+	block, err := armor.Decode(bytes.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(md.UnverifiedBody)
+}
@@ -0,0 +1,351 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/pgp"
+	sopsjson "github.com/getsops/sops/v3/stores/json"
+	sopsyaml "github.com/getsops/sops/v3/stores/yaml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func pgpEncrypt(t *testing.T, entity *openpgp.Entity, plaintext []byte) string {
+	// keys made by openpgp.NewEntity have no hash preferences, which defaults to the unavailable RIPEMD-160
+	for _, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8} // SHA-256
+	}
+	var buf bytes.Buffer
+	armored, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := openpgp.Encrypt(armored, openpgp.EntityList{entity}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(plaintext)
+	w.Close()
+	armored.Close()
+	return buf.String()
+}
+
+func pgpPrivateKey(t *testing.T, entity *openpgp.Entity) string {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.String()
+}
+
+// A master key of an age recipient with the data key encrypted to it
+func ageMasterKey(t *testing.T, identity *age.X25519Identity, dataKey []byte) keys.MasterKey {
+	key, err := sopsage.MasterKeyFromRecipient(identity.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Encrypt(dataKey); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// A master key of a PGP key with the data key encrypted to it. sops can only encrypt to keys of a keyring file
+func pgpMasterKey(t *testing.T, entity *openpgp.Entity, dataKey []byte) keys.MasterKey {
+	return &pgp.MasterKey{
+		Fingerprint:  strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint)),
+		EncryptedKey: pgpEncrypt(t, entity, dataKey),
+		CreationDate: time.Now().UTC(),
+	}
+}
+
+// Encrypts the data and stringData of a manifest file like sops -e --encrypted-regex '^(data|stringData|spec)$'
+func sopsEncryptFile(t *testing.T, plaintext string, dataKey []byte, masterKeys ...keys.MasterKey) []byte {
+	var store sops.Store = sopsyaml.NewStore(&config.YAMLStoreConfig{})
+	if isJSONManifest([]byte(plaintext)) {
+		store = sopsjson.NewStore(&config.JSONStoreConfig{})
+	}
+	branches, err := store.LoadPlainFile([]byte(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			EncryptedRegex: "^(data|stringData|spec)$",
+			Version:        "3.9.4",
+			KeyGroups:      []sops.KeyGroup{masterKeys},
+		},
+	}
+	cipher := aes.NewCipher()
+	mac, err := tree.Encrypt(dataKey, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Metadata.LastModified = time.Now().UTC()
+	if tree.Metadata.MessageAuthenticationCode, err = cipher.Encrypt(mac, dataKey, tree.Metadata.LastModified.Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := store.EmitEncryptedFile(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+// Reads the objects of a file like the controller does before decrypting them
+func readObjects(t *testing.T, file []byte, namespace string) []*unstructured.Unstructured {
+	objs, err := getResourcesFromYAMLOrJSON(bytes.NewReader(file), "secrets.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range objs {
+		popOrigin(obj)
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+	}
+	return objs
+}
+
+const sopsTestManifests = `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+data:
+  password: aHVudGVyMg==
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: web
+spec:
+  replicas: 3
+  paused: false
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx
+`
+
+func TestDecryptSOPSFile(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseSOPSKeys(map[string][]byte{"ci.agekey": []byte("# created: 2024-01-01\n" + identity.String() + "\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := randomBytes(t, 32)
+	file := sopsEncryptFile(t, sopsTestManifests, dataKey, ageMasterKey(t, identity, dataKey))
+
+	objs := readObjects(t, file, "apps")
+	if len(objs) != 2 || !isSOPSEncrypted(objs[0]) || !isSOPSEncrypted(objs[1]) {
+		t.Fatalf("expected two encrypted objects, got %v", objs)
+	}
+	if password, _, _ := unstructured.NestedString(objs[0].Object, "data", "password"); !strings.HasPrefix(password, "ENC[") {
+		t.Fatalf("expected the password to be encrypted, got %q", password)
+	}
+	if err := decryptSOPSFile(file, objs, keys); err != nil {
+		t.Fatal(err)
+	}
+	if password, _, _ := unstructured.NestedString(objs[0].Object, "data", "password"); password != "aHVudGVyMg==" {
+		t.Errorf("expected the password to be decrypted, got %q", password)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(objs[1].Object, "spec", "replicas"); replicas != 3 {
+		t.Errorf("expected 3 replicas, got %d", replicas)
+	}
+	if paused, ok, _ := unstructured.NestedBool(objs[1].Object, "spec", "paused"); !ok || paused {
+		t.Error("expected paused to be false")
+	}
+	if objs[0].GetNamespace() != "apps" || objs[1].GetNamespace() != "web" {
+		t.Errorf("expected the namespaces to be kept, got %s and %s", objs[0].GetNamespace(), objs[1].GetNamespace())
+	}
+	for _, obj := range objs {
+		if _, ok := obj.Object[sopsMetadataField]; ok {
+			t.Error("expected the sops metadata to be removed")
+		}
+		if len(obj.GetAnnotations()) != 0 {
+			t.Errorf("expected the annotations to be removed, got %v", obj.GetAnnotations())
+		}
+	}
+
+	// removing a document invalidates the MAC, although every remaining value can be decrypted
+	truncated := file[:bytes.Index(file, []byte("\n---\n"))+1]
+	err = decryptSOPSFile(truncated, readObjects(t, truncated, "apps"), keys)
+	if err == nil || !strings.Contains(err.Error(), "MAC") {
+		t.Errorf("expected a MAC error for the truncated file, got %v", err)
+	}
+
+	// a value moved to another path must not decrypt
+	moved := bytes.Replace(file, []byte("password:"), []byte("token:"), 1)
+	if err := decryptSOPSFile(moved, readObjects(t, moved, "apps"), keys); err == nil {
+		t.Error("expected an error for the moved value")
+	}
+
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeys, err := parseSOPSKeys(map[string][]byte{"other.agekey": []byte(other.String())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptSOPSFile(file, readObjects(t, file, "apps"), otherKeys); err == nil {
+		t.Error("expected an error for a data key encrypted to another identity")
+	}
+
+	json := sopsEncryptFile(t, `{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "json"}, "stringData": {"token": "s3cr3t"}}`, dataKey, ageMasterKey(t, identity, dataKey))
+	objs = readObjects(t, json, "apps")
+	if err := decryptSOPSFile(json, objs, keys); err != nil {
+		t.Fatal(err)
+	}
+	if token, _, _ := unstructured.NestedString(objs[0].Object, "stringData", "token"); token != "s3cr3t" {
+		t.Errorf("expected the token of the json file to be decrypted, got %q", token)
+	}
+
+	corrupted := identity.String()[:len(identity.String())-1] + "Q"
+	if strings.HasSuffix(identity.String(), "Q") {
+		corrupted = identity.String()[:len(identity.String())-1] + "P"
+	}
+	for name, data := range map[string]map[string][]byte{
+		"no keys":          {"README": []byte("keys for ci")},
+		"invalid identity": {"ci.agekey": []byte("AGE-SECRET-KEY-1INVALID")},
+		"invalid checksum": {"ci.agekey": []byte(corrupted)},
+	} {
+		if _, err := parseSOPSKeys(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDecryptObjects(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity, _ := newGPGKey(t)
+	keys := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "gitops-system"},
+		Data: map[string][]byte{
+			"ci.agekey": []byte(identity.String()),
+			"ci.asc":    []byte(pgpPrivateKey(t, entity)),
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(keys).Build()
+	r := &ApplicationReconciler{Client: c, DecryptionSecret: types.NamespacedName{Namespace: "gitops-system", Name: "sops-keys"}}
+	ctx := context.Background()
+
+	ageKey, pgpKey := randomBytes(t, 32), randomBytes(t, 32)
+	secret := func(name, password string) string {
+		return "apiVersion: v1\nkind: Secret\nmetadata:\n  name: " + name + "\ndata:\n  password: " + password + "\n"
+	}
+	plain := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "settings", "namespace": "default"},
+		"data":       map[string]interface{}{"mode": "ENC[not encrypted]"},
+	}}
+	objs := append(readObjects(t, sopsEncryptFile(t, secret("age", "YWdl"), ageKey, ageMasterKey(t, identity, ageKey)), "default"),
+		readObjects(t, sopsEncryptFile(t, secret("pgp", "cGdw"), pgpKey, pgpMasterKey(t, entity, pgpKey)), "default")...)
+	objs = append(objs, plain)
+	if err := r.decryptObjects(ctx, objs); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"YWdl", "cGdw", ""} {
+		if password, _, _ := unstructured.NestedString(objs[i].Object, "data", "password"); password != want {
+			t.Errorf("%s: expected password %q, got %q", objs[i].GetName(), want, password)
+		}
+	}
+	if mode, _, _ := unstructured.NestedString(plain.Object, "data", "mode"); mode != "ENC[not encrypted]" {
+		t.Errorf("expected objects without sops metadata to be left alone, got %q", mode)
+	}
+
+	// the plaintext must not be part of errors, e.g. if it doesn't match the type of the value
+	file := sopsEncryptFile(t, secret("tampered", "c2VjcmV0"), ageKey, ageMasterKey(t, identity, ageKey))
+	tampered := bytes.Replace(file, []byte("type:str]"), []byte("type:int]"), 1)
+	err = r.decryptObjects(ctx, readObjects(t, tampered, "default"))
+	if err == nil || strings.Contains(err.Error(), "c2VjcmV0") || !strings.Contains(err.Error(), "default/tampered") {
+		t.Errorf("expected an error without the plaintext, got %v", err)
+	}
+
+	unconfigured := &ApplicationReconciler{Client: c}
+	if err := unconfigured.decryptObjects(ctx, []*unstructured.Unstructured{plain}); err != nil {
+		t.Errorf("expected no keys to be needed without encrypted objects, got %v", err)
+	}
+	encrypted := readObjects(t, file, "default")
+	if err := unconfigured.decryptObjects(ctx, encrypted); err == nil {
+		t.Error("expected an error without decryption keys")
+	}
+	missing := &ApplicationReconciler{Client: c, DecryptionSecret: types.NamespacedName{Namespace: "gitops-system", Name: "missing"}}
+	if err := missing.decryptObjects(ctx, encrypted); err == nil {
+		t.Error("expected an error for a missing decryption secret")
+	}
+}
+
+func TestDecryptObjectsBeforeMerging(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "gitops-system"},
+		Data:       map[string][]byte{"ci.agekey": []byte(identity.String())},
+	}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(keys).Build()
+	r := &ApplicationReconciler{Client: c, DecryptionSecret: types.NamespacedName{Namespace: "gitops-system", Name: "sops-keys"}}
+	ctx := context.Background()
+
+	// the base source holds the encrypted password, the overlay repeats it in plaintext and adds a user
+	dataKey := randomBytes(t, 32)
+	base := readObjects(t, sopsEncryptFile(t, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\ndata:\n  password: YWdl\n",
+		dataKey, ageMasterKey(t, identity, dataKey)), "default")
+	overlay := readObjects(t, []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\ndata:\n  password: YWdl\n  user: YWRtaW4=\n"), "default")
+	for _, objs := range [][]*unstructured.Unstructured{base, overlay} {
+		if err := r.decryptObjects(ctx, objs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	merged, err := mergeSourceObjects([][]*unstructured.Unstructured{base, overlay})
+	if err != nil {
+		t.Fatalf("expected the decrypted objects to merge without conflicts, got %v", err)
+	}
+	data, _, _ := unstructured.NestedStringMap(merged[0].Object, "data")
+	if len(merged) != 1 || data["password"] != "YWdl" || data["user"] != "YWRtaW4=" {
+		t.Errorf("expected the fields of both sources, got %v", data)
+	}
+}
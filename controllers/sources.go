@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+// Fetches manifests from the kind of storage a source points to
+type manifestSource interface {
+	// Resolves the target revision of a source to an immutable revision, e.g. a commit SHA. The last synced
+	// revision is passed along so that unchanged revisions can be answered cheaply
+	resolveRevision(ctx context.Context, source gitopsv1.ApplicationSource, lastRevision string) (string, error)
+
+	// Fetches the manifests of a source at a resolved revision
+	getRepoObjs(ctx context.Context, source gitopsv1.ApplicationSource, revision string) ([]*unstructured.Unstructured, error)
+}
+
+// A source of an application with the client for its storage and the revision its target revision resolved to
+type resolvedSource struct {
+	gitopsv1.ApplicationSource
+	client manifestSource
+	// identifies the github credential for rate limiting, empty for other kinds of sources
+	credential string
+	revision   string
+	// tag a semver constraint in the target revision resolved to
+	tag string
+}
+
+// The revision of an application is the revision of its source, or the revisions of its sources
+// separated by commas
+func combinedRevision(sources []resolvedSource) string {
+	revisions := make([]string, 0, len(sources))
+	for _, source := range sources {
+		revisions = append(revisions, source.revision)
+	}
+	return strings.Join(revisions, ",")
+}
+
+// The tags semver constraints of the sources resolved to, separated by commas. Empty if no source has a constraint
+func combinedTag(sources []resolvedSource) string {
+	tags := make([]string, 0, len(sources))
+	resolved := false
+	for _, source := range sources {
+		tags = append(tags, source.tag)
+		resolved = resolved || source.tag != ""
+	}
+	if !resolved {
+		return ""
+	}
+	return strings.Join(tags, ",")
+}
+
+// Returns the commit SHA the i-th source was last synced at
+func lastSyncedRevision(app *gitopsv1.Application, i int) string {
+	revisions := strings.Split(app.Status.Sync.Revision, ",")
+	if i < len(revisions) {
+		return revisions[i]
+	}
+	return ""
+}
+
+// Merges the objects of all sources. Objects that are defined in several sources are merged field by
+// field; a field that is set to different values in two sources is a conflict
+func mergeSourceObjects(objsPerSource [][]*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	if len(objsPerSource) == 1 {
+		return objsPerSource[0], nil
+	}
+
+	var merged []*unstructured.Unstructured
+	byKey := make(map[resourceKey]*unstructured.Unstructured)
+	definedBy := make(map[resourceKey][]int)
+	var conflicts []string
+
+	for i, objs := range objsPerSource {
+		for _, obj := range objs {
+			key := keyOfResource(resourceFromObject(obj))
+			existing, ok := byKey[key]
+			if !ok {
+				byKey[key] = obj
+				merged = append(merged, obj)
+				definedBy[key] = append(definedBy[key], i)
+				continue
+			}
+
+			var paths []string
+			mergeFields(existing.Object, obj.Object, "", &paths)
+			sort.Strings(paths)
+			for _, path := range paths {
+				conflicts = append(conflicts, fmt.Sprintf("%s %s: %s is set to different values in sources %s and %d",
+					obj.GetKind(), describeObject(obj), path, joinInts(definedBy[key]), i))
+			}
+			definedBy[key] = append(definedBy[key], i)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("conflicting sources: %s", strings.Join(conflicts, "; "))
+	}
+	return merged, nil
+}
+
+// Adds the fields of src to dst and collects the paths of fields that are set in both with different values.
+// Nested objects are merged, all other values (including lists) must be equal
+func mergeFields(dst, src map[string]interface{}, path string, conflicts *[]string) {
+	for key, srcValue := range src {
+		fieldPath := path + "." + key
+		dstValue, ok := dst[key]
+		if !ok {
+			dst[key] = runtime.DeepCopyJSONValue(srcValue)
+			continue
+		}
+		dstMap, dstIsMap := dstValue.(map[string]interface{})
+		srcMap, srcIsMap := srcValue.(map[string]interface{})
+		if dstIsMap && srcIsMap {
+			mergeFields(dstMap, srcMap, fieldPath, conflicts)
+			continue
+		}
+		if !equality.Semantic.DeepEqual(dstValue, srcValue) {
+			*conflicts = append(*conflicts, fieldPath)
+		}
+	}
+}
+
+func describeObject(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+func joinInts(values []int) string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		strs = append(strs, fmt.Sprint(value))
+	}
+	return strings.Join(strs, ", ")
+}
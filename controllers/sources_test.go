@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestMergeSourceObjects(t *testing.T) {
+	newConfigMap := func(data map[string]interface{}) *unstructured.Unstructured {
+		obj := newObject("v1", "ConfigMap", "default", "config")
+		obj.Object["data"] = data
+		return obj
+	}
+	base := []*unstructured.Unstructured{
+		newConfigMap(map[string]interface{}{"log-level": "info"}),
+		newObject("v1", "Service", "default", "api"),
+	}
+	overlay := []*unstructured.Unstructured{
+		newConfigMap(map[string]interface{}{"log-level": "info", "replicas": "3"}),
+		newObject("v1", "Secret", "default", "credentials"),
+	}
+
+	merged, err := mergeSourceObjects([][]*unstructured.Unstructured{base, overlay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 3 {
+		t.Fatalf("expected 3 objects, got %d", len(merged))
+	}
+	data, _, _ := unstructured.NestedStringMap(merged[0].Object, "data")
+	if data["log-level"] != "info" || data["replicas"] != "3" {
+		t.Errorf("expected the config maps to be merged, got %v", data)
+	}
+
+	conflicting := []*unstructured.Unstructured{
+		newConfigMap(map[string]interface{}{"log-level": "debug"}),
+	}
+	_, err = mergeSourceObjects([][]*unstructured.Unstructured{
+		{newConfigMap(map[string]interface{}{"log-level": "info"})},
+		conflicting,
+	})
+	if err == nil || !strings.Contains(err.Error(), "ConfigMap default/config: .data.log-level is set to different values in sources 0 and 1") {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+}
+
+func TestLastSyncedRevision(t *testing.T) {
+	app := &gitopsv1.Application{}
+	app.Status.Sync.Revision = combinedRevision([]resolvedSource{{revision: "abc"}, {revision: "def"}})
+	if app.Status.Sync.Revision != "abc,def" {
+		t.Fatalf("unexpected combined revision %s", app.Status.Sync.Revision)
+	}
+	if lastSyncedRevision(app, 1) != "def" || lastSyncedRevision(app, 2) != "" {
+		t.Errorf("unexpected last synced revisions %q %q", lastSyncedRevision(app, 1), lastSyncedRevision(app, 2))
+	}
+}
+
+func TestCombinedTag(t *testing.T) {
+	if tag := combinedTag([]resolvedSource{{revision: "abc"}, {revision: "def"}}); tag != "" {
+		t.Errorf("expected no tag without semver constraints, got %q", tag)
+	}
+	if tag := combinedTag([]resolvedSource{{revision: "abc"}, {revision: "def", tag: "v1.4.3"}}); tag != ",v1.4.3" {
+		t.Errorf("expected the tag of the second source, got %q", tag)
+	}
+}
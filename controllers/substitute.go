@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	// annotation of resources that are not substituted, e.g. ConfigMaps with shell scripts
+	substituteAnnotation = "gitops.jellis18.gitopscontroller.io/substitute"
+	substituteDisabled   = "disabled"
+
+	// annotation with the text of the document an object was read from, if it references variables. Variables
+	// are substituted in the text, so the substituted values get the type YAML gives them. It is removed before
+	// the object is used
+	substituteDocumentAnnotation = "gitops.jellis18.gitopscontroller.io/substitute-document"
+)
+
+var (
+	variableNamePattern = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*$`)
+	// ${NAME}, ${NAME:=default} or ${NAME:-default}, escaped as $${NAME}
+	variableReferencePattern = regexp.MustCompile(`\$?\$\{([_a-zA-Z][_a-zA-Z0-9]*)(?::[=-]([^}]*))?\}`)
+)
+
+// Records the text of the document an object was read from if it references variables
+func setSubstituteDocument(obj *unstructured.Unstructured, document []byte) {
+	if !bytes.Contains(document, []byte("${")) {
+		return
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[substituteDocumentAnnotation] = string(document)
+	obj.SetAnnotations(annotations)
+}
+
+// Removes the document annotation of an object and returns the text of the document it was read from
+func popSubstituteDocument(obj *unstructured.Unstructured) (string, bool) {
+	annotations := obj.GetAnnotations()
+	document, ok := annotations[substituteDocumentAnnotation]
+	if !ok {
+		return "", false
+	}
+	delete(annotations, substituteDocumentAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	obj.SetAnnotations(annotations)
+	return document, true
+}
+
+// Substitutes the variables of the application's postBuild in the target objects in place. Like envsubst,
+// the variables are replaced in the text of the documents the objects were read from, which are decoded
+// again: `replicas: ${REPLICAS}` becomes a number, while a quoted "${PORT}" stays a string
+func (r *ApplicationReconciler) substituteVariables(ctx context.Context, app *gitopsv1.Application, objs []*unstructured.Unstructured) error {
+	documents := make(map[*unstructured.Unstructured]string)
+	for _, obj := range objs {
+		if document, ok := popSubstituteDocument(obj); ok {
+			documents[obj] = document
+		}
+	}
+	postBuild := app.Spec.PostBuild
+	if postBuild == nil || len(documents) == 0 {
+		return nil
+	}
+	vars, err := r.postBuildVariables(ctx, app.Namespace, postBuild)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		document, ok := documents[obj]
+		if !ok || obj.GetAnnotations()[substituteAnnotation] == substituteDisabled {
+			continue
+		}
+		undefined := map[string]bool{}
+		expanded := expandVariables(document, vars, undefined)
+		if postBuild.Strict && len(undefined) > 0 {
+			names := make([]string, 0, len(undefined))
+			for name := range undefined {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("%s %s references undefined variables: %s", obj.GetKind(), describeObject(obj), strings.Join(names, ", "))
+		}
+		substituted, err := decodeManifestDocument([]byte(expanded))
+		if err == nil && substituted == nil {
+			err = fmt.Errorf("the document is empty")
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s is invalid after substituting variables: %w", obj.GetKind(), describeObject(obj), err)
+		}
+		// the object was defaulted to the destination namespace
+		namespace := obj.GetNamespace()
+		obj.Object = substituted.Object
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+	}
+	return nil
+}
+
+// Collects the variables of the ConfigMaps and Secrets of substituteFrom and of substitute, later ones
+// overriding earlier ones
+func (r *ApplicationReconciler) postBuildVariables(ctx context.Context, namespace string, postBuild *gitopsv1.PostBuild) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, ref := range postBuild.SubstituteFrom {
+		key := types.NamespacedName{Namespace: namespace, Name: ref.Name}
+		data := make(map[string]string)
+		var err error
+		if ref.Kind == "Secret" {
+			var secret corev1.Secret
+			if err = r.Get(ctx, key, &secret); err == nil {
+				for name, value := range secret.Data {
+					data[name] = string(value)
+				}
+			}
+		} else {
+			var configMap corev1.ConfigMap
+			if err = r.Get(ctx, key, &configMap); err == nil {
+				data = configMap.Data
+			}
+		}
+		if client.IgnoreNotFound(err) != nil || (err != nil && !ref.Optional) {
+			return nil, fmt.Errorf("could not get %s %s with variables: %w", strings.ToLower(ref.Kind), ref.Name, err)
+		}
+		for name, value := range data {
+			if !variableNamePattern.MatchString(name) {
+				return nil, fmt.Errorf("%s %s: %q is not a valid variable name", strings.ToLower(ref.Kind), ref.Name, name)
+			}
+			vars[name] = value
+		}
+	}
+	for name, value := range postBuild.Substitute {
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+// Replaces the variable references of a string with their values, or their defaults if they are not set or
+// empty. References without a value are replaced with an empty string and added to undefined
+func expandVariables(s string, vars map[string]string, undefined map[string]bool) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+	return variableReferencePattern.ReplaceAllStringFunc(s, func(reference string) string {
+		if strings.HasPrefix(reference, "$$") {
+			return reference[1:]
+		}
+		match := variableReferencePattern.FindStringSubmatch(reference)
+		name, hasDefault := match[1], strings.Contains(reference, ":")
+		if value := vars[name]; value != "" {
+			return value
+		}
+		if hasDefault {
+			return match[2]
+		}
+		if _, ok := vars[name]; !ok {
+			undefined[name] = true
+		}
+		return ""
+	})
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestExpandVariables(t *testing.T) {
+	vars := map[string]string{"CLUSTER": "prod", "REGION": "eu-west-1", "EMPTY": ""}
+	for _, tc := range []struct {
+		value     string
+		want      string
+		undefined string
+	}{
+		{value: "${CLUSTER}", want: "prod"},
+		{value: "app-${CLUSTER}-${REGION}", want: "app-prod-eu-west-1"},
+		{value: "${REPLICAS:=2}", want: "2"},
+		{value: "${EMPTY:-fallback}", want: "fallback"},
+		{value: "${CLUSTER:=dev}", want: "prod"},
+		{value: "${EMPTY}", want: ""},
+		{value: "${MISSING}", want: "", undefined: "MISSING"},
+		{value: "$${CLUSTER}", want: "${CLUSTER}"},
+		{value: "echo $HOME ${1} ${foo.bar}", want: "echo $HOME ${1} ${foo.bar}"},
+		{value: "no variables", want: "no variables"},
+	} {
+		undefined := map[string]bool{}
+		if got := expandVariables(tc.value, vars, undefined); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.value, tc.want, got)
+		}
+		if (tc.undefined != "") != undefined[tc.undefined] || (tc.undefined == "" && len(undefined) > 0) {
+			t.Errorf("%s: expected undefined variable %q, got %v", tc.value, tc.undefined, undefined)
+		}
+	}
+}
+
+func TestSubstituteVariables(t *testing.T) {
+	clusterVars := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-vars", Namespace: "apps"},
+		Data:       map[string]string{"CLUSTER": "prod", "REPLICAS": "3", "REGION": "eu-west-1", "UMASK": "007"},
+	}
+	clusterSecrets := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster-secrets", Namespace: "apps"},
+		Data:       map[string][]byte{"REGION": []byte("us-east-1"), "DB_PASSWORD": []byte("hunter2")},
+	}
+	r := &ApplicationReconciler{Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(clusterVars, clusterSecrets).Build()}
+	ctx := context.Background()
+
+	manifest := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app-${CLUSTER}
+  namespace: apps
+  annotations:
+    replicas: "${REPLICAS}"
+spec:
+  replicas: ${REPLICAS}
+  paused: ${PAUSED:=false}
+  template:
+    spec:
+      containers:
+      - name: app
+        image: registry.example.com/app:${TAG:=latest}
+        args: ["--port", "${PORT:=8080}", "--umask", "${UMASK}"]
+        ports:
+        - containerPort: ${PORT:=8080}
+        env:
+        - name: REGION
+          value: ${REGION}
+        - name: PORT
+          value: "${PORT:=8080}"
+        - name: DB_PASSWORD
+          value: "${DB_PASSWORD}"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: script
+  namespace: apps
+  annotations:
+    gitops.jellis18.gitopscontroller.io/substitute: disabled
+data:
+  run.sh: echo ${CLUSTER}
+`
+	newObjs := func() []*unstructured.Unstructured {
+		objs, err := getResourcesFromYAMLOrJSON(strings.NewReader(manifest), "app.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range objs {
+			popOrigin(obj)
+		}
+		return objs
+	}
+
+	app := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"}}
+	app.Spec.PostBuild = &gitopsv1.PostBuild{
+		Substitute: map[string]string{"TAG": "v1.4.0"},
+		SubstituteFrom: []gitopsv1.SubstituteReference{
+			{Kind: "ConfigMap", Name: "cluster-vars"},
+			{Kind: "Secret", Name: "cluster-secrets"},
+			{Kind: "ConfigMap", Name: "optional-vars", Optional: true},
+		},
+		Strict: true,
+	}
+	objs := newObjs()
+	if err := r.substituteVariables(ctx, app, objs); err != nil {
+		t.Fatal(err)
+	}
+	deployment := objs[0]
+	if deployment.GetName() != "app-prod" {
+		t.Errorf("expected name app-prod, got %s", deployment.GetName())
+	}
+	// values are substituted in the text, so unquoted references get the type YAML gives them
+	spec := deployment.Object["spec"].(map[string]interface{})
+	if spec["replicas"] != int64(3) || spec["paused"] != false {
+		t.Errorf("expected a number and a boolean, got %#v and %#v", spec["replicas"], spec["paused"])
+	}
+	if annotation := deployment.GetAnnotations()["replicas"]; annotation != "3" {
+		t.Errorf("expected the quoted annotation to stay a string, got %q", annotation)
+	}
+	if _, ok := deployment.GetAnnotations()[substituteDocumentAnnotation]; ok {
+		t.Error("expected the document annotation to be removed")
+	}
+	containers, _, _ := unstructured.NestedSlice(deployment.Object, "spec", "template", "spec", "containers")
+	container := containers[0].(map[string]interface{})
+	if container["image"] != "registry.example.com/app:v1.4.0" {
+		t.Errorf("expected substitute to take precedence, got %v", container["image"])
+	}
+	if args, _, _ := unstructured.NestedStringSlice(container, "args"); strings.Join(args, " ") != "--port 8080 --umask 007" {
+		t.Errorf("expected the arguments to stay strings, got %#v", container["args"])
+	}
+	ports := container["ports"].([]interface{})
+	if port := ports[0].(map[string]interface{})["containerPort"]; port != int64(8080) {
+		t.Errorf("expected the container port to be a number, got %#v", port)
+	}
+	env := container["env"].([]interface{})
+	if region := env[0].(map[string]interface{})["value"]; region != "us-east-1" {
+		t.Errorf("expected later references to take precedence, got %v", region)
+	}
+	if port := env[1].(map[string]interface{})["value"]; port != "8080" {
+		t.Errorf("expected environment variables to stay strings, got %#v", port)
+	}
+	if script, _, _ := unstructured.NestedString(objs[1].Object, "data", "run.sh"); script != "echo ${CLUSTER}" {
+		t.Errorf("expected objects with substitution disabled to be left alone, got %q", script)
+	}
+	if _, ok := objs[1].GetAnnotations()[substituteDocumentAnnotation]; ok {
+		t.Error("expected the document annotation to be removed from objects with substitution disabled")
+	}
+
+	app.Spec.PostBuild.Substitute = nil
+	app.Spec.PostBuild.SubstituteFrom = []gitopsv1.SubstituteReference{{Kind: "ConfigMap", Name: "cluster-vars"}}
+	err := r.substituteVariables(ctx, app, newObjs())
+	if err == nil || !strings.Contains(err.Error(), "Deployment apps/app-${CLUSTER}") || !strings.Contains(err.Error(), "DB_PASSWORD") {
+		t.Errorf("expected an error for the undefined variable, got %v", err)
+	}
+
+	app.Spec.PostBuild.Strict = false
+	objs = newObjs()
+	if err := r.substituteVariables(ctx, app, objs); err != nil {
+		t.Fatal(err)
+	}
+	containers, _, _ = unstructured.NestedSlice(objs[0].Object, "spec", "template", "spec", "containers")
+	if image := containers[0].(map[string]interface{})["image"]; image != "registry.example.com/app:latest" {
+		t.Errorf("expected the default to be used, got %v", image)
+	}
+
+	// values are not quoted, so they can make a document invalid
+	app.Spec.PostBuild.Substitute = map[string]string{"REGION": "[eu-west-1"}
+	if err := r.substituteVariables(ctx, app, newObjs()); err == nil || !strings.Contains(err.Error(), "invalid after substituting variables") {
+		t.Errorf("expected an error for the invalid document, got %v", err)
+	}
+
+	app.Spec.PostBuild.SubstituteFrom = []gitopsv1.SubstituteReference{{Kind: "Secret", Name: "missing"}}
+	if err := r.substituteVariables(ctx, app, newObjs()); err == nil {
+		t.Error("expected an error for a missing secret")
+	}
+}
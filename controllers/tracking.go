@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	// identifies the application an object is managed by as <namespace>/<name>
+	trackingAnnotation = "gitops.jellis18.gitopscontroller.io/tracking-id"
+	// label values are limited to 63 characters, so the label is only used to find candidates
+	// and the annotation decides which application an object belongs to
+	trackingLabel = "gitops.jellis18.gitopscontroller.io/instance"
+)
+
+func trackingID(app *gitopsv1.Application) string {
+	return app.Namespace + "/" + app.Name
+}
+
+func trackingLabelValue(app *gitopsv1.Application) string {
+	// namespaces can't contain dots, so this is unique
+	value := app.Namespace + "." + app.Name
+	if len(value) > 63 {
+		sum := sha256.Sum256([]byte(value))
+		value = hex.EncodeToString(sum[:])[:63]
+	}
+	return value
+}
+
+// Stamps an object with the tracking label and annotation of the application
+func setTracking(obj client.Object, app *gitopsv1.Application) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[trackingAnnotation] = trackingID(app)
+	obj.SetAnnotations(annotations)
+
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[trackingLabel] = trackingLabelValue(app)
+	obj.SetLabels(labels)
+}
+
+// Returns the application an object is tracked by, if it is tracked by another application than app.
+// Untracked objects, e.g. objects created before they were added to git, can be adopted
+func trackedByOther(obj client.Object, app *gitopsv1.Application) (string, bool) {
+	owner, ok := obj.GetAnnotations()[trackingAnnotation]
+	return owner, ok && owner != "" && owner != trackingID(app)
+}
+
+// Returns the resources managed by an application. Besides the resources recorded in its status,
+// these are all objects in the cluster that carry the application's tracking annotation, so orphans
+// are pruned even if they were not recorded in the status
+func (r *ApplicationReconciler) managedResources(ctx context.Context, app *gitopsv1.Application) ([]gitopsv1.Resource, error) {
+	managed := append([]gitopsv1.Resource{}, app.Status.Resources...)
+	if r.Discovery == nil {
+		return managed, nil
+	}
+	reader, err := r.resourceReader(app)
+	if err != nil {
+		return nil, err
+	}
+	if reader == nil {
+		return managed, nil
+	}
+
+	tracked, err := r.discoverTrackedResources(ctx, reader, app)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[resourceKey]bool)
+	for _, resource := range managed {
+		known[keyOfResource(resource)] = true
+	}
+	for _, resource := range tracked {
+		if !known[keyOfResource(resource)] {
+			managed = append(managed, resource)
+		}
+	}
+	return managed, nil
+}
+
+// Lists the objects carrying the tracking label of the application. Listing every kind in the cluster is
+// expensive, so only the kinds recorded in the status are listed. All kinds that can be listed and deleted
+// are only searched if the status is empty, e.g. because it was lost when the application was restored.
+// Kinds the reader is not allowed to list are skipped
+func (r *ApplicationReconciler) discoverTrackedResources(ctx context.Context, reader client.Reader, app *gitopsv1.Application) ([]gitopsv1.Resource, error) {
+	kinds, err := r.trackedKinds(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []gitopsv1.Resource
+	for _, gvk := range kinds {
+		// only the metadata of the objects is needed
+		list := &metav1.PartialObjectMetadataList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		if err := reader.List(ctx, list, client.MatchingLabels{trackingLabel: trackingLabelValue(app)}); err != nil {
+			// the kind may no longer be served, e.g. if its CRD was removed, or the service account may not list it
+			if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) || apierrors.IsForbidden(err) {
+				continue
+			}
+			return nil, fmt.Errorf("could not list %s: %w", gvk.Kind, err)
+		}
+		for _, item := range list.Items {
+			if item.GetAnnotations()[trackingAnnotation] != trackingID(app) {
+				continue
+			}
+			resources = append(resources, gitopsv1.Resource{
+				Group:     gvk.Group,
+				Version:   gvk.Version,
+				Kind:      gvk.Kind,
+				Name:      item.Name,
+				Namespace: item.Namespace,
+			})
+		}
+	}
+	return resources, nil
+}
+
+// Returns the kinds to search for objects of the application, see discoverTrackedResources
+func (r *ApplicationReconciler) trackedKinds(ctx context.Context, app *gitopsv1.Application) ([]schema.GroupVersionKind, error) {
+	if len(app.Status.Resources) > 0 {
+		var kinds []schema.GroupVersionKind
+		seen := make(map[schema.GroupKind]bool)
+		for _, resource := range app.Status.Resources {
+			gk := schema.GroupKind{Group: resource.Group, Kind: resource.Kind}
+			if !seen[gk] {
+				seen[gk] = true
+				kinds = append(kinds, gk.WithVersion(resource.Version))
+			}
+		}
+		return kinds, nil
+	}
+
+	resourceLists, err := discovery.ServerPreferredResources(r.Discovery)
+	if err != nil {
+		// resources of the groups that could be discovered are still returned
+		if !discovery.IsGroupDiscoveryFailedError(err) {
+			return nil, fmt.Errorf("could not discover api resources: %w", err)
+		}
+		log.FromContext(ctx).Error(err, "could not discover all api groups, objects of these groups are not tracked")
+	}
+
+	var kinds []schema.GroupVersionKind
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, apiResource := range resourceList.APIResources {
+			if strings.Contains(apiResource.Name, "/") || !hasVerbs(apiResource, "list", "delete") {
+				continue
+			}
+			kinds = append(kinds, gv.WithKind(apiResource.Kind))
+		}
+	}
+	return kinds, nil
+}
+
+func hasVerbs(apiResource metav1.APIResource, verbs ...string) bool {
+	for _, verb := range verbs {
+		found := false
+		for _, v := range apiResource.Verbs {
+			if v == verb {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Identifies a resource independent of the api version it is served at
+type resourceKey struct{ name, namespace, group, kind string }
+
+func keyOfResource(resource gitopsv1.Resource) resourceKey {
+	return resourceKey{name: resource.Name, namespace: resource.Namespace, group: resource.Group, kind: resource.Kind}
+}
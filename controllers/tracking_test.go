@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+func TestManagedResources(t *testing.T) {
+	app := &gitopsv1.Application{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps"},
+		Status: gitopsv1.ApplicationStatus{
+			Resources: []gitopsv1.Resource{{Version: "v1", Kind: "ConfigMap", Namespace: "default", Name: "recorded"}},
+		},
+	}
+	other := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "apps"}}
+
+	tracked := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "tracked", Namespace: "default"}}
+	setTracking(tracked, app)
+	recorded := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "recorded", Namespace: "default"}}
+	setTracking(recorded, app)
+	foreign := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "foreign", Namespace: "default"}}
+	setTracking(foreign, other)
+	// same label value as app, but tracked by another application
+	impostor := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name:        "impostor",
+		Namespace:   "default",
+		Labels:      map[string]string{trackingLabel: trackingLabelValue(app)},
+		Annotations: map[string]string{trackingAnnotation: trackingID(other)},
+	}}
+	// only found by discovery, as no secrets are recorded in the status
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default"}}
+	setTracking(secret, app)
+
+	discovery := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: []*metav1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: metav1.Verbs{"list", "delete"}},
+			{Name: "secrets", Namespaced: true, Kind: "Secret", Verbs: metav1.Verbs{"list", "delete"}},
+			{Name: "pods/log", Namespaced: true, Kind: "Pod", Verbs: metav1.Verbs{"get"}},
+		},
+	}}}}
+	r := &ApplicationReconciler{
+		Discovery: discovery,
+		APIReader: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(tracked, recorded, foreign, impostor, secret).Build(),
+	}
+
+	managed, err := r.managedResources(context.Background(), app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(managed) != 2 || managed[0].Name != "recorded" || managed[1].Name != "tracked" {
+		t.Errorf("unexpected managed resources %v", managed)
+	}
+
+	// all kinds are searched if the status was lost
+	app.Status.Resources = nil
+	managed, err = r.managedResources(context.Background(), app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, resource := range managed {
+		names = append(names, resource.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "recorded,secret,tracked" {
+		t.Errorf("unexpected managed resources without status %v", names)
+	}
+
+	if owner, ok := trackedByOther(foreign, app); !ok || owner != "apps/other" {
+		t.Errorf("expected %s to be tracked by apps/other, got %q", foreign.Name, owner)
+	}
+	if _, ok := trackedByOther(tracked, app); ok {
+		t.Errorf("expected %s to be tracked by app", tracked.Name)
+	}
+	if _, ok := trackedByOther(&corev1.ConfigMap{}, app); ok {
+		t.Error("expected untracked objects to be adoptable")
+	}
+}
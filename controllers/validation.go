@@ -0,0 +1,341 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// annotation with the file and line an object was read from. It is removed before the object is used
+	originAnnotation = "gitops.jellis18.gitopscontroller.io/origin"
+
+	// number of invalid fields listed in the sync error, the others are only counted
+	maxValidationErrors = 20
+
+	quantitySchema = "#/components/schemas/io.k8s.apimachinery.pkg.api.resource.Quantity"
+)
+
+// Records the file and line an object was read from
+func setOrigin(obj *unstructured.Unstructured, file string, line int) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[originAnnotation] = fmt.Sprintf("%s:%d", file, line)
+	obj.SetAnnotations(annotations)
+}
+
+// Removes the origin annotation of an object and returns the file and line it was read from
+func popOrigin(obj *unstructured.Unstructured) string {
+	annotations := obj.GetAnnotations()
+	origin, ok := annotations[originAnnotation]
+	if !ok {
+		return ""
+	}
+	delete(annotations, originAnnotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	obj.SetAnnotations(annotations)
+	return origin
+}
+
+// The parts of an OpenAPI v3 schema needed to find unknown fields and type errors
+type openAPISchema struct {
+	Ref                   string                       `json:"$ref"`
+	Type                  string                       `json:"type"`
+	Format                string                       `json:"format"`
+	Properties            map[string]*openAPISchema    `json:"properties"`
+	AdditionalProperties  *openAPIAdditionalProperties `json:"additionalProperties"`
+	Items                 *openAPISchema               `json:"items"`
+	AllOf                 []*openAPISchema             `json:"allOf"`
+	AnyOf                 []*openAPISchema             `json:"anyOf"`
+	OneOf                 []*openAPISchema             `json:"oneOf"`
+	PreserveUnknownFields bool                         `json:"x-kubernetes-preserve-unknown-fields"`
+	IntOrString           bool                         `json:"x-kubernetes-int-or-string"`
+	EmbeddedResource      bool                         `json:"x-kubernetes-embedded-resource"`
+	GroupVersionKinds     []struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"x-kubernetes-group-version-kind"`
+}
+
+// additionalProperties is either a boolean or the schema of the values of a map
+type openAPIAdditionalProperties struct {
+	allowed bool
+	schema  *openAPISchema
+}
+
+func (p *openAPIAdditionalProperties) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.allowed); err == nil {
+		return nil
+	}
+	p.allowed = true
+	return json.Unmarshal(data, &p.schema)
+}
+
+// The OpenAPI v3 document of a group version
+type openAPIDocument struct {
+	Components struct {
+		Schemas map[string]*openAPISchema `json:"schemas"`
+	} `json:"components"`
+
+	kinds map[schema.GroupVersionKind]*openAPISchema
+}
+
+// openAPIDocuments caches the OpenAPI v3 documents of the API server by their URL. The URLs contain a hash
+// of the document, so a cached document is never stale
+type openAPIDocuments struct {
+	mu        sync.Mutex
+	documents map[string]*openAPIDocument
+}
+
+// Validates the target objects against the OpenAPI v3 schemas of the API server. Unknown fields and type
+// errors of all objects are reported together, so that nothing is applied if any object is invalid. Kinds
+// the API server doesn't know yet, e.g. of a CRD applied in the same sync, are not validated
+func (r *ApplicationReconciler) validateObjects(ctx context.Context, objs []*unstructured.Unstructured, origins map[*unstructured.Unstructured]string) error {
+	if r.Discovery == nil || r.Discovery.RESTClient() == nil || len(objs) == 0 {
+		return nil
+	}
+	paths, err := r.openAPIPaths(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get OpenAPI schemas: %w", err)
+	}
+
+	var errs []string
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		document, err := r.openAPIDocument(ctx, paths, gvk.GroupVersion())
+		if err != nil {
+			return fmt.Errorf("could not get OpenAPI schema of %s: %w", gvk.GroupVersion(), err)
+		}
+		if document == nil || document.kinds[gvk] == nil {
+			continue
+		}
+		location := fmt.Sprintf("%s %s", obj.GetKind(), describeObject(obj))
+		if origin := origins[obj]; origin != "" {
+			location = origin + ": " + location
+		}
+		var fieldErrs []string
+		document.validate(document.kinds[gvk], obj.Object, "", &fieldErrs)
+		for _, fieldErr := range fieldErrs {
+			errs = append(errs, location+": "+fieldErr)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) > maxValidationErrors {
+		errs = append(errs[:maxValidationErrors], fmt.Sprintf("and %d more", len(errs)-maxValidationErrors))
+	}
+	return fmt.Errorf("invalid manifests, nothing was applied: %s", strings.Join(errs, "; "))
+}
+
+// Returns the URLs of the OpenAPI v3 documents of the API server by group version path, e.g. apis/apps/v1.
+// Returns nil if the API server doesn't serve OpenAPI v3
+func (r *ApplicationReconciler) openAPIPaths(ctx context.Context) (map[string]string, error) {
+	data, err := r.Discovery.RESTClient().Get().AbsPath("/openapi/v3").Do(ctx).Raw()
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var discovery struct {
+		Paths map[string]struct {
+			ServerRelativeURL string `json:"serverRelativeURL"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &discovery); err != nil {
+		return nil, err
+	}
+	paths := make(map[string]string, len(discovery.Paths))
+	current := make(map[string]bool, len(discovery.Paths))
+	for path, groupVersion := range discovery.Paths {
+		paths[path] = groupVersion.ServerRelativeURL
+		current[groupVersion.ServerRelativeURL] = true
+	}
+
+	// documents of previous versions of the schemas, e.g. of updated CRDs, are not needed anymore
+	r.openAPIDocuments.mu.Lock()
+	defer r.openAPIDocuments.mu.Unlock()
+	for url := range r.openAPIDocuments.documents {
+		if !current[url] {
+			delete(r.openAPIDocuments.documents, url)
+		}
+	}
+	return paths, nil
+}
+
+// Returns the OpenAPI v3 document of a group version, or nil if the API server doesn't serve it
+func (r *ApplicationReconciler) openAPIDocument(ctx context.Context, paths map[string]string, gv schema.GroupVersion) (*openAPIDocument, error) {
+	path := "apis/" + gv.String()
+	if gv.Group == "" {
+		path = "api/" + gv.Version
+	}
+	url, ok := paths[path]
+	if !ok {
+		return nil, nil
+	}
+
+	r.openAPIDocuments.mu.Lock()
+	document, ok := r.openAPIDocuments.documents[url]
+	r.openAPIDocuments.mu.Unlock()
+	if ok {
+		return document, nil
+	}
+
+	data, err := r.Discovery.RESTClient().Get().RequestURI(url).SetHeader("Accept", "application/json").Do(ctx).Raw()
+	if err != nil {
+		return nil, err
+	}
+	document = &openAPIDocument{}
+	if err := json.Unmarshal(data, document); err != nil {
+		return nil, err
+	}
+	document.kinds = make(map[schema.GroupVersionKind]*openAPISchema)
+	for _, s := range document.Components.Schemas {
+		for _, gvk := range s.GroupVersionKinds {
+			document.kinds[schema.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}] = s
+		}
+	}
+
+	r.openAPIDocuments.mu.Lock()
+	defer r.openAPIDocuments.mu.Unlock()
+	if r.openAPIDocuments.documents == nil {
+		r.openAPIDocuments.documents = make(map[string]*openAPIDocument)
+	}
+	r.openAPIDocuments.documents[url] = document
+	return document, nil
+}
+
+// Checks a value against a schema and collects unknown fields and type errors with the path of the field.
+// Values are not part of the errors, as they may be decrypted secrets
+func (d *openAPIDocument) validate(s *openAPISchema, value interface{}, path string, errs *[]string) {
+	if s == nil || value == nil {
+		return
+	}
+	// quantities are strings in the schema, but numbers are accepted as well
+	if s.Ref == quantitySchema {
+		if t := jsonType(value); t != "string" && t != "integer" && t != "number" {
+			*errs = append(*errs, fmt.Sprintf("%s: expected a quantity, got %s", fieldPath(path), t))
+		}
+		return
+	}
+	if s.Ref != "" {
+		d.validate(d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")], value, path, errs)
+		return
+	}
+	for _, sub := range s.AllOf {
+		d.validate(sub, value, path, errs)
+	}
+
+	if s.IntOrString || s.Format == "int-or-string" {
+		if t := jsonType(value); t != "integer" && t != "string" {
+			*errs = append(*errs, fmt.Sprintf("%s: expected integer or string, got %s", fieldPath(path), t))
+		}
+		return
+	}
+	if alternatives := append(append([]*openAPISchema{}, s.AnyOf...), s.OneOf...); len(alternatives) > 0 && s.Type == "" {
+		// the value must have the type of one of the alternatives, their fields are not checked
+		var types []string
+		for _, alternative := range alternatives {
+			if alternative.Type == "" || matchesType(alternative.Type, value) {
+				return
+			}
+			types = append(types, alternative.Type)
+		}
+		*errs = append(*errs, fmt.Sprintf("%s: expected %s, got %s", fieldPath(path), strings.Join(types, " or "), jsonType(value)))
+		return
+	}
+
+	typ := s.Type
+	if typ == "" && len(s.Properties) > 0 {
+		typ = "object"
+	}
+	if typ == "" {
+		return
+	}
+	if !matchesType(typ, value) {
+		*errs = append(*errs, fmt.Sprintf("%s: expected %s, got %s", fieldPath(path), typ, jsonType(value)))
+		return
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			childPath := path + "." + key
+			if property, ok := s.Properties[key]; ok {
+				d.validate(property, child, childPath, errs)
+				continue
+			}
+			if s.AdditionalProperties != nil && s.AdditionalProperties.allowed {
+				d.validate(s.AdditionalProperties.schema, child, childPath, errs)
+				continue
+			}
+			// objects without properties are free-form
+			if s.PreserveUnknownFields || (len(s.Properties) == 0 && s.AdditionalProperties == nil) {
+				continue
+			}
+			if s.EmbeddedResource && (key == "apiVersion" || key == "kind" || key == "metadata") {
+				continue
+			}
+			*errs = append(*errs, fmt.Sprintf("%s: unknown field", childPath))
+		}
+	case []interface{}:
+		for i, item := range value {
+			d.validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+func matchesType(typ string, value interface{}) bool {
+	actual := jsonType(value)
+	switch typ {
+	case "number":
+		return actual == "integer" || actual == "number"
+	case "integer", "string", "boolean", "object", "array":
+		return actual == typ
+	default:
+		return true
+	}
+}
+
+// The JSON type of a value of an unstructured object
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64, int32, int:
+		return "integer"
+	case float64:
+		if value == float64(int64(value)) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func fieldPath(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
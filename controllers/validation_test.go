@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+const testAppsV1Schema = `{
+  "openapi": "3.0.0",
+  "components": {"schemas": {
+    "io.k8s.api.apps.v1.Deployment": {
+      "type": "object",
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"default": {}, "allOf": [{"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"}]},
+        "spec": {"default": {}, "allOf": [{"$ref": "#/components/schemas/io.k8s.api.apps.v1.DeploymentSpec"}]}
+      },
+      "x-kubernetes-group-version-kind": [{"group": "apps", "kind": "Deployment", "version": "v1"}]
+    },
+    "io.k8s.api.apps.v1.DeploymentSpec": {
+      "type": "object",
+      "properties": {
+        "replicas": {"type": "integer", "format": "int32"},
+        "paused": {"type": "boolean"},
+        "strategy": {"type": "object", "properties": {"rollingUpdate": {"type": "object", "properties": {
+          "maxSurge": {"allOf": [{"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.util.intstr.IntOrString"}]}
+        }}}},
+        "template": {"type": "object", "properties": {
+          "metadata": {"allOf": [{"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"}]},
+          "spec": {"type": "object", "properties": {"containers": {"type": "array", "items": {"type": "object", "properties": {
+            "name": {"type": "string"},
+            "image": {"type": "string"},
+            "resources": {"type": "object", "properties": {"limits": {"type": "object", "additionalProperties": {
+              "allOf": [{"$ref": "#/components/schemas/io.k8s.apimachinery.pkg.api.resource.Quantity"}]
+            }}}}
+          }}}}}
+        }}
+      }
+    },
+    "io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta": {
+      "type": "object",
+      "properties": {
+        "name": {"type": "string"},
+        "namespace": {"type": "string"},
+        "labels": {"type": "object", "additionalProperties": {"type": "string", "default": ""}},
+        "annotations": {"type": "object", "additionalProperties": {"type": "string", "default": ""}}
+      }
+    },
+    "io.k8s.apimachinery.pkg.util.intstr.IntOrString": {"type": "string", "format": "int-or-string"},
+    "io.k8s.apimachinery.pkg.api.resource.Quantity": {"type": "string"}
+  }}
+}`
+
+// An API server serving the OpenAPI v3 schema of apps/v1
+func newTestOpenAPIServer(schemaRequests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.URL.Path == "/openapi/v3":
+			w.Write([]byte(`{"paths": {"apis/apps/v1": {"serverRelativeURL": "/openapi/v3/apis/apps/v1?hash=0123abcd"}}}`))
+		case req.URL.Path == "/openapi/v3/apis/apps/v1" && req.URL.Query().Get("hash") == "0123abcd":
+			*schemaRequests++
+			w.Write([]byte(testAppsV1Schema))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+}
+
+func testDeployment(spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "apps", "labels": map[string]interface{}{"app": "web"}},
+		"spec":       spec,
+	}}
+}
+
+func TestValidateObjects(t *testing.T) {
+	var schemaRequests int
+	server := newTestOpenAPIServer(&schemaRequests)
+	defer server.Close()
+	r := &ApplicationReconciler{Discovery: discovery.NewDiscoveryClientForConfigOrDie(&rest.Config{Host: server.URL})}
+	ctx := context.Background()
+
+	valid := testDeployment(map[string]interface{}{
+		"replicas": int64(3),
+		"strategy": map[string]interface{}{"rollingUpdate": map[string]interface{}{"maxSurge": "25%"}},
+		"template": map[string]interface{}{"spec": map[string]interface{}{"containers": []interface{}{map[string]interface{}{
+			"name":      "web",
+			"image":     "web:v1",
+			"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": int64(1), "memory": "512Mi"}},
+		}}}},
+	})
+	crd := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"metadata":   map[string]interface{}{"name": "w"},
+		"spec":       map[string]interface{}{"anything": true},
+	}}
+	if err := r.validateObjects(ctx, []*unstructured.Unstructured{valid, crd}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := testDeployment(map[string]interface{}{
+		"replicas": "3",
+		"paused":   "no",
+		"strategy": map[string]interface{}{"rollingUpdate": map[string]interface{}{"maxSurge": true}},
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{"labelz": map[string]interface{}{"app": "web"}},
+			"spec": map[string]interface{}{"containers": []interface{}{
+				map[string]interface{}{"name": "web", "image": "web:v1"},
+				map[string]interface{}{"name": "sidecar", "imag": "sidecar:v1", "resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": []interface{}{}}}},
+			}},
+		},
+	})
+	invalid.Object["metadata"].(map[string]interface{})["labels"] = map[string]interface{}{"replicas": int64(3)}
+	origins := map[*unstructured.Unstructured]string{invalid: "apps/web.yaml:12"}
+	err := r.validateObjects(ctx, []*unstructured.Unstructured{valid, invalid}, origins)
+	if err == nil {
+		t.Fatal("expected the invalid deployment to be rejected")
+	}
+	for _, want := range []string{
+		"apps/web.yaml:12: Deployment apps/web: .spec.replicas: expected integer, got string",
+		".spec.paused: expected boolean, got string",
+		".spec.strategy.rollingUpdate.maxSurge: expected integer or string, got boolean",
+		".spec.template.metadata.labelz: unknown field",
+		".spec.template.spec.containers[1].imag: unknown field",
+		".spec.template.spec.containers[1].resources.limits.cpu: expected a quantity, got array",
+		".metadata.labels.replicas: expected string, got integer",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "sidecar:v1") {
+		t.Errorf("expected values not to be part of the error, got %v", err)
+	}
+	if schemaRequests != 1 {
+		t.Errorf("expected the schema to be fetched once, got %d requests", schemaRequests)
+	}
+
+	// API servers without OpenAPI v3 don't validate
+	withoutOpenAPI := httptest.NewServer(http.NotFoundHandler())
+	defer withoutOpenAPI.Close()
+	r = &ApplicationReconciler{Discovery: discovery.NewDiscoveryClientForConfigOrDie(&rest.Config{Host: withoutOpenAPI.URL})}
+	if err := r.validateObjects(ctx, []*unstructured.Unstructured{invalid}, origins); err != nil {
+		t.Errorf("expected no validation without OpenAPI v3, got %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const (
+	reasonCommitVerified     = "Verified"
+	reasonUnsigned           = "Unsigned"
+	reasonUntrustedKey       = "UntrustedKey"
+	reasonExpiredKey         = "ExpiredKey"
+	reasonRevokedKey         = "RevokedKey"
+	reasonInvalidSignature   = "InvalidSignature"
+	reasonVerificationFailed = "VerificationFailed"
+
+	pgpPublicKeyBlock = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	pgpSignatureBlock = "-----BEGIN PGP SIGNATURE-----"
+	sshSignatureBlock = "-----BEGIN SSH SIGNATURE-----"
+
+	// magic preamble and namespace of SSH signatures made by git
+	sshSignatureMagic     = "SSHSIG"
+	sshSignatureNamespace = "git"
+)
+
+// Sources whose commits can be signed
+type signedCommitSource interface {
+	// Returns the armored signature of a commit and the payload it signs. The signature is empty for unsigned commits
+	getCommitSignature(ctx context.Context, source gitopsv1.ApplicationSource, sha string) (signature, payload string, err error)
+}
+
+// Why a commit was refused, the reason of the CommitVerified condition
+type commitVerificationError struct {
+	reason  string
+	message string
+}
+
+func (e *commitVerificationError) Error() string {
+	return e.message
+}
+
+// Keys trusted to sign commits
+type trustedKeys struct {
+	gpg openpgp.EntityList
+	// SSH public keys in wire format
+	ssh [][]byte
+}
+
+// A commit is only verified once: if the i-th source is still at the revision it was last synced at and that
+// was verified, the commit is not fetched again on every sync
+func commitAlreadyVerified(app *gitopsv1.Application, i int, revision string) bool {
+	condition := meta.FindStatusCondition(app.Status.Conditions, gitopsv1.ConditionTypeCommitVerified)
+	return condition != nil && condition.Status == metav1.ConditionTrue && condition.ObservedGeneration == app.Generation &&
+		revision != "" && revision == lastSyncedRevision(app, i)
+}
+
+// Checks that the resolved commit of a source is signed by one of the keys trusted by the source. The
+// CommitVerified condition is set to false if it isn't
+func (r *ApplicationReconciler) verifyCommit(ctx context.Context, app *gitopsv1.Application, source resolvedSource) error {
+	err := r.checkCommitSignature(ctx, app.Namespace, source)
+	if err == nil {
+		return nil
+	}
+
+	reason := reasonVerificationFailed
+	var verificationErr *commitVerificationError
+	if errors.As(err, &verificationErr) {
+		reason = verificationErr.reason
+	}
+	meta.SetStatusCondition(&app.Status.Conditions, metav1.Condition{
+		Type:               gitopsv1.ConditionTypeCommitVerified,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: app.Generation,
+		Reason:             reason,
+		Message:            fmt.Sprintf("commit %s of %s: %s", source.revision, source.RepoURL, err),
+	})
+	return err
+}
+
+func (r *ApplicationReconciler) checkCommitSignature(ctx context.Context, namespace string, source resolvedSource) error {
+	signed, ok := source.client.(signedCommitSource)
+	if !ok {
+		return fmt.Errorf("commit verification is only supported for git repositories")
+	}
+	keys, err := r.getTrustedKeys(ctx, namespace, source.VerifyCommit)
+	if err != nil {
+		return err
+	}
+	signature, payload, err := signed.getCommitSignature(ctx, source.ApplicationSource, source.revision)
+	if err != nil {
+		return err
+	}
+	return verifyCommitSignature(keys, signature, payload)
+}
+
+// Sets the CommitVerified condition after the commits of all sources were verified, or removes it if no
+// source verifies commits
+func setCommitVerified(app *gitopsv1.Application, sources []resolvedSource) {
+	var verified []string
+	for _, source := range sources {
+		if source.VerifyCommit != nil {
+			verified = append(verified, source.revision)
+		}
+	}
+	if len(verified) == 0 {
+		meta.RemoveStatusCondition(&app.Status.Conditions, gitopsv1.ConditionTypeCommitVerified)
+		return
+	}
+	meta.SetStatusCondition(&app.Status.Conditions, metav1.Condition{
+		Type:               gitopsv1.ConditionTypeCommitVerified,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: app.Generation,
+		Reason:             reasonCommitVerified,
+		Message:            fmt.Sprintf("signed by a trusted key: %s", strings.Join(verified, ", ")),
+	})
+}
+
+// Reads the trusted keys from the ConfigMap or Secret referenced by verifyCommit
+func (r *ApplicationReconciler) getTrustedKeys(ctx context.Context, namespace string, ref *gitopsv1.CommitVerification) (*trustedKeys, error) {
+	key := types.NamespacedName{Namespace: namespace, Name: ref.Name}
+	data := make(map[string][]byte)
+	if ref.Kind == "Secret" {
+		var secret corev1.Secret
+		if err := r.Get(ctx, key, &secret); err != nil {
+			return nil, fmt.Errorf("could not get secret %s with trusted keys: %w", ref.Name, err)
+		}
+		data = secret.Data
+	} else {
+		var configMap corev1.ConfigMap
+		if err := r.Get(ctx, key, &configMap); err != nil {
+			return nil, fmt.Errorf("could not get config map %s with trusted keys: %w", ref.Name, err)
+		}
+		for name, value := range configMap.Data {
+			data[name] = []byte(value)
+		}
+		for name, value := range configMap.BinaryData {
+			data[name] = value
+		}
+	}
+	return parseTrustedKeys(data)
+}
+
+// Every entry is an armored GPG public key or SSH public keys in authorized_keys format
+func parseTrustedKeys(data map[string][]byte) (*trustedKeys, error) {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := &trustedKeys{}
+	for _, name := range names {
+		value := data[name]
+		if bytes.Contains(value, []byte(pgpPublicKeyBlock)) {
+			entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid GPG key %s: %w", name, err)
+			}
+			keys.gpg = append(keys.gpg, entities...)
+			continue
+		}
+		for rest := value; len(bytes.TrimSpace(rest)) > 0; {
+			var key ssh.PublicKey
+			var err error
+			key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SSH key %s: %w", name, err)
+			}
+			keys.ssh = append(keys.ssh, key.Marshal())
+		}
+	}
+	if len(keys.gpg) == 0 && len(keys.ssh) == 0 {
+		return nil, fmt.Errorf("no trusted keys found")
+	}
+	return keys, nil
+}
+
+// Verifies a GPG or SSH signature of a commit
+func verifyCommitSignature(keys *trustedKeys, signature, payload string) error {
+	signature = strings.TrimSpace(signature)
+	switch {
+	case signature == "":
+		return &commitVerificationError{reason: reasonUnsigned, message: "commit is not signed"}
+	case strings.HasPrefix(signature, pgpSignatureBlock):
+		// keys and signatures are checked for expiry and revocation as well
+		_, err := openpgp.CheckArmoredDetachedSignature(keys.gpg, strings.NewReader(payload), strings.NewReader(signature), nil)
+		switch {
+		case errors.Is(err, pgperrors.ErrUnknownIssuer):
+			return &commitVerificationError{reason: reasonUntrustedKey, message: "commit is signed by an untrusted GPG key"}
+		case errors.Is(err, pgperrors.ErrKeyExpired) || errors.Is(err, pgperrors.ErrSignatureExpired):
+			return &commitVerificationError{reason: reasonExpiredKey, message: fmt.Sprintf("commit is signed by an expired GPG key: %s", err)}
+		case errors.Is(err, pgperrors.ErrKeyRevoked):
+			return &commitVerificationError{reason: reasonRevokedKey, message: "commit is signed by a revoked GPG key"}
+		}
+		if err != nil {
+			return &commitVerificationError{reason: reasonInvalidSignature, message: fmt.Sprintf("invalid GPG signature: %s", err)}
+		}
+		return nil
+	case strings.HasPrefix(signature, sshSignatureBlock):
+		return verifySSHSignature(keys, signature, payload)
+	default:
+		return &commitVerificationError{reason: reasonInvalidSignature, message: "unsupported signature format"}
+	}
+}
+
+// Verifies an SSH signature in the format of ssh-keygen -Y sign, as used by git
+func verifySSHSignature(keys *trustedKeys, signature, payload string) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &commitVerificationError{reason: reasonInvalidSignature, message: "invalid SSH signature: " + fmt.Sprintf(format, args...)}
+	}
+
+	block, _ := pem.Decode([]byte(signature))
+	if block == nil || !bytes.HasPrefix(block.Bytes, []byte(sshSignatureMagic)) {
+		return invalid("malformed signature")
+	}
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes[len(sshSignatureMagic):], &sig); err != nil {
+		return invalid("%s", err)
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return invalid("namespace %q is not %q", sig.Namespace, sshSignatureNamespace)
+	}
+
+	publicKey, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return invalid("%s", err)
+	}
+	trusted := false
+	for _, key := range keys.ssh {
+		trusted = trusted || bytes.Equal(key, sig.PublicKey)
+	}
+	if !trusted {
+		return &commitVerificationError{reason: reasonUntrustedKey,
+			message: fmt.Sprintf("commit is signed by untrusted SSH key %s", ssh.FingerprintSHA256(publicKey))}
+	}
+
+	var hash []byte
+	switch sig.HashAlgorithm {
+	case "sha256":
+		sum := sha256.Sum256([]byte(payload))
+		hash = sum[:]
+	case "sha512":
+		sum := sha512.Sum512([]byte(payload))
+		hash = sum[:]
+	default:
+		return invalid("unsupported hash algorithm %s", sig.HashAlgorithm)
+	}
+	signed := append([]byte(sshSignatureMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, hash})...)
+
+	var sshSig ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &sshSig); err != nil {
+		return invalid("%s", err)
+	}
+	if err := publicKey.Verify(signed, &sshSig); err != nil {
+		return invalid("%s", err)
+	}
+	return nil
+}
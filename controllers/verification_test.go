@@ -0,0 +1,260 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
+)
+
+const testCommitPayload = "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\nauthor CI <ci@example.com> 1700000000 +0000\ncommitter CI <ci@example.com> 1700000000 +0000\n\nRelease v1.4.0\n"
+
+func newGPGKey(t *testing.T) (*openpgp.Entity, string) {
+	return newGPGKeyWithConfig(t, nil)
+}
+
+// Creates a GPG key with the config, e.g. created in the past with a short lifetime
+func newGPGKeyWithConfig(t *testing.T, config *packet.Config) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("CI", "", "ci@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity, armoredGPGPublicKey(t, entity)
+}
+
+func armoredGPGPublicKey(t *testing.T, entity *openpgp.Entity) string {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.String()
+}
+
+func gpgSign(t *testing.T, entity *openpgp.Entity, payload string) string {
+	return gpgSignWithConfig(t, entity, payload, nil)
+}
+
+func gpgSignWithConfig(t *testing.T, entity *openpgp.Entity, payload string, config *packet.Config) string {
+	var buf bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&buf, entity, strings.NewReader(payload), config); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func newSSHKey(t *testing.T) (ssh.Signer, string) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+// Signs the payload like ssh-keygen -Y sign -n git
+func sshSign(t *testing.T, signer ssh.Signer, payload string) string {
+	hash := sha512.Sum512([]byte(payload))
+	signed := append([]byte(sshSignatureMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sshSignatureNamespace, "", "sha512", hash[:]})...)
+	sig, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte(sshSignatureMagic), ssh.Marshal(struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}{1, signer.PublicKey().Marshal(), sshSignatureNamespace, "", "sha512", ssh.Marshal(sig)})...)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob}))
+}
+
+func TestVerifyCommitSignature(t *testing.T) {
+	gpgKey, gpgPublicKey := newGPGKey(t)
+	untrustedGPGKey, _ := newGPGKey(t)
+	sshKey, sshPublicKey := newSSHKey(t)
+	untrustedSSHKey, _ := newSSHKey(t)
+
+	// created a year ago and valid for a day
+	past := &packet.Config{Time: func() time.Time { return time.Now().AddDate(-1, 0, 0) }, KeyLifetimeSecs: 24 * 60 * 60}
+	expiredGPGKey, expiredGPGPublicKey := newGPGKeyWithConfig(t, past)
+	// revoked after it signed the commit
+	revokedGPGKey, _ := newGPGKey(t)
+	revokedSignature := gpgSign(t, revokedGPGKey, testCommitPayload)
+	if err := revokedGPGKey.RevokeKey(packet.KeyCompromised, "leaked", nil); err != nil {
+		t.Fatal(err)
+	}
+	revokedGPGPublicKey := armoredGPGPublicKey(t, revokedGPGKey)
+
+	keys, err := parseTrustedKeys(map[string][]byte{
+		"release.asc":     []byte(gpgPublicKey),
+		"expired.asc":     []byte(expiredGPGPublicKey),
+		"revoked.asc":     []byte(revokedGPGPublicKey),
+		"authorized_keys": []byte("# CI\n" + sshPublicKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		signature string
+		payload   string
+		reason    string
+	}{
+		"gpg":                      {signature: gpgSign(t, gpgKey, testCommitPayload)},
+		"ssh":                      {signature: sshSign(t, sshKey, testCommitPayload)},
+		"unsigned":                 {reason: reasonUnsigned},
+		"untrusted gpg key":        {signature: gpgSign(t, untrustedGPGKey, testCommitPayload), reason: reasonUntrustedKey},
+		"expired gpg key":          {signature: gpgSignWithConfig(t, expiredGPGKey, testCommitPayload, past), reason: reasonExpiredKey},
+		"revoked gpg key":          {signature: revokedSignature, reason: reasonRevokedKey},
+		"untrusted ssh key":        {signature: sshSign(t, untrustedSSHKey, testCommitPayload), reason: reasonUntrustedKey},
+		"tampered gpg commit":      {signature: gpgSign(t, gpgKey, testCommitPayload), payload: testCommitPayload + "x", reason: reasonInvalidSignature},
+		"tampered ssh commit":      {signature: sshSign(t, sshKey, testCommitPayload), payload: testCommitPayload + "x", reason: reasonInvalidSignature},
+		"unknown signature format": {signature: "-----BEGIN X509 SIGNATURE-----", reason: reasonInvalidSignature},
+	} {
+		payload := tc.payload
+		if payload == "" {
+			payload = testCommitPayload
+		}
+		err := verifyCommitSignature(keys, tc.signature, payload)
+		if tc.reason == "" {
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			continue
+		}
+		verificationErr, ok := err.(*commitVerificationError)
+		if !ok || verificationErr.reason != tc.reason {
+			t.Errorf("%s: expected %s, got %v", name, tc.reason, err)
+		}
+	}
+
+	if _, err := parseTrustedKeys(map[string][]byte{"empty": []byte("\n")}); err == nil {
+		t.Error("expected an error without keys")
+	}
+	if _, err := parseTrustedKeys(map[string][]byte{"invalid": []byte("ssh-ed25519 not-a-key")}); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+}
+
+// A git source serving a single signed commit
+type testSignedSource struct {
+	signature string
+}
+
+func (s *testSignedSource) resolveRevision(ctx context.Context, source gitopsv1.ApplicationSource, lastRevision string) (string, error) {
+	return "abc123", nil
+}
+
+func (s *testSignedSource) getRepoObjs(ctx context.Context, source gitopsv1.ApplicationSource, revision string) ([]*unstructured.Unstructured, error) {
+	return nil, nil
+}
+
+func (s *testSignedSource) getCommitSignature(ctx context.Context, source gitopsv1.ApplicationSource, sha string) (string, string, error) {
+	return s.signature, testCommitPayload, nil
+}
+
+func TestVerifyCommit(t *testing.T) {
+	sshKey, sshPublicKey := newSSHKey(t)
+	untrustedSSHKey, _ := newSSHKey(t)
+	keys := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "trusted-keys", Namespace: "apps"},
+		Data:       map[string]string{"ci": sshPublicKey},
+	}
+	r := &ApplicationReconciler{Client: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(keys).Build()}
+	ctx := context.Background()
+
+	app := &gitopsv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "apps", Generation: 1}}
+	source := resolvedSource{
+		ApplicationSource: gitopsv1.ApplicationSource{
+			RepoURL:      "https://github.com/org/repo",
+			VerifyCommit: &gitopsv1.CommitVerification{Name: "trusted-keys"},
+		},
+		client:   &testSignedSource{signature: sshSign(t, untrustedSSHKey, testCommitPayload)},
+		revision: "abc123",
+	}
+
+	if err := r.verifyCommit(ctx, app, source); err == nil {
+		t.Fatal("expected a commit signed by an untrusted key to be refused")
+	}
+	condition := meta.FindStatusCondition(app.Status.Conditions, gitopsv1.ConditionTypeCommitVerified)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != reasonUntrustedKey {
+		t.Errorf("expected the CommitVerified condition to be false, got %+v", condition)
+	}
+
+	source.client = &testSignedSource{signature: sshSign(t, sshKey, testCommitPayload)}
+	if err := r.verifyCommit(ctx, app, source); err != nil {
+		t.Fatal(err)
+	}
+	setCommitVerified(app, []resolvedSource{source})
+	if !meta.IsStatusConditionTrue(app.Status.Conditions, gitopsv1.ConditionTypeCommitVerified) {
+		t.Errorf("expected the CommitVerified condition to be true, got %+v", app.Status.Conditions)
+	}
+
+	// verified commits are not verified again once they are synced
+	if commitAlreadyVerified(app, 0, "abc123") {
+		t.Error("expected a commit that was not synced yet to be verified")
+	}
+	app.Status.Sync.Revision = "abc123"
+	if !commitAlreadyVerified(app, 0, "abc123") {
+		t.Error("expected the synced commit not to be verified again")
+	}
+	if commitAlreadyVerified(app, 0, "def456") {
+		t.Error("expected a new commit to be verified")
+	}
+	app.Generation++
+	if commitAlreadyVerified(app, 0, "abc123") {
+		t.Error("expected the commit to be verified again after the spec changed")
+	}
+	app.Generation--
+
+	source.VerifyCommit = &gitopsv1.CommitVerification{Kind: "Secret", Name: "trusted-keys"}
+	if err := r.verifyCommit(ctx, app, source); err == nil || !strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected an error for a missing secret, got %v", err)
+	}
+	if condition := meta.FindStatusCondition(app.Status.Conditions, gitopsv1.ConditionTypeCommitVerified); condition.Reason != reasonVerificationFailed {
+		t.Errorf("expected verification to fail, got %+v", condition)
+	}
+
+	source.client = newBundleClient(nil, nil)
+	if err := r.verifyCommit(ctx, app, source); err == nil {
+		t.Error("expected an error for a source without commits")
+	}
+
+	setCommitVerified(app, []resolvedSource{{revision: "abc123"}})
+	if meta.FindStatusCondition(app.Status.Conditions, gitopsv1.ConditionTypeCommitVerified) != nil {
+		t.Error("expected the condition to be removed without verified sources")
+	}
+}
@@ -17,25 +17,39 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	gitopsv1 "github.com/jellis18/gitops-controller/api/v1"
 	"github.com/jellis18/gitops-controller/controllers"
 	//+kubebuilder:scaffold:imports
 )
 
+// How often cached api discovery results are refreshed
+const discoveryRefreshInterval = 10 * time.Minute
+
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
@@ -52,11 +66,46 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var manifestCacheSize int
+	var manifestCacheDir string
+	var manifestCacheDiskSize int
+	var fetchMode string
+	var responseCacheBytes int64
+	var gitWebhookAddr string
+	var gitWebhookSecretFile string
+	var decryptionSecret string
+	var defaultServiceAccount string
+	var projectNamespace string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&manifestCacheSize, "manifest-cache-size", 128,
+		"Maximum number of manifest sets (repo, revision and path) fetched from git to keep in memory.")
+	flag.StringVar(&manifestCacheDir, "manifest-cache-dir", "",
+		"Directory to spill manifest sets evicted from memory to. Spilling is disabled if empty.")
+	flag.IntVar(&manifestCacheDiskSize, "manifest-cache-disk-size", 1024,
+		"Maximum number of manifest sets to keep in the manifest cache directory.")
+	flag.StringVar(&fetchMode, "fetch-mode", string(controllers.FetchModeContents),
+		"How manifests are fetched from github. One of 'contents' (one request per file) "+
+			"or 'archive' (a single tarball of the repository per sync).")
+	flag.Int64Var(&responseCacheBytes, "github-response-cache-bytes", 64<<20,
+		"Maximum size of github responses cached for conditional requests. Set to 0 to disable the cache.")
+	flag.StringVar(&gitWebhookAddr, "git-webhook-bind-address", "0",
+		"The address the git push webhook receiver binds to, e.g. :8082. Set to 0 to disable the receiver.")
+	flag.StringVar(&gitWebhookSecretFile, "git-webhook-secret-file", "",
+		"File containing the secret used to verify git push webhooks. Required if the receiver is enabled.")
+	flag.StringVar(&decryptionSecret, "sops-decryption-secret", "",
+		"Secret (namespace/name) with the age identities (*.agekey) and PGP private keys (*.asc) "+
+			"used to decrypt SOPS-encrypted manifests. Encrypted manifests fail to sync if empty.")
+	flag.StringVar(&defaultServiceAccount, "default-service-account", "",
+		"Service account impersonated for Applications that don't set spec.serviceAccountName, e.g. 'default' "+
+			"if Applications are managed by tenants. If empty, these Applications use the controller's own permissions.")
+	flag.StringVar(&projectNamespace, "project-namespace", "",
+		"Namespace Projects are read from, e.g. the controller's namespace, if Applications are managed by tenants. "+
+			"Applications without a project are then restricted by the project named default. "+
+			"If empty, Projects are read from the namespace of each Application.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -89,13 +138,107 @@ func main() {
 		os.Exit(1)
 	}
 
+	if fetchMode != string(controllers.FetchModeContents) && fetchMode != string(controllers.FetchModeArchive) {
+		setupLog.Error(fmt.Errorf("unknown fetch mode %q", fetchMode), "invalid flags")
+		os.Exit(1)
+	}
+
+	var decryptionSecretKey types.NamespacedName
+	if decryptionSecret != "" {
+		namespace, name, ok := strings.Cut(decryptionSecret, "/")
+		if !ok || namespace == "" || name == "" {
+			setupLog.Error(fmt.Errorf("decryption secret %q is not of the form namespace/name", decryptionSecret), "invalid flags")
+			os.Exit(1)
+		}
+		decryptionSecretKey = types.NamespacedName{Namespace: namespace, Name: name}
+	}
+
+	manifestCache, err := controllers.NewManifestCache(manifestCacheSize, manifestCacheDir, manifestCacheDiskSize)
+	if err != nil {
+		setupLog.Error(err, "unable to create manifest cache")
+		os.Exit(1)
+	}
+
+	var responseCache *controllers.GithubResponseCache
+	if responseCacheBytes > 0 {
+		responseCache = controllers.NewGithubResponseCache(responseCacheBytes)
+	}
+
+	var pushEvents chan event.GenericEvent
+	if gitWebhookAddr != "0" {
+		if gitWebhookSecretFile == "" {
+			setupLog.Error(fmt.Errorf("the git push webhook receiver requires --git-webhook-secret-file"), "invalid flags")
+			os.Exit(1)
+		}
+		secret, err := os.ReadFile(gitWebhookSecretFile)
+		if err != nil {
+			setupLog.Error(err, "unable to read git webhook secret")
+			os.Exit(1)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			setupLog.Error(fmt.Errorf("git webhook secret file %s is empty", gitWebhookSecretFile), "invalid flags")
+			os.Exit(1)
+		}
+
+		pushEvents = make(chan event.GenericEvent)
+		if err := mgr.Add(&controllers.PushWebhookReceiver{
+			Client:      mgr.GetClient(),
+			BindAddress: gitWebhookAddr,
+			Secret:      secret,
+			Events:      pushEvents,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up git push webhook receiver")
+			os.Exit(1)
+		}
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create discovery client")
+		os.Exit(1)
+	}
+	// api resources are discovered at most once per refresh interval, so CRDs added later are found eventually
+	cachedDiscoveryClient := memory.NewMemCacheClient(discoveryClient)
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		wait.UntilWithContext(ctx, func(context.Context) { cachedDiscoveryClient.Invalidate() }, discoveryRefreshInterval)
+		return nil
+	})); err != nil {
+		setupLog.Error(err, "unable to set up discovery refresh")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.ApplicationReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                    mgr.GetClient(),
+		Scheme:                    mgr.GetScheme(),
+		ManifestCache:             manifestCache,
+		FetchMode:                 controllers.FetchMode(fetchMode),
+		ResponseCache:             responseCache,
+		PushEvents:                pushEvents,
+		Discovery:                 cachedDiscoveryClient,
+		APIReader:                 mgr.GetAPIReader(),
+		Config:                    mgr.GetConfig(),
+		DecryptionSecret:          decryptionSecretKey,
+		DefaultServiceAccountName: defaultServiceAccount,
+		ProjectNamespace:          projectNamespace,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Application")
 		os.Exit(1)
 	}
+	if err = (&controllers.ApplicationSetReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		ResponseCache: responseCache,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ApplicationSet")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&gitopsv1.Application{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Application")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {